@@ -4,143 +4,81 @@
 package main
 
 import (
-	"fmt"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
-	"path"
-	"path/filepath"
+	"strings"
 
 	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
 )
 
+const (
+	defaultSystemCACerts = "/etc/ssl/certs/" + certs.BundleFileName
+	outputDir            = "/workspace"
+)
+
 func main() {
 	logger := log.New(os.Stdout, "", 0)
 
-	tempLocal, err := ioutil.TempDir("", "local")
-	if err != nil {
-		log.Fatal(err)
+	if helperPath := os.Getenv(certs.HelperPathEnv); helperPath != "" {
+		logger.Printf("Installing helper to %s...\n", helperPath)
+		if err := certs.InstallHelper(helperPath); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-	defer os.RemoveAll(tempLocal)
 
-	tempCerts, err := ioutil.TempDir("", "certs")
-	if err != nil {
-		log.Fatal(err)
+	systemCACerts := os.Getenv("SYSTEM_CA_CERTS")
+	if systemCACerts == "" {
+		systemCACerts = defaultSystemCACerts
 	}
-	defer os.RemoveAll(tempCerts)
 
-	logger.Println("Parsing certificate(s)...")
-	caCerts, err := certs.Parse("CA_CERTS_DATA", os.Environ())
+	strategy, err := certs.StrategyFor(os.Getenv(certs.StrategyEnv))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	logger.Printf("Populate %d certificate(s)...\n", len(caCerts))
-	for i, cert := range caCerts {
-		writeCert(tempLocal, i, cert)
-	}
-
-	logger.Println("Update CA certificates...")
-	cmd := exec.Command("update-ca-certificates", "--etccertsdir", tempCerts, "--localcertsdir", tempLocal)
-	out, err := cmd.CombinedOutput()
+	javaTrustStoreType, err := certs.ParseJavaTrustStoreType(os.Getenv(certs.JavaTrustStoreTypeEnv))
 	if err != nil {
 		log.Fatal(err)
 	}
-	logger.Println(string(out))
 
-	logger.Println("Forcing the generation of hashed symlinks...")
-	cmd = exec.Command("c_rehash", tempCerts)
-	err = cmd.Run()
-	if err != nil {
-		log.Fatal(err)
-	}
+	store := certs.NewTrustStore()
 
-	logger.Println("Copying CA certificates...")
-	err = CopyDir(tempCerts, "/workspace")
-	if err != nil {
+	logger.Printf("Reading system certificate(s) from %s...\n", systemCACerts)
+	systemData, err := os.ReadFile(systemCACerts)
+	if err != nil && !os.IsNotExist(err) {
 		log.Fatal(err)
 	}
 
-	logger.Println("Finished setting up CA certificates")
-}
+	n, skipped := store.AddSystem("system_ca", systemData)
+	for _, err := range skipped {
+		logger.Printf("Skipping system certificate: %v\n", err)
+	}
+	logger.Printf("Added %d system certificate(s)\n", n)
 
-func writeCert(dir string, i int, cert string) {
-	file, err := os.Create(filepath.Join(dir, fmt.Sprintf("cert_injection_webhook_%d.crt", i)))
+	logger.Println("Parsing certificate(s)...")
+	caCerts, err := certs.Parse("CA_CERTS_DATA", os.Environ())
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer file.Close()
 
-	_, err = file.WriteString(cert)
+	n, err = store.Add("cert_injection_webhook", []byte(strings.Join(caCerts, "\n")))
 	if err != nil {
 		log.Fatal(err)
 	}
-}
-
-func CopyDir(src string, dest string) error {
-	var (
-		err  error
-		fds  []os.FileInfo
-		info os.FileInfo
-	)
-
-	if info, err = os.Stat(src); err != nil {
-		return err
-	}
-
-	if err = os.MkdirAll(dest, info.Mode()); err != nil {
-		return err
-	}
+	logger.Printf("Added %d injected certificate(s)\n", n)
 
-	if fds, err = ioutil.ReadDir(src); err != nil {
-		return err
+	logger.Printf("Writing %d certificate(s) to %s for %s...\n", store.Len(), outputDir, strategy.Name)
+	if err := store.Write(outputDir, strategy); err != nil {
+		log.Fatal(err)
 	}
 
-	for _, fd := range fds {
-		srcPath := path.Join(src, fd.Name())
-		destPath := path.Join(dest, fd.Name())
-
-		if fd.IsDir() {
-			if err = CopyDir(srcPath, destPath); err != nil {
-				return err
-			}
-		} else {
-			if err = CopyFile(srcPath, destPath); err != nil {
-				return err
-			}
+	if javaTrustStoreType != certs.JavaTrustStorePKCS12 {
+		logger.Printf("Writing %s Java truststore...\n", javaTrustStoreType)
+		if err := store.WriteJava(outputDir, strategy, javaTrustStoreType); err != nil {
+			log.Fatal(err)
 		}
 	}
 
-	return nil
-}
-
-func CopyFile(src, dest string) error {
-	var (
-		err      error
-		srcFile  *os.File
-		destFile *os.File
-		info     os.FileInfo
-	)
-
-	if srcFile, err = os.Open(src); err != nil {
-		return err
-	}
-	defer srcFile.Close()
-
-	if destFile, err = os.Create(dest); err != nil {
-		return err
-	}
-	defer destFile.Close()
-
-	if _, err = io.Copy(destFile, srcFile); err != nil {
-		return err
-	}
-
-	if info, err = os.Stat(src); err != nil {
-		return err
-	}
-
-	return os.Chmod(dest, info.Mode())
+	logger.Println("Finished setting up CA certificates")
 }
@@ -5,16 +5,18 @@ package main
 
 import (
 	"context"
-	"encoding/base64"
 	"flag"
-	"io"
-	"io/ioutil"
 	"log"
 	"os"
+	"runtime/debug"
 	"strconv"
 	"strings"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
+	k8slabels "k8s.io/apimachinery/pkg/labels"
+	"k8s.io/client-go/tools/record"
+	filteredinformerfactory "knative.dev/pkg/client/injection/kube/informers/factory/filtered"
 	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
 	"knative.dev/pkg/injection"
@@ -24,6 +26,8 @@ import (
 	"knative.dev/pkg/webhook/certificates"
 
 	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+	namedconfigmapinformer "github.com/vmware-tanzu/cert-injection-webhook/pkg/client/injection/informers/core/v1/configmap/named"
 )
 
 const (
@@ -31,10 +35,8 @@ const (
 	webhookPath              = "/certinjectionwebhook"
 	defaultWebhookSecretName = "cert-injection-webhook-tls"
 	defaultWebhookPort       = 8443
-	caCertsFile              = "/run/config_maps/ca_cert/ca.crt"
-	httpProxyFile            = "/run/config_maps/http_proxy/value"
-	httpsProxyFile           = "/run/config_maps/https_proxy/value"
-	noProxyFile              = "/run/config_maps/no_proxy/value"
+	defaultNamespaceLabel    = "cert-injection.tanzu.vmware.com/inject"
+	defaultSystemCACerts     = "/etc/ssl/certs/" + certs.BundleFileName
 )
 
 type labelAnnotationFlags []string
@@ -48,11 +50,53 @@ func (l *labelAnnotationFlags) String() string {
 	return strings.Join(*l, ", ")
 }
 
-var labels, annotations labelAnnotationFlags
+var (
+	labels, annotations labelAnnotationFlags
+	namespaceLabel      string
+	proxyEnvPrecedence  string
+	trustStore          string
+	javaToolOptions     bool
+	javaTrustStoreType  string
+	runtimeProfiles     string
+	injectionMode       string
+	mountMode           string
+	mountPath           string
+	mountFiles          string
+	expiryThresholds    string
+	caSources           string
+	certManagerNS       string
+	caRotationOverlap   time.Duration
+	publishBundle       string
+	publishNamespaces   string
+	extraCAConfigMap    string
+	autoRestart         bool
+	restartConcurrency  int
+	restartInterval     time.Duration
+)
 
 func main() {
-	flag.Var(&labels, "label", "-label: label to monitor (can be specified multiple times)")
-	flag.Var(&annotations, "annotation", "-annotation: annotation to monitor (can be specified multiple times)")
+	flag.Var(&labels, "label", "-label: label to monitor, a trailing * matches a prefix (can be specified multiple times)")
+	flag.Var(&annotations, "annotation", "-annotation: annotation to monitor, a trailing * matches a prefix (can be specified multiple times)")
+	flag.StringVar(&namespaceLabel, "namespace-label", defaultNamespaceLabel, "-namespace-label: namespace label that opts all pods of a namespace in (enabled) or out (disabled) of injection, empty to disable")
+	flag.StringVar(&proxyEnvPrecedence, "proxy-env-precedence", string(certinjectionwebhook.ProxyEnvPrecedenceOverride), "-proxy-env-precedence: what to do when a container already sets a proxy env var: override, keep or merge")
+	flag.StringVar(&trustStore, "trust-store", certs.Debian.Name, "-trust-store: trust store strategy of pods that do not select one: debian, rhel, alpine or suse")
+	flag.BoolVar(&javaToolOptions, "java-tool-options", false, "-java-tool-options: point the JVMs of injected containers to the Java truststore with JAVA_TOOL_OPTIONS")
+	flag.StringVar(&javaTrustStoreType, "java-truststore-type", string(certs.JavaTrustStorePKCS12), "-java-truststore-type: type of the Java truststore: PKCS12 or JKS")
+	flag.StringVar(&runtimeProfiles, "runtime-profiles", "", "-runtime-profiles: comma separated runtime profiles whose trust env vars are set on pods that do not select any: node, python, openssl, curl or git")
+	flag.StringVar(&injectionMode, "injection-mode", string(certinjectionwebhook.InjectionModeInitContainer), "-injection-mode: how the ca certs get into pods: init-container, configmap or merge to extend the trust store of the application image")
+	flag.StringVar(&mountMode, "mount-mode", string(certinjectionwebhook.MountModeDirectory), "-mount-mode: how the ca certs are mounted into pods: directory or file to only mount the bundles with a subPath")
+	flag.StringVar(&mountPath, "mount-path", "", "-mount-path: where the certificate directory of the trust store strategy is mounted, empty for its default")
+	flag.StringVar(&mountFiles, "mount-files", "", "-mount-files: comma separated paths in the trust store mounted besides the bundles in file mode, e.g. java/cacerts")
+	flag.StringVar(&expiryThresholds, "expiry-thresholds", "30d,7d,1d", "-expiry-thresholds: comma separated times before the injected certificates expire to emit Events and warn about them on pod creation at, e.g. 30d or 72h, empty to disable")
+	flag.StringVar(&caSources, "ca-sources", "", "-ca-sources: comma separated Secret and ConfigMap keys, TLS Secrets, cert-manager Certificates, Issuers and ClusterIssuers and trust-manager Bundles in the webhook namespace whose CA certificates are injected besides the ca-cert ConfigMap, e.g. secret/registry-ca/ca.crt,configmap/ldap-ca/ca.crt,certificate/internal-ca")
+	flag.StringVar(&certManagerNS, "cert-manager-namespace", "cert-manager", "-cert-manager-namespace: cluster resource namespace of cert-manager, where the Secrets of ClusterIssuers are")
+	flag.DurationVar(&caRotationOverlap, "ca-rotation-overlap", 24*time.Hour, "-ca-rotation-overlap: how long CA certificates that rotated out of a cert-manager source keep being injected besides the new ones")
+	flag.StringVar(&publishBundle, "publish-bundle", "", "-publish-bundle: ConfigMap or Secret key to publish the CA bundle to like a trust-manager Bundle target, e.g. configmap/cert-injection-ca-bundle/ca-certificates.crt, empty to disable")
+	flag.StringVar(&publishNamespaces, "publish-namespace-selector", "", "-publish-namespace-selector: label selector of the namespaces the CA bundle is published to, empty for all namespaces")
+	flag.StringVar(&extraCAConfigMap, "extra-ca-configmap", certinjectionwebhook.DefaultExtraCAConfigMapName, "-extra-ca-configmap: name of the ConfigMap whose ca.crt is injected besides the CA bundle into the pods of its namespace, empty to disable")
+	flag.BoolVar(&autoRestart, "auto-restart", false, "-auto-restart: restart the rollout of the workloads annotated for auto-restart once the CA bundle of their pods changes")
+	flag.IntVar(&restartConcurrency, "restart-concurrency", 1, "-restart-concurrency: number of restarted workloads that may roll out at the same time")
+	flag.DurationVar(&restartInterval, "restart-interval", time.Minute, "-restart-interval: minimum time between two restarts, 0 for no limit")
 	flag.Parse()
 
 	webhookSecretName := os.Getenv("WEBHOOK_SECRET_NAME")
@@ -72,121 +116,239 @@ func main() {
 		Port:        webhookPort,
 		SecretName:  webhookSecretName,
 	}))
+	ctx = filteredinformerfactory.WithSelectors(ctx, certinjectionwebhook.MirrorLabel, certinjectionwebhook.InjectedLabel, certinjectionwebhook.PublishedLabel)
+	if extraCAConfigMap != "" {
+		ctx = namedconfigmapinformer.WithNames(ctx, extraCAConfigMap)
+	}
 
-	sharedmain.WebhookMainWithConfig(ctx, "webhook",
-		injection.ParseAndGetRESTConfigOrDie(),
-		certificates.NewController,
-		PodAdmissionController,
-	)
-}
-
-func PodAdmissionController(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
-	envVars, err := loadEnvVars()
+	mode, err := certinjectionwebhook.ParseInjectionMode(injectionMode)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	caCertsData, err := readFile(caCertsFile, readBase64)
+	thresholds, err := certinjectionwebhook.ParseExpiryThresholds(strings.Split(expiryThresholds, ","))
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	webhookName := os.Getenv("WEBHOOK_NAME")
-	if webhookName == "" {
-		webhookName = defaultWebhookName
+	sources, err := certinjectionwebhook.ParseCASources(strings.Split(caSources, ","))
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	var imagePullSecrets corev1.LocalObjectReference
-	if systemRegistrySecret := os.Getenv("SYSTEM_REGISTRY_SECRET"); systemRegistrySecret != "" {
-		imagePullSecrets = corev1.LocalObjectReference{Name: systemRegistrySecret}
+	certManager, err := certinjectionwebhook.ParseCertManagerOptions(certManagerNS, caRotationOverlap)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	c, err := certinjectionwebhook.NewController(
-		ctx,
-		webhookName,
-		webhookPath,
-		func(ctx context.Context) context.Context {
-			return ctx
-		},
-		labels,
-		annotations,
-		envVars,
-		caCertsData,
-		os.Getenv("SETUP_CA_CERTS_IMAGE"),
-		imagePullSecrets,
+	var (
+		publishTarget            certinjectionwebhook.CASource
+		publishNamespaceSelector k8slabels.Selector
 	)
+	if publishBundle != "" {
+		if publishTarget, err = certinjectionwebhook.ParsePublishTarget(publishBundle); err != nil {
+			log.Fatal(err)
+		}
+		if publishNamespaceSelector, err = k8slabels.Parse(publishNamespaces); err != nil {
+			log.Fatalf("invalid publish namespace selector %q: %v", publishNamespaces, err)
+		}
+	}
+
+	restart, err := certinjectionwebhook.ParseRestartOptions(restartConcurrency, restartInterval)
 	if err != nil {
 		log.Fatal(err)
 	}
-	return c
-}
 
-func loadEnvVars() ([]corev1.EnvVar, error) {
-	var envVars []corev1.EnvVar
-
-	httpProxy, err := readFile(httpProxyFile, read)
-	if err != nil {
-		return nil, err
+	if err := certinjectionwebhook.RegisterMetrics(); err != nil {
+		log.Fatal(err)
 	}
-	if httpProxy != "" {
-		envVars = append(envVars, corev1.EnvVar{Name: "HTTP_PROXY", Value: httpProxy})
-		envVars = append(envVars, corev1.EnvVar{Name: "http_proxy", Value: httpProxy})
+
+	policies := certinjectionwebhook.NewPolicySet()
+
+	ctors := []injection.ControllerConstructor{certificates.NewController}
+
+	// The constructors run in order, so the mirror, the expiry monitor, the
+	// stale bundle detector, the CA sources, the publisher and the extra CA
+	// certificates are created before the controllers that use them.
+	var mirror *certinjectionwebhook.BundleMirror
+	if mode == certinjectionwebhook.InjectionModeConfigMap {
+		ctors = append(ctors, func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			var c *controller.Impl
+			c, mirror = certinjectionwebhook.NewMirrorController(ctx, systemCACerts())
+			return c
+		})
 	}
 
-	httpsProxy, err := readFile(httpsProxyFile, read)
-	if err != nil {
-		return nil, err
+	var (
+		recorder record.EventRecorder
+		expiry   *certinjectionwebhook.ExpiryMonitor
+		stale    *certinjectionwebhook.StaleBundleDetector
+	)
+	ctors = append(ctors,
+		func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			// The controllers share the recorder and its broadcaster.
+			recorder = certinjectionwebhook.NewEventRecorder(ctx)
+
+			var c *controller.Impl
+			c, expiry = certinjectionwebhook.NewExpiryController(ctx, thresholds, recorder)
+			return c
+		},
+		func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			var c *controller.Impl
+			c, stale = certinjectionwebhook.NewStaleBundleController(ctx, recorder)
+			return c
+		},
+	)
+	if autoRestart {
+		ctors = append(ctors, func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			return certinjectionwebhook.NewRestartController(ctx, restart, stale, recorder)
+		})
+	}
+	var caSourceSet *certinjectionwebhook.CASourceSet
+	if len(sources) > 0 {
+		ctors = append(ctors, func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			var c *controller.Impl
+			c, caSourceSet = certinjectionwebhook.NewCASourceController(ctx, sources, certManager)
+			return c
+		})
+	}
+	var publisher *certinjectionwebhook.BundlePublisher
+	if publishBundle != "" {
+		ctors = append(ctors, func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			var c *controller.Impl
+			c, publisher = certinjectionwebhook.NewPublishController(ctx, publishTarget, publishNamespaceSelector)
+			return c
+		})
 	}
-	if httpsProxy != "" {
-		envVars = append(envVars, corev1.EnvVar{Name: "HTTPS_PROXY", Value: httpsProxy})
-		envVars = append(envVars, corev1.EnvVar{Name: "https_proxy", Value: httpsProxy})
+	var extra *certinjectionwebhook.ExtraCABundles
+	if extraCAConfigMap != "" {
+		ctors = append(ctors, func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			var c *controller.Impl
+			c, extra = certinjectionwebhook.NewExtraCAController(ctx, extraCAConfigMap, mirror, stale)
+			return c
+		})
+	}
+	ctors = append(ctors,
+		func(ctx context.Context, cmw configmap.Watcher) *controller.Impl {
+			return PodAdmissionController(ctx, cmw, caSourceSet, certinjectionwebhook.AdmissionOptions{
+				Policies:  policies,
+				Mode:      mode,
+				Mirror:    mirror,
+				Expiry:    expiry,
+				Stale:     stale,
+				Publisher: publisher,
+				Extra:     extra,
+				Recorder:  recorder,
+			})
+		},
+		func(ctx context.Context, _ configmap.Watcher) *controller.Impl {
+			return certinjectionwebhook.NewPolicyController(ctx, policies, mirror, expiry, stale)
+		},
+	)
+
+	sharedmain.WebhookMainWithConfig(ctx, "webhook", injection.ParseAndGetRESTConfigOrDie(), ctors...)
+}
+
+// systemCACerts reads the CA certificates of the webhook image, which the
+// mirrored trust stores include like setup-ca-certs does.
+func systemCACerts() []byte {
+	path := os.Getenv("SYSTEM_CA_CERTS")
+	if path == "" {
+		path = defaultSystemCACerts
 	}
 
-	noProxy, err := readFile(noProxyFile, read)
-	if err != nil {
-		return nil, err
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
 	}
-	if noProxy != "" {
-		envVars = append(envVars, corev1.EnvVar{Name: "NO_PROXY", Value: noProxy})
-		envVars = append(envVars, corev1.EnvVar{Name: "no_proxy", Value: noProxy})
+	return data
+}
+
+// version returns the version of the webhook recorded on injected pods:
+// WEBHOOK_VERSION, which releases set, or else the version or revision the
+// binary was built from.
+func version() string {
+	if v := os.Getenv("WEBHOOK_VERSION"); v != "" {
+		return v
 	}
 
-	return envVars, nil
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return ""
+	}
+	if info.Main.Version != "" && info.Main.Version != "(devel)" {
+		return info.Main.Version
+	}
+	for _, setting := range info.Settings {
+		if setting.Key == "vcs.revision" {
+			return setting.Value
+		}
+	}
+	return ""
 }
 
-func readFile(filepath string, read func(reader io.Reader) (string, error)) (string, error) {
-	info, err := os.Stat(filepath)
+// PodAdmissionController returns the webhook controller with opts, which
+// hold the components set up by the other controllers, completed from the
+// flags and the environment.
+func PodAdmissionController(ctx context.Context, cmw configmap.Watcher, sources *certinjectionwebhook.CASourceSet, opts certinjectionwebhook.AdmissionOptions) *controller.Impl {
+	webhookName := os.Getenv("WEBHOOK_NAME")
+	if webhookName == "" {
+		webhookName = defaultWebhookName
+	}
+
+	var imagePullSecrets corev1.LocalObjectReference
+	if systemRegistrySecret := os.Getenv("SYSTEM_REGISTRY_SECRET"); systemRegistrySecret != "" {
+		imagePullSecrets = corev1.LocalObjectReference{Name: systemRegistrySecret}
+	}
+
+	envPrecedence, err := certinjectionwebhook.ParseProxyEnvPrecedence(proxyEnvPrecedence)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if info.Size() == 0 {
-		return "", nil
+	javaTrustStoreType, err := certs.ParseJavaTrustStoreType(javaTrustStoreType)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	file, err := os.Open(filepath)
+	profiles, err := certinjectionwebhook.ParseRuntimeProfiles(strings.Split(runtimeProfiles, ","))
 	if err != nil {
-		return "", err
+		log.Fatal(err)
 	}
-	defer file.Close()
-
-	return read(file)
-}
 
-func readBase64(reader io.Reader) (string, error) {
-	buf, err := ioutil.ReadAll(base64.NewDecoder(base64.StdEncoding, reader))
+	mount, err := certinjectionwebhook.ParseMountOptions(mountMode, mountPath, strings.Split(mountFiles, ","))
 	if err != nil {
-		return "", err
+		log.Fatal(err)
 	}
 
-	return string(buf), nil
-}
+	opts.Labels = labels
+	opts.Annotations = annotations
+	opts.NamespaceLabel = namespaceLabel
+	opts.EnvPrecedence = envPrecedence
+	opts.TrustStore = trustStore
+	opts.Java = certinjectionwebhook.JavaOptions{
+		ToolOptions:    javaToolOptions,
+		TrustStoreType: javaTrustStoreType,
+	}
+	opts.RuntimeProfiles = profiles
+	opts.Mount = mount
+	opts.Version = version()
+	opts.SetupCACertsImage = os.Getenv("SETUP_CA_CERTS_IMAGE")
+	opts.ImagePullSecrets = imagePullSecrets
 
-func read(reader io.Reader) (string, error) {
-	buf, err := ioutil.ReadAll(reader)
+	c, err := certinjectionwebhook.NewController(
+		ctx,
+		cmw,
+		webhookName,
+		webhookPath,
+		func(ctx context.Context) context.Context {
+			return ctx
+		},
+		sources,
+		opts,
+	)
 	if err != nil {
-		return "", err
+		log.Fatal(err)
 	}
-
-	return string(buf), nil
+	return c
 }
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
@@ -57,13 +58,13 @@ func testCertInjectionWebhook(t *testing.T, when spec.G, it spec.S) {
 		it.Before(func() {
 			_, _, err := generateAndUpdateCerts(ctx, client)
 			require.NoError(t, err)
-			require.NoError(t, restartController(t, ctx, client))
+			waitForConfigSync(t, ctx, client, testNamespace)
 		})
 
 		it.After(func() {
 			deletePod(t, ctx, client, testNamespace, podName)
 			require.NoError(t, restoreProxies(ctx, client))
-			require.NoError(t, restartController(t, ctx, client))
+			waitForConfigSync(t, ctx, client, testNamespace)
 		})
 
 		it("will match pods that have any label the webhook is matching on", func() {
@@ -97,6 +98,17 @@ func testCertInjectionWebhook(t *testing.T, when spec.G, it spec.S) {
 			pod := getPod(t, ctx, client, testNamespace, podName)
 			require.False(t, hasInjectedContainer(t, pod), "should not have cert injection container")
 		})
+
+		it("exports metrics about the admissions", func() {
+			eventually(t, func() bool {
+				metrics, err := scrapeMetrics(ctx, client)
+				if err != nil {
+					t.Log(err)
+					return false
+				}
+				return strings.Contains(metrics, "webhook_pod_admissions")
+			}, 5*time.Second, 2*time.Minute)
+		})
 	})
 
 	when("ensuring injected containers are correct", func() {
@@ -104,7 +116,7 @@ func testCertInjectionWebhook(t *testing.T, when spec.G, it spec.S) {
 			deletePod(t, ctx, client, testNamespace, podName)
 			require.NoError(t, restoreProxies(ctx, client))
 			require.NoError(t, restoreCaCerts(ctx, client))
-			require.NoError(t, restartController(t, ctx, client))
+			waitForConfigSync(t, ctx, client, testNamespace)
 		})
 
 		podLogFormat := `setup-ca-cert container logs:
@@ -116,7 +128,7 @@ test container logs:
 			http, https, no, err := generateAndUpdateProxies(ctx, client)
 			require.NoError(t, err)
 
-			require.NoError(t, restartController(t, ctx, client))
+			waitForConfigSync(t, ctx, client, testNamespace)
 
 			podName = "testpod-proxy-envs"
 			createNoopPod(t, ctx, client, testNamespace, podName, map[string]string{"some-label-1": ""}, map[string]string{})
@@ -137,7 +149,7 @@ test container logs:
 			caKey, caCert, err := generateAndUpdateCerts(ctx, client)
 			require.NoError(t, err)
 
-			require.NoError(t, restartController(t, ctx, client))
+			waitForConfigSync(t, ctx, client, testNamespace)
 
 			testingCert, err := generateCert(caKey, caCert)
 			require.NoError(t, err)
@@ -183,7 +195,7 @@ test container logs:
 			certChain += fmt.Sprintln(pem)
 
 			require.NoError(t, setCaCerts(ctx, client, certChain))
-			require.NoError(t, restartController(t, ctx, client))
+			waitForConfigSync(t, ctx, client, testNamespace)
 
 			testingCert, err := generateCert(key, cert)
 			require.NoError(t, err)
@@ -10,6 +10,7 @@ import (
 	"fmt"
 	"io"
 	"math/big"
+	"reflect"
 	"strings"
 	"testing"
 	"time"
@@ -20,6 +21,8 @@ import (
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
 )
 
 func eventually(t *testing.T, fun func() bool, interval time.Duration, duration time.Duration) {
@@ -184,33 +187,8 @@ func getPod(t *testing.T, ctx context.Context, client kubernetes.Interface, name
 	return pod
 }
 
-func parseConfigmapName(ctx context.Context, client kubernetes.Interface, name string) (string, error) {
-	deployment, err := client.AppsV1().Deployments(controllerNamespace).Get(ctx, controllerName, metav1.GetOptions{})
-	if err != nil {
-		return "", err
-	}
-
-	configmapName := ""
-	for _, v := range deployment.Spec.Template.Spec.Volumes {
-		if v.Name == name {
-			configmapName = v.ConfigMap.Name
-			break
-		}
-	}
-
-	if configmapName == "" {
-		return "", fmt.Errorf("no configmap found")
-	}
-	return configmapName, nil
-}
-
 func updateConfigmap(ctx context.Context, client kubernetes.Interface, name, key, value string) error {
-	configmapName, err := parseConfigmapName(ctx, client, name)
-	if err != nil {
-		return err
-	}
-
-	config, err := client.CoreV1().ConfigMaps(controllerNamespace).Get(ctx, configmapName, metav1.GetOptions{})
+	config, err := client.CoreV1().ConfigMaps(controllerNamespace).Get(ctx, name, metav1.GetOptions{})
 	if err != nil {
 		return err
 	}
@@ -231,11 +209,11 @@ func setCaCerts(ctx context.Context, client kubernetes.Interface, certs string)
 		return err
 	}
 
-	return updateConfigmap(ctx, client, "webhook-ca-cert", "ca.crt", encoded.String())
+	return updateConfigmap(ctx, client, "ca-cert", "ca.crt", encoded.String())
 }
 
 func restoreCaCerts(ctx context.Context, client kubernetes.Interface) error {
-	return updateConfigmap(ctx, client, "webhook-ca-cert", "ca.crt", oldConfigs["ca-cert"])
+	return updateConfigmap(ctx, client, "ca-cert", "ca.crt", oldConfigs["ca-cert"])
 }
 
 func restoreProxies(ctx context.Context, client kubernetes.Interface) error {
@@ -255,22 +233,90 @@ func restoreProxies(ctx context.Context, client kubernetes.Interface) error {
 	return nil
 }
 
-func restartController(t *testing.T, ctx context.Context, client kubernetes.Interface) error {
-	err := client.CoreV1().Pods(controllerNamespace).DeleteCollection(ctx, metav1.DeleteOptions{}, metav1.ListOptions{
-		LabelSelector: "app=cert-injection-webhook",
-	})
-	require.NoError(t, err)
+// scrapeMetrics returns the prometheus metrics the webhook exports, read
+// through the API server proxy of its service.
+func scrapeMetrics(ctx context.Context, client kubernetes.Interface) (string, error) {
+	body, err := client.CoreV1().Services(controllerNamespace).
+		ProxyGet("http", "cert-injection-webhook", "http-metrics", "/metrics", nil).
+		DoRaw(ctx)
+	return string(body), err
+}
+
+// waitForConfigSync waits until the webhook injects the CA certificates and
+// proxy env vars of the configmaps into a probe pod created as a dry run in
+// the namespace.
+func waitForConfigSync(t *testing.T, ctx context.Context, client kubernetes.Interface, namespace string) {
+	t.Helper()
+
+	caCerts, envVars := expectedInjection(t, ctx, client)
+	probe := &corev1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "config-sync-probe",
+			Namespace: namespace,
+			Labels:    map[string]string{"some-label-1": ""},
+		},
+		Spec: corev1.PodSpec{
+			Containers: []corev1.Container{{Name: "test", Image: "nginx:latest"}},
+		},
+	}
 
 	eventually(t, func() bool {
-		list, err := client.CoreV1().Pods(controllerNamespace).List(ctx, metav1.ListOptions{
-			LabelSelector: "app=cert-injection-webhook",
-		})
+		pod, err := client.CoreV1().Pods(namespace).Create(ctx, probe, metav1.CreateOptions{DryRun: []string{metav1.DryRunAll}})
+		if err != nil {
+			t.Error(err)
+			return false
+		}
+
+		var injected []string
+		for _, container := range pod.Spec.InitContainers {
+			if container.Name != "setup-ca-certs" {
+				continue
+			}
+			for _, env := range container.Env {
+				if strings.HasPrefix(env.Name, "CA_CERTS_DATA_") {
+					injected = append(injected, env.Value)
+				}
+			}
+		}
+		return equalOrEmpty(caCerts, injected) && equalOrEmpty(envVars, pod.Spec.Containers[0].Env)
+	}, time.Second, time.Minute)
+}
+
+// expectedInjection returns the CA certificates and proxy env vars of the
+// configmaps.
+func expectedInjection(t *testing.T, ctx context.Context, client kubernetes.Interface) ([]string, []corev1.EnvVar) {
+	t.Helper()
+
+	value := func(name, key string) string {
+		cm, err := client.CoreV1().ConfigMaps(controllerNamespace).Get(ctx, name, metav1.GetOptions{})
 		require.NoError(t, err)
+		return cm.Data[key]
+	}
 
-		return len(list.Items) == 1
-	}, 5*time.Second, 2*time.Minute)
+	caCertsData, err := base64.StdEncoding.DecodeString(value("ca-cert", "ca.crt"))
+	require.NoError(t, err)
 
-	return nil
+	var envVars []corev1.EnvVar
+	for _, proxy := range []struct{ configMap, env string }{
+		{"http-proxy", "HTTP_PROXY"},
+		{"https-proxy", "HTTPS_PROXY"},
+		{"no-proxy", "NO_PROXY"},
+	} {
+		if v := value(proxy.configMap, "value"); v != "" {
+			envVars = append(envVars,
+				corev1.EnvVar{Name: proxy.env, Value: v},
+				corev1.EnvVar{Name: strings.ToLower(proxy.env), Value: v},
+			)
+		}
+	}
+	return certs.Split(string(caCertsData)), envVars
+}
+
+func equalOrEmpty[T any](expected, actual []T) bool {
+	if len(expected) == 0 {
+		return len(actual) == 0
+	}
+	return reflect.DeepEqual(expected, actual)
 }
 
 func generateCert(caPrivateKey *rsa.PrivateKey, caCert *x509.Certificate) (string, error) {
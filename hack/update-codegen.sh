@@ -0,0 +1,13 @@
+#!/bin/bash
+
+#! Copyright 2020-Present VMware, Inc.
+#! SPDX-License-Identifier: Apache-2.0
+
+set -euo pipefail
+
+cd "$(dirname "${BASH_SOURCE[0]}")/.."
+
+go run k8s.io/code-generator/cmd/deepcopy-gen@v0.33.3 \
+  --go-header-file hack/boilerplate.go.txt \
+  --output-file zz_generated.deepcopy.go \
+  ./pkg/apis/...
@@ -0,0 +1,8 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjection
+
+const (
+	GroupName = "cert-injection.tanzu.vmware.com"
+)
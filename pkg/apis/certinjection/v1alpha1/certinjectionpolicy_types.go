@@ -0,0 +1,200 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package v1alpha1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	CertInjectionPolicyKind = "CertInjectionPolicy"
+
+	// ConditionReady is true when the policy has been loaded and is applied
+	// to matching pods.
+	ConditionReady = "Ready"
+)
+
+// +genclient
+// +genclient:nonNamespaced
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// CertInjectionPolicy selects pods and describes the CA certificates and
+// proxy settings injected into them. When several policies match a pod only
+// the one with the highest priority is applied.
+type CertInjectionPolicy struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   CertInjectionPolicySpec   `json:"spec"`
+	Status CertInjectionPolicyStatus `json:"status,omitempty"`
+}
+
+type CertInjectionPolicySpec struct {
+	// Priority orders policies matching the same pod. The highest priority
+	// wins and ties are broken by name.
+	Priority int32 `json:"priority,omitempty"`
+
+	// PodSelector selects the pods the policy applies to.
+	PodSelector PodSelector `json:"podSelector"`
+
+	// CertSource is where the injected CA certificates are read from. The
+	// ca-cert bundle of the webhook is injected when it is not set.
+	CertSource *CertSource `json:"certSource,omitempty"`
+
+	// Proxy holds the proxy settings injected as env vars. The proxy
+	// settings of the webhook are injected when it is not set.
+	Proxy *Proxy `json:"proxy,omitempty"`
+
+	// SetupCACertsImage overrides the image used for the setup-ca-certs
+	// init container.
+	SetupCACertsImage string `json:"setupCACertsImage,omitempty"`
+
+	// TrustStore is the trust store strategy of the selected pods: debian,
+	// rhel, alpine or suse. It decides the files written and the paths they
+	// are mounted at.
+	TrustStore string `json:"trustStore,omitempty"`
+
+	// Java configures the Java truststore of the selected pods.
+	Java *Java `json:"java,omitempty"`
+
+	// RuntimeProfiles point the runtimes of the selected pods to the CA
+	// bundle with env vars like NODE_EXTRA_CA_CERTS: node, python, openssl,
+	// curl or git.
+	RuntimeProfiles []string `json:"runtimeProfiles,omitempty"`
+
+	// Mount configures where the CA certificates are mounted into the
+	// containers.
+	Mount *Mount `json:"mount,omitempty"`
+
+	// Containers selects the containers of a pod that get the CA
+	// certificates and the proxy env vars. All containers do by default.
+	Containers *ContainerSelection `json:"containers,omitempty"`
+}
+
+// PodSelector selects a pod when it has any of the Labels or Annotations
+// keys or when it matches all of LabelSelector, AnnotationSelector and
+// NamespaceSelector that are set.
+type PodSelector struct {
+	// Labels matches pods that have any of these label keys.
+	Labels []string `json:"labels,omitempty"`
+
+	// Annotations matches pods that have any of these annotation keys. A
+	// key ending in "*" matches every key with that prefix.
+	Annotations []string `json:"annotations,omitempty"`
+
+	// LabelSelector matches pods by their labels.
+	LabelSelector *metav1.LabelSelector `json:"labelSelector,omitempty"`
+
+	// AnnotationSelector matches pods by their annotations.
+	AnnotationSelector *AnnotationSelector `json:"annotationSelector,omitempty"`
+
+	// NamespaceSelector matches pods by the labels of their namespace.
+	NamespaceSelector *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+}
+
+// AnnotationSelector has the semantics of a metav1.LabelSelector applied to
+// annotations. Keys ending in "*" match every annotation with that prefix.
+type AnnotationSelector struct {
+	// MatchAnnotations requires the annotation to have the given value.
+	MatchAnnotations map[string]string `json:"matchAnnotations,omitempty"`
+
+	// MatchExpressions are requirements that all have to be met.
+	MatchExpressions []AnnotationSelectorRequirement `json:"matchExpressions,omitempty"`
+}
+
+type AnnotationSelectorRequirement struct {
+	Key string `json:"key"`
+
+	// Operator is one of In, NotIn, Exists and DoesNotExist.
+	Operator metav1.LabelSelectorOperator `json:"operator"`
+
+	// Values must be non-empty for In and NotIn and empty otherwise.
+	Values []string `json:"values,omitempty"`
+}
+
+type ContainerSelection struct {
+	// CACerts selects the containers the CA certificates are mounted into.
+	CACerts *ContainerFilter `json:"caCerts,omitempty"`
+
+	// Env selects the containers the proxy env vars are set on.
+	Env *ContainerFilter `json:"env,omitempty"`
+}
+
+// ContainerFilter patterns match the container name, or the image when
+// prefixed with "image:". "*" matches any sequence of characters and "?" a
+// single character.
+type ContainerFilter struct {
+	// Include limits injection to the containers matching any of the
+	// patterns. All containers are included when empty.
+	Include []string `json:"include,omitempty"`
+
+	// Exclude skips the containers matching any of the patterns, even when
+	// they are included.
+	Exclude []string `json:"exclude,omitempty"`
+}
+
+type CertSource struct {
+	// ConfigMap references PEM encoded certificates in a ConfigMap in the
+	// webhook's namespace.
+	ConfigMap *ConfigMapKeyReference `json:"configMap,omitempty"`
+}
+
+type ConfigMapKeyReference struct {
+	Name string `json:"name"`
+	Key  string `json:"key"`
+}
+
+type Proxy struct {
+	HTTPProxy  string `json:"httpProxy,omitempty"`
+	HTTPSProxy string `json:"httpsProxy,omitempty"`
+	NoProxy    string `json:"noProxy,omitempty"`
+
+	// Precedence decides what happens when a container already sets one
+	// of the proxy env vars: override (the default) replaces its value,
+	// keep leaves it and merge combines the NO_PROXY host lists and keeps
+	// the other values.
+	Precedence string `json:"precedence,omitempty"`
+}
+
+// Java configures the Java truststore written next to the CA bundle.
+type Java struct {
+	// ToolOptions sets JAVA_TOOL_OPTIONS on the containers that get the CA
+	// certificates so that their JVMs use the truststore. Options the
+	// containers already set are kept.
+	ToolOptions bool `json:"toolOptions,omitempty"`
+
+	// TrustStoreType is the format of the truststore: PKCS12, the default,
+	// or JKS.
+	TrustStoreType string `json:"trustStoreType,omitempty"`
+}
+
+// Mount configures where the trust store is mounted into the containers.
+type Mount struct {
+	// Mode is directory, the default, to mount the certificate directories
+	// of the trust store, or file to only mount the CA bundles, and Files,
+	// into the directories of the image with a subPath.
+	Mode string `json:"mode,omitempty"`
+
+	// Path overrides where the certificate directory of the trust store
+	// strategy is mounted, e.g. /etc/ssl/certs.
+	Path string `json:"path,omitempty"`
+
+	// Files are further paths in the trust store mounted in file mode, e.g.
+	// java/cacerts.
+	Files []string `json:"files,omitempty"`
+}
+
+type CertInjectionPolicyStatus struct {
+	ObservedGeneration int64              `json:"observedGeneration,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+type CertInjectionPolicyList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata"`
+
+	Items []CertInjectionPolicy `json:"items"`
+}
@@ -0,0 +1,8 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+// +k8s:deepcopy-gen=package
+// +groupName=cert-injection.tanzu.vmware.com
+
+// Package v1alpha1 contains the CertInjectionPolicy API.
+package v1alpha1
@@ -8,14 +8,21 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
 	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
 	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/apimachinery/pkg/runtime/serializer"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/record"
 	"knative.dev/pkg/apis"
 	"knative.dev/pkg/apis/duck"
 	"knative.dev/pkg/logging"
@@ -25,15 +32,40 @@ import (
 )
 
 const (
-	caCertsVolumeName = "ca-certs"
-	caCertsMountPath  = "/etc/ssl/certs"
+	caCertsVolumeName         = "ca-certs"
+	setupCACertsContainerName = "setup-ca-certs"
+
+	ephemeralContainersSubresource = "ephemeralcontainers"
 )
 
 var (
 	errMissingNewObject = errors.New("the new object may not be nil")
 	podResource         = metav1.GroupVersionResource{Version: "v1", Resource: "pods"}
+
+	// webhookRules are the operations handled by Admit. The reconciler keeps
+	// the MutatingWebhookConfiguration subscribed to exactly these.
+	webhookRules = []admissionregistrationv1.RuleWithOperations{
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+			Rule:       podRule(podResource.Resource),
+		},
+		{
+			Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+			Rule:       podRule(podResource.Resource + "/" + ephemeralContainersSubresource),
+		},
+	}
 )
 
+func podRule(resource string) admissionregistrationv1.Rule {
+	scope := admissionregistrationv1.AllScopes
+	return admissionregistrationv1.Rule{
+		APIGroups:   []string{podResource.Group},
+		APIVersions: []string{podResource.Version},
+		Resources:   []string{resource},
+		Scope:       &scope,
+	}
+}
+
 // Implements webhook.AdmissionController
 type admissionController struct {
 	name string
@@ -41,42 +73,271 @@ type admissionController struct {
 
 	withContext func(context.Context) context.Context
 
-	labels            []string
-	annotations       []string
-	envVars           []corev1.EnvVar
+	selector          podSelector
 	setupCACertsImage string
-	caCertsData       string
 	imagePullSecrets  corev1.LocalObjectReference
+
+	// trustStore is the name of the trust store strategy of pods that are
+	// not annotated and whose policy does not set one.
+	trustStore string
+
+	// java configures the Java truststore of pods whose policy does not.
+	java JavaOptions
+
+	// runtimeProfiles are the runtime profiles of pods that are not
+	// annotated and whose policy does not set any.
+	runtimeProfiles []RuntimeProfile
+
+	// mount configures where the trust store is mounted into the containers
+	// of pods whose policy does not.
+	mount MountOptions
+
+	// mode decides how the ca-certs volume is populated. The trust store of
+	// the application image is extended in merge mode.
+	mode InjectionMode
+
+	// mirror mirrors the trust stores into the namespaces of the pods,
+	// which mount them instead of running setup-ca-certs. It is nil in init
+	// container mode.
+	mirror *BundleMirror
+
+	// expiry monitors the expiry of the injected certificates and warns
+	// about the ones that expire soon when pods are created.
+	expiry *ExpiryMonitor
+
+	// stale detects the running pods injected with a bundle that is no
+	// longer current.
+	stale *StaleBundleDetector
+
+	// publisher publishes the bundle injected by default like trust-manager.
+	// It is nil unless a publish target is set.
+	publisher *BundlePublisher
+
+	// extra are the CA certificates added to the bundle injected into the
+	// pods of their namespace. It is nil unless they are enabled.
+	extra *ExtraCABundles
+
+	// version is the version of the webhook recorded on injected pods.
+	version string
+
+	// recorder emits Events on the pods that are injected or deliberately
+	// skipped.
+	recorder record.EventRecorder
+
+	// namespaceLabel opts all pods of a namespace in or out of injection.
+	namespaceLabel  string
+	namespaceLister corelisters.NamespaceLister
+
+	// policies take precedence over the selector above.
+	policies *PolicySet
+
+	// loaded are closed once the sources of the injected bundle, such as
+	// the CA sources and the extra CA ConfigMaps, have been loaded.
+	// Admissions of the pods to inject wait for them so that pods are not
+	// injected with part of the bundle.
+	loaded []<-chan struct{}
+
+	// data is swapped as a whole so that an admission in flight always sees
+	// a consistent bundle and set of env vars. updateLock serializes writers.
+	data       atomic.Pointer[injectionData]
+	updateLock sync.Mutex
+}
+
+// injectionData is the CA bundle and proxy env vars injected into pods.
+type injectionData struct {
+	envVars     []corev1.EnvVar
+	caCertsData string
+
+	// caCerts are the certificates of caCertsData.
+	caCerts []certs.Certificate
+
+	// envPrecedence decides how envVars are combined with env vars the
+	// containers already set.
+	envPrecedence ProxyEnvPrecedence
+
+	// envContainers and caCertsContainers select the containers that get
+	// the env vars and the ca certs.
+	envContainers     containerFilter
+	caCertsContainers containerFilter
+
+	// setupCACertsImage overrides the image of the admission controller when
+	// set.
+	setupCACertsImage string
+
+	// trustStore overrides the trust store strategy of the admission
+	// controller when set.
+	trustStore string
+
+	// java overrides the Java options of the admission controller when set.
+	java *JavaOptions
+
+	// runtimeProfiles override the runtime profiles of the admission
+	// controller when set.
+	runtimeProfiles []RuntimeProfile
+
+	// mount overrides the mount options of the admission controller when
+	// set.
+	mount *MountOptions
+
+	// caCertsConfigMap is the name of the copies of caCertsData in
+	// configmap mode.
+	caCertsConfigMap string
+}
+
+// AdmissionOptions are the settings of an admission controller. The zero
+// value of a field leaves out what it configures.
+type AdmissionOptions struct {
+	// Labels and Annotations are the keys of the labels and annotations
+	// that select the pods to inject.
+	Labels      []string
+	Annotations []string
+
+	// EnvVars, CACertsData and EnvPrecedence are the initial proxy env vars
+	// and CA bundle, which the ConfigMaps replace when they are loaded.
+	EnvVars       []corev1.EnvVar
+	CACertsData   string
+	EnvPrecedence ProxyEnvPrecedence
+
+	SetupCACertsImage string
+	ImagePullSecrets  corev1.LocalObjectReference
+
+	// Policies select pods with their own injection data besides Labels
+	// and Annotations.
+	Policies *PolicySet
+
+	// NamespaceLabel limits injection to the namespaces with the label,
+	// which NamespaceLister looks up.
+	NamespaceLabel  string
+	NamespaceLister corelisters.NamespaceLister
+
+	TrustStore      string
+	Java            JavaOptions
+	RuntimeProfiles []RuntimeProfile
+	Mount           MountOptions
+	Mode            InjectionMode
+
+	Mirror    *BundleMirror
+	Expiry    *ExpiryMonitor
+	Stale     *StaleBundleDetector
+	Publisher *BundlePublisher
+	Extra     *ExtraCABundles
+
+	// Version is the version of the webhook recorded on injected pods.
+	Version  string
+	Recorder record.EventRecorder
 }
 
 func NewAdmissionController(
 	name string,
 	path string,
 	wc func(context.Context) context.Context,
-
-	labels []string,
-	annotations []string,
-	envVars []corev1.EnvVar,
-	setupCACertsImage string,
-	caCertsData string,
-	imagePullSecrets corev1.LocalObjectReference,
+	opts AdmissionOptions,
 ) (*admissionController, error) {
+	if _, err := certs.StrategyFor(opts.TrustStore); err != nil {
+		return nil, err
+	}
+
+	java := opts.Java
+	javaTrustStoreType, err := certs.ParseJavaTrustStoreType(string(java.TrustStoreType))
+	if err != nil {
+		return nil, err
+	}
+	java.TrustStoreType = javaTrustStoreType
+
+	mount, err := ParseMountOptions(string(opts.Mount.Mode), opts.Mount.Path, opts.Mount.Files)
+	if err != nil {
+		return nil, err
+	}
+
+	mode, err := ParseInjectionMode(string(opts.Mode))
+	if err != nil {
+		return nil, err
+	}
 
-	if len(labels) == 0 && len(annotations) == 0 {
-		return nil, errors.New("at least one label or annotation required")
+	selector, err := newKeySelector(opts.Labels, opts.Annotations)
+	if err != nil {
+		return nil, err
 	}
 
-	return &admissionController{
+	namespaceSelector, err := newNamespaceSelector(opts.NamespaceLabel)
+	if err != nil {
+		return nil, err
+	}
+	selector = append(selector, namespaceSelector...)
+
+	ac := &admissionController{
 		name:              name,
 		path:              path,
 		withContext:       wc,
-		labels:            labels,
-		annotations:       annotations,
-		envVars:           envVars,
-		setupCACertsImage: setupCACertsImage,
-		caCertsData:       caCertsData,
-		imagePullSecrets:  imagePullSecrets,
-	}, nil
+		selector:          selector,
+		setupCACertsImage: opts.SetupCACertsImage,
+		imagePullSecrets:  opts.ImagePullSecrets,
+		trustStore:        opts.TrustStore,
+		java:              java,
+		runtimeProfiles:   opts.RuntimeProfiles,
+		mount:             mount,
+		mode:              mode,
+		mirror:            opts.Mirror,
+		expiry:            opts.Expiry,
+		stale:             opts.Stale,
+		publisher:         opts.Publisher,
+		extra:             opts.Extra,
+		version:           opts.Version,
+		recorder:          opts.Recorder,
+		policies:          opts.Policies,
+		namespaceLabel:    opts.NamespaceLabel,
+		namespaceLister:   opts.NamespaceLister,
+	}
+	if opts.Extra != nil {
+		ac.loaded = append(ac.loaded, opts.Extra.loaded)
+	}
+	ac.data.Store(&injectionData{
+		envVars:          opts.EnvVars,
+		caCertsData:      opts.CACertsData,
+		caCerts:          certs.Certificates(opts.CACertsData),
+		envPrecedence:    opts.EnvPrecedence,
+		caCertsConfigMap: defaultMirrorName,
+	})
+	ac.mirror.setSource(defaultMirrorName, opts.CACertsData)
+	ac.expiry.setSource(caCertConfigMapReference(), opts.CACertsData)
+	ac.stale.setBundle(defaultSelector, opts.CACertsData)
+	return ac, nil
+}
+
+// UpdateEnvVars replaces the env vars injected into subsequently admitted
+// pods.
+func (ac *admissionController) UpdateEnvVars(envVars []corev1.EnvVar) {
+	ac.updateLock.Lock()
+	defer ac.updateLock.Unlock()
+
+	data := *ac.data.Load()
+	data.envVars = envVars
+	ac.data.Store(&data)
+}
+
+// UpdateCaCertsData replaces the CA bundle injected into subsequently
+// admitted pods, whose expiry is monitored as that of the ca-cert
+// ConfigMap.
+func (ac *admissionController) UpdateCaCertsData(caCertsData string) {
+	ac.updateCaCertsData(caCertsData)
+	ac.expiry.setSource(caCertConfigMapReference(), caCertsData)
+}
+
+// updateCaCertsData replaces the CA bundle like UpdateCaCertsData, leaving
+// the expiry to whoever read the certificates, such as the CASourceSet
+// that aggregates them.
+func (ac *admissionController) updateCaCertsData(caCertsData string) {
+	ac.updateLock.Lock()
+	defer ac.updateLock.Unlock()
+
+	data := *ac.data.Load()
+	data.caCertsData = caCertsData
+	data.caCerts = certs.Certificates(caCertsData)
+	ac.data.Store(&data)
+
+	ac.mirror.setSource(defaultMirrorName, caCertsData)
+	ac.stale.setBundle(defaultSelector, caCertsData)
+	ac.publisher.setBundle(caCertsData)
 }
 
 func (ac *admissionController) Path() string {
@@ -88,18 +349,40 @@ func (ac *admissionController) Admit(ctx context.Context, request *admissionv1.A
 		ctx = ac.withContext(ctx)
 	}
 
+	start := time.Now()
+	response, a := ac.admit(ctx, request)
+	reportAdmission(ctx, request, response, a, time.Since(start))
+	return response
+}
+
+// waitLoaded waits until the sources of the injected bundle have been
+// loaded and returns false if ctx is done first.
+func (ac *admissionController) waitLoaded(ctx context.Context) bool {
+	for _, loaded := range ac.loaded {
+		select {
+		case <-loaded:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	return true
+}
+
+// admit returns the response to request and how it was decided.
+func (ac *admissionController) admit(ctx context.Context, request *admissionv1.AdmissionRequest) (*admissionv1.AdmissionResponse, admission) {
 	logger := logging.FromContext(ctx)
 
 	if request.Resource != podResource {
 		logger.Infof("expected resource to be %v", podResource)
-		return &admissionv1.AdmissionResponse{Allowed: true}
+		return &admissionv1.AdmissionResponse{Allowed: true}, admission{outcome: outcomeSkippedUnhandled}
 	}
 
-	switch request.Operation {
-	case admissionv1.Create:
+	switch {
+	case request.Operation == admissionv1.Create && request.SubResource == "":
+	case request.Operation == admissionv1.Update && request.SubResource == ephemeralContainersSubresource:
 	default:
-		logger.Infof("Unhandled webhook operation, letting it through %v", request.Operation)
-		return &admissionv1.AdmissionResponse{Allowed: true}
+		logger.Infof("Unhandled webhook operation, letting it through %v %v", request.Operation, request.SubResource)
+		return &admissionv1.AdmissionResponse{Allowed: true}, admission{outcome: outcomeSkippedUnhandled}
 	}
 
 	raw := request.Object.Raw
@@ -111,121 +394,273 @@ func (ac *admissionController) Admit(ctx context.Context, request *admissionv1.A
 		return &admissionv1.AdmissionResponse{
 			Result:  &result,
 			Allowed: true,
-		}
+		}, admission{outcome: outcomeDecodeError}
 	}
 
+	namespaceLabels := ac.namespaceLabels(ctx, request.Namespace)
 	if pod.Spec.NodeSelector["kubernetes.io/os"] == "windows" {
-		return &admissionv1.AdmissionResponse{Allowed: true}
+		if ac.selects(&pod, namespaceLabels) {
+			ac.recordSkipped(ctx, request, &pod, "Windows pods are not injected")
+		}
+		return &admissionv1.AdmissionResponse{Allowed: true}, admission{outcome: outcomeSkippedWindows}
 	}
 
-	if !(intersect(ac.labels, pod.Labels) || intersect(ac.annotations, pod.Annotations)) {
-		logger.Info("does not contain matching labels or annotations, letting it through")
-		return &admissionv1.AdmissionResponse{Allowed: true}
+	if ac.namespaceLabel != "" && namespaceLabels[ac.namespaceLabel] == NamespaceInjectionDisabled {
+		logger.Infof("namespace %q has opted out of injection, letting it through", request.Namespace)
+		if ac.selects(&pod, namespaceLabels) {
+			ac.recordSkipped(ctx, request, &pod, fmt.Sprintf("namespace %q has opted out of injection", request.Namespace))
+		}
+		return &admissionv1.AdmissionResponse{Allowed: true}, admission{outcome: outcomeSkippedNamespace}
 	}
 
-	patchBytes, err := ac.mutate(ctx, request)
+	// Only the pods to inject wait for the sources. A pod is let through
+	// rather than denied if they are still not loaded, as the failure
+	// policy would.
+	if ac.selects(&pod, namespaceLabels) && !ac.waitLoaded(ctx) {
+		reason := "CA bundle sources have not been loaded yet, letting the pod through without injecting it"
+		logger.Error(reason)
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: []string{reason}}, admission{outcome: outcomeNotLoaded}
+	}
+
+	a := admission{selector: defaultSelector}
+	p := ac.policies.match(&pod, namespaceLabels)
+	if p == nil {
+		p = &policy{selector: ac.selector, data: ac.data.Load()}
+		if !p.matches(&pod, namespaceLabels) {
+			logger.Info("does not contain matching labels or annotations, letting it through")
+			return &admissionv1.AdmissionResponse{Allowed: true}, admission{outcome: outcomeSkippedNoMatch}
+		}
+	} else {
+		logger.Infof("Applying CertInjectionPolicy %q", p.name)
+		a.selector = policySelector(p.name)
+	}
+
+	data := ac.extra.data(request.Namespace, p.dataWith(ac.data.Load()))
+	patchBytes, warnings, err := ac.mutate(ctx, request, data, a.selector)
 	if err != nil {
 		logger.Error(fmt.Sprintf("mutation failed: %v", err))
 		status := webhook.MakeErrorStatus("mutation failed: %v", err)
-		return status
+		a.outcome = outcomeMutationFailed
+		return status, a
+	}
+	for _, w := range warnings {
+		logger.Warn(w)
+	}
+	if request.SubResource == "" {
+		warnings = append(warnings, ac.expiry.warnings(data.caCerts)...)
+	}
+	if patchBytes == nil {
+		logger.Info("pod needs no changes, letting it through")
+		a.outcome = outcomeUnchanged
+		return &admissionv1.AdmissionResponse{Allowed: true, Warnings: warnings}, a
 	}
 	logger.Infof("Kind: %q PatchBytes: %v", request.Kind, string(patchBytes))
 
+	a.outcome = outcomeInjected
+	if request.SubResource == "" {
+		ac.recordInjected(ctx, request, &pod, ac.injectionRecord(data, a.selector))
+	}
 	return &admissionv1.AdmissionResponse{
-		Patch:   patchBytes,
-		Allowed: true,
+		Patch:    patchBytes,
+		Allowed:  true,
+		Warnings: warnings,
 		PatchType: func() *admissionv1.PatchType {
 			pt := admissionv1.PatchTypeJSONPatch
 			return &pt
 		}(),
+	}, a
+}
+
+// selects returns whether a policy or the selector of the admission
+// controller selects the pod.
+func (ac *admissionController) selects(pod *corev1.Pod, namespaceLabels map[string]string) bool {
+	return ac.policies.match(pod, namespaceLabels) != nil || ac.selector.matches(pod, namespaceLabels)
+}
+
+// namespaceLabels returns the labels of the namespace or nil if they are not
+// known.
+func (ac *admissionController) namespaceLabels(ctx context.Context, name string) map[string]string {
+	if ac.namespaceLister == nil || name == "" {
+		return nil
+	}
+
+	ns, err := ac.namespaceLister.Get(name)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Error fetching namespace %q, evaluating pod without namespace labels: %v", name, err)
+		return nil
 	}
+	return ns.Labels
 }
 
-func (ac *admissionController) mutate(ctx context.Context, req *admissionv1.AdmissionRequest) ([]byte, error) {
+// mutate returns the patch for the pod of the request and warnings about
+// the CA certificate mounts that conflict with the mounts of the pod. The
+// selector that matched the pod is recorded on injected pods.
+func (ac *admissionController) mutate(ctx context.Context, req *admissionv1.AdmissionRequest, data *injectionData, selector string) ([]byte, []string, error) {
 	newBytes := req.Object.Raw
 
 	var newObj corev1.Pod
 	if len(newBytes) != 0 {
 		newDecoder := json.NewDecoder(bytes.NewBuffer(newBytes))
 		if err := newDecoder.Decode(&newObj); err != nil {
-			return nil, fmt.Errorf("cannot decode incoming new object: %v", err)
+			return nil, nil, fmt.Errorf("cannot decode incoming new object: %v", err)
 		}
 	}
 
 	var patches duck.JSONPatch
+	var warnings []string
 	var err error
 
-	ctx = apis.WithinCreate(ctx)
 	ctx = apis.WithUserInfo(ctx, &req.UserInfo)
 
-	if patches, err = ac.setBuildServicePodDefaults(ctx, patches, newObj); err != nil {
-		return nil, errors.Wrap(err, "Failed to set default env vars and ca cert on pod")
+	if req.SubResource == ephemeralContainersSubresource {
+		var oldObj corev1.Pod
+		if len(req.OldObject.Raw) != 0 {
+			if err := json.Unmarshal(req.OldObject.Raw, &oldObj); err != nil {
+				return nil, nil, fmt.Errorf("cannot decode incoming old object: %v", err)
+			}
+		}
+
+		ctx = apis.WithinUpdate(ctx, &oldObj)
+		if patches, warnings, err = ac.setEphemeralContainerDefaults(ctx, patches, newObj, oldObj, data); err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to set default env vars and ca cert on ephemeral containers")
+		}
+	} else {
+		ctx = apis.WithinCreate(ctx)
+		if patches, warnings, err = ac.setBuildServicePodDefaults(ctx, patches, req, newObj, data, selector); err != nil {
+			return nil, nil, errors.Wrap(err, "Failed to set default env vars and ca cert on pod")
+		}
 	}
 
 	if &newObj == nil {
-		return nil, errMissingNewObject
+		return nil, nil, errMissingNewObject
+	}
+	if len(patches) == 0 {
+		return nil, warnings, nil
 	}
-	return json.Marshal(patches)
+	patchBytes, err := json.Marshal(patches)
+	return patchBytes, warnings, err
 }
 
-func (ac *admissionController) SetEnvVars(ctx context.Context, obj *corev1.Pod) {
-	if len(ac.envVars) == 0 {
+// SetEnvVars sets the env vars on the selected containers. Env vars the
+// containers already set are combined according to precedence.
+func (ac *admissionController) SetEnvVars(ctx context.Context, obj *corev1.Pod, envVars []corev1.EnvVar, precedence ProxyEnvPrecedence, containers containerFilter) {
+	if len(envVars) == 0 {
 		return
 	}
 
 	for i := range obj.Spec.Containers {
-		for _, envVar := range ac.envVars {
-			obj.Spec.Containers[i].Env = append(obj.Spec.Containers[i].Env, envVar)
+		if !containers.selects(obj.Spec.Containers[i].Name, obj.Spec.Containers[i].Image) {
+			continue
+		}
+		for _, envVar := range envVars {
+			obj.Spec.Containers[i].Env = setEnvVar(obj.Spec.Containers[i].Env, envVar, precedence)
 		}
 	}
 
 	for i := range obj.Spec.InitContainers {
-		for _, envVar := range ac.envVars {
-			obj.Spec.InitContainers[i].Env = append(obj.Spec.InitContainers[i].Env, envVar)
+		if isCACertsInitContainer(obj.Spec.InitContainers[i].Name) ||
+			!containers.selects(obj.Spec.InitContainers[i].Name, obj.Spec.InitContainers[i].Image) {
+			continue
+		}
+		for _, envVar := range envVars {
+			obj.Spec.InitContainers[i].Env = setEnvVar(obj.Spec.InitContainers[i].Env, envVar, precedence)
 		}
 	}
 }
 
-func (ac *admissionController) SetCaCerts(ctx context.Context, obj *corev1.Pod) {
-	if ac.caCertsData == "" {
-		return
+// SetCaCerts adds the ca-certs volume, mounts it into the selected containers,
+// points the runtimes of the profiles to it and adds the setup-ca-certs init
+// container that populates it. In merge mode setup-ca-certs installs the helper
+// that the merge-ca-certs init container runs in the image of the first
+// selected container instead. When configMap is set the volume projects the
+// mirrored trust store instead and no init container is added. Anything that
+// is already present from an earlier admission is reused or replaced rather
+// than added again. The warnings report mounts of the containers that
+// conflict with the ca-certs volume.
+func (ac *admissionController) SetCaCerts(ctx context.Context, obj *corev1.Pod, caCertsData, setupCACertsImage string, strategy certs.Strategy, java JavaOptions, profiles []RuntimeProfile, configMap *caCertsConfigMap, containers containerFilter) []string {
+	if caCertsData == "" {
+		return nil
 	}
 
-	volume := corev1.Volume{
-		Name: caCertsVolumeName,
-		VolumeSource: corev1.VolumeSource{
-			EmptyDir: &corev1.EmptyDirVolumeSource{},
-		},
+	volumeSource := corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}}
+	if configMap != nil {
+		volumeSource = corev1.VolumeSource{ConfigMap: &corev1.ConfigMapVolumeSource{
+			LocalObjectReference: corev1.LocalObjectReference{Name: configMap.name},
+			Items:                configMapVolumeItems(configMap.bundle.configMap.Items(strategy)),
+			// The hash links of the copy change with its bundle. Keys that
+			// went missing must not keep the pod from starting.
+			Optional: boolPointer(true),
+		}}
+		// Mirrored trust stores only hold a PKCS#12 Java truststore.
+		java.TrustStoreType = certs.JavaTrustStorePKCS12
 	}
-	obj.Spec.Volumes = append(obj.Spec.Volumes, volume)
-
-	mount := corev1.VolumeMount{
-		Name:      caCertsVolumeName,
-		MountPath: caCertsMountPath,
-		ReadOnly:  true,
+	if !hasVolume(obj.Spec.Volumes, caCertsVolumeName) {
+		obj.Spec.Volumes = append(obj.Spec.Volumes, corev1.Volume{
+			Name:         caCertsVolumeName,
+			VolumeSource: volumeSource,
+		})
 	}
+
+	mounts := caCertsVolumeMounts(strategy)
+	javaOptions, setJava := javaToolOptions(strategy, java.TrustStoreType)
+	setJava = setJava && java.ToolOptions
+	runtimeEnv := runtimeEnvVars(strategy, profiles)
+	var warnings, w []string
 	for i := range obj.Spec.InitContainers {
-		obj.Spec.InitContainers[i].VolumeMounts = append(obj.Spec.InitContainers[i].VolumeMounts, mount)
+		if isCACertsInitContainer(obj.Spec.InitContainers[i].Name) ||
+			!containers.selects(obj.Spec.InitContainers[i].Name, obj.Spec.InitContainers[i].Image) {
+			continue
+		}
+		obj.Spec.InitContainers[i].VolumeMounts, w = addCACertsVolumeMounts(obj.Spec.InitContainers[i].Name, obj.Spec.InitContainers[i].VolumeMounts, mounts)
+		warnings = append(warnings, w...)
+		if setJava {
+			obj.Spec.InitContainers[i].Env = setJavaToolOptions(obj.Spec.InitContainers[i].Env, javaOptions)
+		}
+		obj.Spec.InitContainers[i].Env = setRuntimeEnvVars(obj.Spec.InitContainers[i].Env, runtimeEnv)
 	}
 	for i := range obj.Spec.Containers {
-		obj.Spec.Containers[i].VolumeMounts = append(obj.Spec.Containers[i].VolumeMounts, mount)
+		if !containers.selects(obj.Spec.Containers[i].Name, obj.Spec.Containers[i].Image) {
+			continue
+		}
+		obj.Spec.Containers[i].VolumeMounts, w = addCACertsVolumeMounts(obj.Spec.Containers[i].Name, obj.Spec.Containers[i].VolumeMounts, mounts)
+		warnings = append(warnings, w...)
+		if setJava {
+			obj.Spec.Containers[i].Env = setJavaToolOptions(obj.Spec.Containers[i].Env, javaOptions)
+		}
+		obj.Spec.Containers[i].Env = setRuntimeEnvVars(obj.Spec.Containers[i].Env, runtimeEnv)
 	}
 
-	if ac.imagePullSecrets != (corev1.LocalObjectReference{}) {
+	if configMap != nil {
+		return warnings
+	}
+
+	if ac.imagePullSecrets != (corev1.LocalObjectReference{}) && !hasImagePullSecret(obj.Spec.ImagePullSecrets, ac.imagePullSecrets) {
 		obj.Spec.ImagePullSecrets = append(obj.Spec.ImagePullSecrets, ac.imagePullSecrets)
 	}
 
 	var envVars []corev1.EnvVar
-	for i, cert := range certs.Split(ac.caCertsData) {
+	for i, cert := range certs.Split(caCertsData) {
 		envVars = append(envVars, corev1.EnvVar{
 			Name:  fmt.Sprintf("CA_CERTS_DATA_%d", i),
 			Value: cert,
 		})
 	}
+	if strategy.Name != certs.Debian.Name {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  certs.StrategyEnv,
+			Value: strategy.Name,
+		})
+	}
+	if java.TrustStoreType != certs.JavaTrustStorePKCS12 {
+		envVars = append(envVars, corev1.EnvVar{
+			Name:  certs.JavaTrustStoreTypeEnv,
+			Value: string(java.TrustStoreType),
+		})
+	}
 
 	container := corev1.Container{
-		Name:            "setup-ca-certs",
-		Image:           ac.setupCACertsImage,
+		Name:            setupCACertsContainerName,
+		Image:           setupCACertsImage,
 		Env:             envVars,
 		ImagePullPolicy: corev1.PullIfNotPresent,
 		WorkingDir:      "/workspace",
@@ -243,33 +678,221 @@ func (ac *admissionController) SetCaCerts(ctx context.Context, obj *corev1.Pod)
 			Capabilities:             &corev1.Capabilities{Drop: []corev1.Capability{"ALL"}},
 		},
 	}
-	obj.Spec.InitContainers = append([]corev1.Container{container}, obj.Spec.InitContainers...)
+
+	initContainers := []corev1.Container{container}
+	if app, ok := mergeApp(obj, containers); ok && ac.mode == InjectionModeMerge {
+		initContainers = mergeInitContainers(container, app, strategy)
+		if !hasVolume(obj.Spec.Volumes, caCertsHelperVolumeName) {
+			obj.Spec.Volumes = append(obj.Spec.Volumes, corev1.Volume{
+				Name:         caCertsHelperVolumeName,
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			})
+		}
+	}
+	obj.Spec.InitContainers = setCACertsInitContainers(obj.Spec.InitContainers, initContainers)
+	return warnings
 }
 
-func (ac *admissionController) setBuildServicePodDefaults(ctx context.Context, patches duck.JSONPatch, pod corev1.Pod) (duck.JSONPatch, error) {
-	before, after := pod.DeepCopyObject(), pod
-	ac.SetEnvVars(ctx, &after)
-	ac.SetCaCerts(ctx, &after)
+// caCertsConfigMap mirrors the trust store of data into the namespace of the
+// request and returns the copy to mount. It returns nil in init container
+// mode or when the trust store cannot be mirrored, in which case the pod
+// falls back to the setup-ca-certs init container.
+func (ac *admissionController) caCertsConfigMap(ctx context.Context, req *admissionv1.AdmissionRequest, data *injectionData) *caCertsConfigMap {
+	if ac.mirror == nil || data.caCertsData == "" || data.caCertsConfigMap == "" {
+		return nil
+	}
 
-	patch, err := duck.CreatePatch(before, after)
+	logger := logging.FromContext(ctx)
+
+	bundle, err := ac.mirror.bundle(req.Namespace, data.caCertsConfigMap, data.caCertsData)
 	if err != nil {
-		return nil, err
+		logger.Warnf("Error building trust store, falling back to the %s init container: %v", setupCACertsContainerName, err)
+		return nil
 	}
 
-	return append(patches, patch...), nil
+	if req.DryRun == nil || !*req.DryRun {
+		if err := ac.mirror.ensure(ctx, req.Namespace, data.caCertsConfigMap, bundle); err != nil {
+			logger.Warnf("Error mirroring trust store to namespace %q, falling back to the %s init container: %v", req.Namespace, setupCACertsContainerName, err)
+			return nil
+		}
+	}
+
+	return &caCertsConfigMap{name: data.caCertsConfigMap, bundle: bundle}
 }
 
-var universalDeserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+func hasVolume(volumes []corev1.Volume, name string) bool {
+	for _, v := range volumes {
+		if v.Name == name {
+			return true
+		}
+	}
+	return false
+}
 
-func intersect(a []string, b map[string]string) bool {
-	for _, k := range a {
-		if _, ok := b[k]; ok {
+func addVolumeMounts(mounts []corev1.VolumeMount, add []corev1.VolumeMount) []corev1.VolumeMount {
+	for _, mount := range add {
+		if !hasVolumeMount(mounts, mount) {
+			mounts = append(mounts, mount)
+		}
+	}
+	return mounts
+}
+
+func hasVolumeMount(mounts []corev1.VolumeMount, mount corev1.VolumeMount) bool {
+	for _, m := range mounts {
+		if m.Name == mount.Name && m.MountPath == mount.MountPath {
+			return true
+		}
+	}
+	return false
+}
+
+func hasImagePullSecret(secrets []corev1.LocalObjectReference, secret corev1.LocalObjectReference) bool {
+	for _, s := range secrets {
+		if s == secret {
 			return true
 		}
 	}
 	return false
 }
 
+func (ac *admissionController) setBuildServicePodDefaults(ctx context.Context, patches duck.JSONPatch, req *admissionv1.AdmissionRequest, pod corev1.Pod, data *injectionData, selector string) (duck.JSONPatch, []string, error) {
+	trustStore := data.trustStore
+	if trustStore == "" {
+		trustStore = ac.trustStore
+	}
+	strategy, err := trustStoreStrategy(&pod, trustStore)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	mount := ac.mount
+	if data.mount != nil {
+		mount = *data.mount
+	}
+	strategy = mount.apply(strategy)
+
+	profiles := data.runtimeProfiles
+	if profiles == nil {
+		profiles = ac.runtimeProfiles
+	}
+	if profiles, err = podRuntimeProfiles(&pod, profiles); err != nil {
+		return nil, nil, err
+	}
+
+	before, after := pod.DeepCopyObject(), pod
+	ac.SetEnvVars(ctx, &after, data.envVars, data.envPrecedence, data.envContainers.excluding(pod.Annotations[SkipEnvAnnotation]))
+	setupCACertsImage := data.setupCACertsImage
+	if setupCACertsImage == "" {
+		setupCACertsImage = ac.setupCACertsImage
+	}
+	java := ac.java
+	if data.java != nil {
+		java = *data.java
+	}
+	configMap := ac.caCertsConfigMap(ctx, req, data)
+	warnings := ac.SetCaCerts(ctx, &after, data.caCertsData, setupCACertsImage, strategy, java, profiles, configMap, data.caCertsContainers.excluding(pod.Annotations[SkipCACertsAnnotation]))
+
+	// Pods that are already injected are left as they are.
+	if !equality.Semantic.DeepEqual(before, &after) {
+		if err := markInjected(&after, ac.injectionRecord(data, selector)); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	patch, err := duck.CreatePatch(before, after)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(patches, patch...), warnings, nil
+}
+
+// SetEphemeralContainers sets the env vars on the selected ephemeral
+// containers that are not in old and mounts the ca-certs volume into them
+// where strategy mounts it. Volumes cannot be added to a running pod, so the
+// certs are only mounted if the pod was injected when it was created. The
+// warnings report mounts of the containers that conflict with the ca-certs
+// volume.
+func (ac *admissionController) SetEphemeralContainers(ctx context.Context, obj *corev1.Pod, old *corev1.Pod, envVars []corev1.EnvVar, precedence ProxyEnvPrecedence, strategy certs.Strategy, java JavaOptions, profiles []RuntimeProfile, envContainers, caCertsContainers containerFilter) []string {
+	existing := map[string]bool{}
+	for _, c := range old.Spec.EphemeralContainers {
+		existing[c.Name] = true
+	}
+
+	mountCACerts := hasVolume(obj.Spec.Volumes, caCertsVolumeName)
+	if !mountCACerts {
+		logging.FromContext(ctx).Infof("pod has no %q volume, only setting env vars on ephemeral containers", caCertsVolumeName)
+	}
+
+	var warnings, w []string
+	for i := range obj.Spec.EphemeralContainers {
+		c := &obj.Spec.EphemeralContainers[i]
+		if existing[c.Name] {
+			continue
+		}
+
+		if envContainers.selects(c.Name, c.Image) {
+			for _, envVar := range envVars {
+				c.Env = setEnvVar(c.Env, envVar, precedence)
+			}
+		}
+		if mountCACerts && caCertsContainers.selects(c.Name, c.Image) {
+			c.VolumeMounts, w = addCACertsVolumeMounts(c.Name, c.VolumeMounts, caCertsVolumeMounts(strategy))
+			warnings = append(warnings, w...)
+			if options, ok := javaToolOptions(strategy, java.TrustStoreType); ok && java.ToolOptions {
+				c.Env = setJavaToolOptions(c.Env, options)
+			}
+			c.Env = setRuntimeEnvVars(c.Env, runtimeEnvVars(strategy, profiles))
+		}
+	}
+	return warnings
+}
+
+func (ac *admissionController) setEphemeralContainerDefaults(ctx context.Context, patches duck.JSONPatch, pod, old corev1.Pod, data *injectionData) (duck.JSONPatch, []string, error) {
+	// The volume was populated when the pod was created, so the strategy of
+	// the setup-ca-certs container applies rather than the current one, and
+	// it is mounted where the other containers mount it.
+	strategy, err := injectedTrustStoreStrategy(&pod)
+	if err != nil {
+		return nil, nil, err
+	}
+	if mounts := injectedMounts(&pod); len(mounts) > 0 {
+		strategy.Mounts = mounts
+	}
+
+	java := ac.java
+	if data.java != nil {
+		java = *data.java
+	}
+	if java.TrustStoreType, err = injectedJavaTrustStoreType(&pod); err != nil {
+		return nil, nil, err
+	}
+
+	profiles := data.runtimeProfiles
+	if profiles == nil {
+		profiles = ac.runtimeProfiles
+	}
+	if profiles, err = podRuntimeProfiles(&pod, profiles); err != nil {
+		return nil, nil, err
+	}
+
+	before, after := pod.DeepCopyObject(), pod
+	warnings := ac.SetEphemeralContainers(ctx, &after, &old, data.envVars, data.envPrecedence, strategy, java, profiles,
+		data.envContainers.excluding(pod.Annotations[SkipEnvAnnotation]),
+		data.caCertsContainers.excluding(pod.Annotations[SkipCACertsAnnotation]),
+	)
+
+	patch, err := duck.CreatePatch(before, after)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return append(patches, patch...), warnings, nil
+}
+
+var universalDeserializer = serializer.NewCodecFactory(runtime.NewScheme()).UniversalDeserializer()
+
 func boolPointer(b bool) *bool {
 	return &b
 }
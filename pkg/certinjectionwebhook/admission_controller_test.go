@@ -6,6 +6,7 @@ package certinjectionwebhook_test
 import (
 	"context"
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	jp "github.com/evanphx/json-patch/v5"
@@ -17,9 +18,13 @@ import (
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/webhook"
 	wtesting "knative.dev/pkg/webhook/testing"
 
 	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
 )
 
 func TestPodAdmissionController(t *testing.T) {
@@ -33,44 +38,12 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 	)
 
 	when("#NewAdmissionController", func() {
-		it("returns an error if there is not at least one label or annotation", func() {
-			_, err := certinjectionwebhook.NewAdmissionController(
-				"",
-				"",
-				nil,
-				[]string{},
-				[]string{},
-				nil,
-				"",
-				"",
-				corev1.LocalObjectReference{},
-			)
-			require.Errorf(t, err, "at least one label or annotation required")
-
-			_, err = certinjectionwebhook.NewAdmissionController(
-				"",
-				"",
-				nil,
-				[]string{"label"},
-				[]string{},
-				nil,
-				"",
-				"",
-				corev1.LocalObjectReference{},
-			)
-			require.NoError(t, err)
-
-			_, err = certinjectionwebhook.NewAdmissionController(
-				"",
-				"",
-				nil,
-				[]string{},
-				[]string{"annotation"},
-				nil,
-				"",
-				"",
-				corev1.LocalObjectReference{},
-			)
+		it("does not require a label or annotation since policies can select pods", func() {
+			_, err := certinjectionwebhook.NewAdmissionController("", "", nil, certinjectionwebhook.AdmissionOptions{
+				Labels:      []string{},
+				Annotations: []string{},
+				Policies:    certinjectionwebhook.NewPolicySet(),
+			})
 			require.NoError(t, err)
 		})
 	})
@@ -140,17 +113,11 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 		ctx := context.TODO()
 
 		it("sets the env vars on all containers on the pods that are labelled", func() {
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{label},
-				[]string{},
-				envVars,
-				"",
-				"",
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:      []string{label},
+				Annotations: []string{},
+				EnvVars:     envVars,
+			})
 			require.NoError(t, err)
 
 			testPod.Labels = map[string]string{
@@ -186,7 +153,11 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "object-meta",
 					Labels: map[string]string{
-						label: "some value",
+						label:                              "some value",
+						certinjectionwebhook.InjectedLabel: "true",
+					},
+					Annotations: map[string]string{
+						certinjectionwebhook.InjectedAnnotation: injectedAnnotation("", 0),
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -280,17 +251,11 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{},
-				[]string{annotation},
-				envVars,
-				"",
-				"",
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:      []string{},
+				Annotations: []string{annotation},
+				EnvVars:     envVars,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -309,8 +274,12 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			expectedPod := corev1.Pod{
 				ObjectMeta: metav1.ObjectMeta{
 					Name: "object-meta",
+					Labels: map[string]string{
+						certinjectionwebhook.InjectedLabel: "true",
+					},
 					Annotations: map[string]string{
-						annotation: "some value",
+						annotation:                              "some value",
+						certinjectionwebhook.InjectedAnnotation: injectedAnnotation("", 0),
 					},
 				},
 				Spec: corev1.PodSpec{
@@ -404,17 +373,13 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{label},
-				[]string{},
-				[]corev1.EnvVar{},
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{label},
+				Annotations:       []string{},
+				EnvVars:           []corev1.EnvVar{},
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -554,6 +519,7 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			var expectedPatch []jsonpatch.JsonPatchOperation
 			err = json.Unmarshal([]byte(expectedJSON), &expectedPatch)
 			require.NoError(t, err)
+			expectedPatch = append(expectedPatch, injectedPatches(true, false, injectedAnnotation(caCertsData, 0))...)
 
 			assert.ElementsMatch(t, expectedPatch, actualPatch)
 		})
@@ -578,17 +544,13 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{label},
-				[]string{},
-				[]corev1.EnvVar{},
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{label},
+				Annotations:       []string{},
+				EnvVars:           []corev1.EnvVar{},
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -618,17 +580,13 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{},
-				[]string{annotation},
-				[]corev1.EnvVar{},
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{},
+				Annotations:       []string{annotation},
+				EnvVars:           []corev1.EnvVar{},
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -770,6 +728,7 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			var expectedPatch []jsonpatch.JsonPatchOperation
 			err = json.Unmarshal([]byte(expectedJSON), &expectedPatch)
 			require.NoError(t, err)
+			expectedPatch = append(expectedPatch, injectedPatches(false, true, injectedAnnotation(caCertsData, 0))...)
 
 			assert.ElementsMatch(t, expectedPatch, actualPatch)
 		})
@@ -791,17 +750,13 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{label},
-				[]string{},
-				envVars,
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{label},
+				Annotations:       []string{},
+				EnvVars:           envVars,
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -993,6 +948,7 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			var expectedPatch []jsonpatch.JsonPatchOperation
 			err = json.Unmarshal([]byte(expectedJSON), &expectedPatch)
 			require.NoError(t, err)
+			expectedPatch = append(expectedPatch, injectedPatches(true, false, injectedAnnotation(caCertsData, 0))...)
 
 			assert.ElementsMatch(t, expectedPatch, actualPatch)
 		})
@@ -1014,17 +970,13 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{},
-				[]string{annotation},
-				envVars,
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{},
+				Annotations:       []string{annotation},
+				EnvVars:           envVars,
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -1216,6 +1168,7 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			var expectedPatch []jsonpatch.JsonPatchOperation
 			err = json.Unmarshal([]byte(expectedJSON), &expectedPatch)
 			require.NoError(t, err)
+			expectedPatch = append(expectedPatch, injectedPatches(false, true, injectedAnnotation(caCertsData, 0))...)
 
 			assert.ElementsMatch(t, expectedPatch, actualPatch)
 		})
@@ -1237,17 +1190,13 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "containers"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{},
-				[]string{annotation},
-				envVars,
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{},
+				Annotations:       []string{annotation},
+				EnvVars:           envVars,
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -1271,17 +1220,13 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{label},
-				[]string{annotation},
-				envVars,
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{},
-			)
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{label},
+				Annotations:       []string{annotation},
+				EnvVars:           envVars,
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -1289,6 +1234,34 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			require.Nil(t, response.Patch)
 		})
 
+		it("matches annotations by prefix when the configured annotation ends in *", func() {
+			testPod.Labels = nil
+			testPod.Annotations = map[string]string{"kpack.io/build": "some-build"}
+
+			bytes, err := json.Marshal(testPod)
+			require.NoError(t, err)
+
+			admissionRequest := &admissionv1.AdmissionRequest{
+				Name: "testAdmissionRequest",
+				Object: runtime.RawExtension{
+					Raw: bytes,
+				},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			}
+
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Annotations:       []string{"kpack.io/*"},
+				EnvVars:           envVars,
+				SetupCACertsImage: setupCACertsImage,
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, admissionRequest)
+			wtesting.ExpectAllowed(t, response)
+			require.NotNil(t, response.Patch)
+		})
+
 		it("sets the registry credentials on all containers on the pods that have the registry env vars", func() {
 			testPod.Labels = map[string]string{
 				label: "some value",
@@ -1306,19 +1279,16 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{label},
-				[]string{},
-				[]corev1.EnvVar{},
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{label},
+				Annotations:       []string{},
+				EnvVars:           []corev1.EnvVar{},
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+				ImagePullSecrets: corev1.LocalObjectReference{
 					Name: "system-registry-credentials",
 				},
-			)
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -1332,6 +1302,7 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			var expectedPatch []jsonpatch.JsonPatchOperation
 			err = json.Unmarshal([]byte(expectedJSON), &expectedPatch)
 			require.NoError(t, err)
+			expectedPatch = append(expectedPatch, injectedPatches(true, false, injectedAnnotation(caCertsData, 0))...)
 
 			assert.ElementsMatch(t, expectedPatch, actualPatch)
 		})
@@ -1356,19 +1327,16 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
 			}
 
-			ac, err := certinjectionwebhook.NewAdmissionController(
-				name,
-				path,
-				func(ctx context.Context) context.Context { return ctx },
-				[]string{},
-				[]string{annotation},
-				[]corev1.EnvVar{},
-				setupCACertsImage,
-				caCertsData,
-				corev1.LocalObjectReference{
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, func(ctx context.Context) context.Context { return ctx }, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{},
+				Annotations:       []string{annotation},
+				EnvVars:           []corev1.EnvVar{},
+				SetupCACertsImage: setupCACertsImage,
+				CACertsData:       caCertsData,
+				ImagePullSecrets: corev1.LocalObjectReference{
 					Name: "system-registry-credentials",
 				},
-			)
+			})
 			require.NoError(t, err)
 
 			response := ac.Admit(ctx, admissionRequest)
@@ -1382,17 +1350,965 @@ func testPodAdmissionController(t *testing.T, when spec.G, it spec.S) {
 			var expectedPatch []jsonpatch.JsonPatchOperation
 			err = json.Unmarshal([]byte(expectedJSON), &expectedPatch)
 			require.NoError(t, err)
+			expectedPatch = append(expectedPatch, injectedPatches(false, true, injectedAnnotation(caCertsData, 0))...)
+
+			assert.ElementsMatch(t, expectedPatch, actualPatch)
+		})
+
+	})
+
+	when("a pod is admitted again", func() {
+		var (
+			ctx = context.TODO()
+			ac  webhook.AdmissionController
+		)
+
+		it.Before(func() {
+			var err error
+			ac, err = certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				EnvVars:           []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://my.proxy.com"}},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+				ImagePullSecrets:  corev1.LocalObjectReference{Name: "system-registry-credentials"},
+			})
+			require.NoError(t, err)
+		})
+
+		admit := func(pod *corev1.Pod) (*corev1.Pod, []byte) {
+			bytes, err := json.Marshal(pod)
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+			if response.Patch == nil {
+				return pod, nil
+			}
+
+			patch, err := jp.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(bytes)
+			require.NoError(t, err)
+
+			result := &corev1.Pod{}
+			require.NoError(t, json.Unmarshal(patched, result))
+			return result, response.Patch
+		}
+
+		pod := func() *corev1.Pod {
+			return &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Labels: map[string]string{"some/label": ""}},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{Name: "init", Image: "image"}},
+					Containers:     []corev1.Container{{Name: "container", Image: "image"}},
+				},
+			}
+		}
+
+		it("does not patch a pod that is already injected", func() {
+			injected, patch := admit(pod())
+			require.NotNil(t, patch)
+
+			reinjected, patch := admit(injected)
+			require.Nil(t, patch)
+			require.Equal(t, injected, reinjected)
+		})
+
+		it("converges on the same pod when the injection was copied", func() {
+			injected, _ := admit(pod())
+
+			copied := injected.DeepCopy()
+			copied.Spec.Containers[0].Env[0].Value = "http://stale.proxy.com"
+			copied.Spec.InitContainers[0].Image = "stale-image"
+
+			reinjected, _ := admit(copied)
+			require.Equal(t, injected, reinjected)
+		})
+
+		it("injects containers added after the first admission", func() {
+			injected, _ := admit(pod())
+			injected.Spec.Containers = append(injected.Spec.Containers, corev1.Container{Name: "sidecar", Image: "sidecar"})
+
+			reinjected, _ := admit(injected)
+			require.Len(t, reinjected.Spec.Volumes, 1)
+			require.Len(t, reinjected.Spec.InitContainers, 2)
+			require.Len(t, reinjected.Spec.ImagePullSecrets, 1)
+			require.Equal(t, injected.Spec.Containers[0], reinjected.Spec.Containers[0])
+			require.Equal(t, []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://my.proxy.com"}}, reinjected.Spec.Containers[1].Env)
+			require.Equal(t, []corev1.VolumeMount{{Name: "ca-certs", MountPath: "/etc/ssl/certs", ReadOnly: true}}, reinjected.Spec.Containers[1].VolumeMounts)
+		})
+	})
+
+	when("a container already sets proxy env vars", func() {
+		admit := func(precedence certinjectionwebhook.ProxyEnvPrecedence) []jsonpatch.JsonPatchOperation {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels: []string{"some/label"},
+				EnvVars: []corev1.EnvVar{
+					{Name: "HTTP_PROXY", Value: "http://my.proxy.com"},
+					{Name: "HTTPS_PROXY", Value: "http://my.secure.proxy.com"},
+					{Name: "NO_PROXY", Value: ".svc,.cluster.local"},
+				},
+				SetupCACertsImage: "some-ca-certs-image",
+				EnvPrecedence:     precedence,
+			})
+			require.NoError(t, err)
+
+			bytes, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Labels: map[string]string{"some/label": ""}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  "container",
+							Image: "image",
+							Env: []corev1.EnvVar{
+								{Name: "HTTP_PROXY", Value: "http://app.proxy.com"},
+								{Name: "NO_PROXY", Value: "app.example.com,.svc"},
+							},
+						},
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(context.TODO(), &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+
+			var patch []jsonpatch.JsonPatchOperation
+			require.NoError(t, json.Unmarshal(response.Patch, &patch))
+			return patch
+		}
+
+		expectPatch := func(expectedJSON string, actualPatch []jsonpatch.JsonPatchOperation) {
+			t.Helper()
+			var expectedPatch []jsonpatch.JsonPatchOperation
+			require.NoError(t, json.Unmarshal([]byte(expectedJSON), &expectedPatch))
+			expectedPatch = append(expectedPatch, injectedPatches(true, false, injectedAnnotation("", 0))...)
+			assert.ElementsMatch(t, expectedPatch, actualPatch)
+		}
+
+		it("overrides the container's values by default", func() {
+			expectPatch(`[
+				{"op":"replace","path":"/spec/containers/0/env/0/value","value":"http://my.proxy.com"},
+				{"op":"replace","path":"/spec/containers/0/env/1/value","value":".svc,.cluster.local"},
+				{"op":"add","path":"/spec/containers/0/env/2","value":{"name":"HTTPS_PROXY","value":"http://my.secure.proxy.com"}}
+			]`, admit(""))
+
+			expectPatch(`[
+				{"op":"replace","path":"/spec/containers/0/env/0/value","value":"http://my.proxy.com"},
+				{"op":"replace","path":"/spec/containers/0/env/1/value","value":".svc,.cluster.local"},
+				{"op":"add","path":"/spec/containers/0/env/2","value":{"name":"HTTPS_PROXY","value":"http://my.secure.proxy.com"}}
+			]`, admit(certinjectionwebhook.ProxyEnvPrecedenceOverride))
+		})
+
+		it("keeps the container's values", func() {
+			expectPatch(`[
+				{"op":"add","path":"/spec/containers/0/env/2","value":{"name":"HTTPS_PROXY","value":"http://my.secure.proxy.com"}}
+			]`, admit(certinjectionwebhook.ProxyEnvPrecedenceKeep))
+		})
+
+		it("merges the NO_PROXY host lists and keeps the container's other values", func() {
+			expectPatch(`[
+				{"op":"replace","path":"/spec/containers/0/env/1/value","value":"app.example.com,.svc,.cluster.local"},
+				{"op":"add","path":"/spec/containers/0/env/2","value":{"name":"HTTPS_PROXY","value":"http://my.secure.proxy.com"}}
+			]`, admit(certinjectionwebhook.ProxyEnvPrecedenceMerge))
+		})
+	})
+
+	when("the pod annotations skip containers", func() {
+		it("does not inject the skipped containers separately for env vars and ca certs", func() {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				EnvVars:           []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://my.proxy.com"}},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+			})
+			require.NoError(t, err)
+
+			bytes, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:   "some-pod",
+					Labels: map[string]string{"some/label": ""},
+					Annotations: map[string]string{
+						"cert-injection.tanzu.vmware.com/skip-env":      "istio-*",
+						"cert-injection.tanzu.vmware.com/skip-ca-certs": "image:registry.example.com/own-trust/*, other",
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{Name: "app", Image: "app"},
+						{Name: "istio-proxy", Image: "istio/proxyv2"},
+						{Name: "vault-agent", Image: "registry.example.com/own-trust/vault"},
+					},
+				},
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(context.TODO(), &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+
+			patch, err := jp.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(bytes)
+			require.NoError(t, err)
+			pod := &corev1.Pod{}
+			require.NoError(t, json.Unmarshal(patched, pod))
+
+			envVars := []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://my.proxy.com"}}
+			mounts := []corev1.VolumeMount{{Name: "ca-certs", MountPath: "/etc/ssl/certs", ReadOnly: true}}
+
+			require.Equal(t, envVars, pod.Spec.Containers[0].Env)
+			require.Equal(t, mounts, pod.Spec.Containers[0].VolumeMounts)
+
+			require.Empty(t, pod.Spec.Containers[1].Env)
+			require.Equal(t, mounts, pod.Spec.Containers[1].VolumeMounts)
+
+			require.Equal(t, envVars, pod.Spec.Containers[2].Env)
+			require.Empty(t, pod.Spec.Containers[2].VolumeMounts)
+		})
+	})
+
+	when("a trust store strategy is selected", func() {
+		var ctx = context.TODO()
+
+		newAdmissionController := func(trustStore string) (webhook.AdmissionController, error) {
+			return certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+				TrustStore:        trustStore,
+			})
+		}
+
+		admit := func(ac webhook.AdmissionController, annotations map[string]string) (*admissionv1.AdmissionResponse, *corev1.Pod) {
+			bytes, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "some-pod",
+					Labels:      map[string]string{"some/label": ""},
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app"}},
+				},
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			if !response.Allowed {
+				return response, nil
+			}
+
+			patch, err := jp.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(bytes)
+			require.NoError(t, err)
+			pod := &corev1.Pod{}
+			require.NoError(t, json.Unmarshal(patched, pod))
+			return response, pod
+		}
+
+		it("mounts the paths of the default strategy", func() {
+			ac, err := newAdmissionController("alpine")
+			require.NoError(t, err)
+
+			_, pod := admit(ac, nil)
+			require.Equal(t, []corev1.VolumeMount{
+				{Name: "ca-certs", MountPath: "/etc/ssl/certs", SubPath: "certs", ReadOnly: true},
+				{Name: "ca-certs", MountPath: "/etc/ssl/cert.pem", SubPath: "cert.pem", ReadOnly: true},
+			}, pod.Spec.Containers[0].VolumeMounts)
+			require.Contains(t, pod.Spec.InitContainers[0].Env, corev1.EnvVar{Name: "TRUST_STORE_STRATEGY", Value: "alpine"})
+		})
+
+		it("mounts the paths of the strategy of the pod annotation", func() {
+			ac, err := newAdmissionController("alpine")
+			require.NoError(t, err)
+
+			_, pod := admit(ac, map[string]string{"cert-injection.tanzu.vmware.com/trust-store": "rhel"})
+			require.Equal(t, []corev1.VolumeMount{
+				{Name: "ca-certs", MountPath: "/etc/pki/tls/certs", SubPath: "tls/certs", ReadOnly: true},
+				{Name: "ca-certs", MountPath: "/etc/pki/ca-trust/extracted", SubPath: "ca-trust/extracted", ReadOnly: true},
+			}, pod.Spec.Containers[0].VolumeMounts)
+			require.Contains(t, pod.Spec.InitContainers[0].Env, corev1.EnvVar{Name: "TRUST_STORE_STRATEGY", Value: "rhel"})
+		})
+
+		it("does not set the strategy on the setup container for debian", func() {
+			ac, err := newAdmissionController("")
+			require.NoError(t, err)
+
+			_, pod := admit(ac, map[string]string{"cert-injection.tanzu.vmware.com/trust-store": "debian"})
+			for _, e := range pod.Spec.InitContainers[0].Env {
+				require.NotEqual(t, "TRUST_STORE_STRATEGY", e.Name)
+			}
+			require.Equal(t, []corev1.VolumeMount{{Name: "ca-certs", MountPath: "/etc/ssl/certs", ReadOnly: true}}, pod.Spec.Containers[0].VolumeMounts)
+		})
+
+		it("rejects pods annotated with an unknown strategy", func() {
+			ac, err := newAdmissionController("")
+			require.NoError(t, err)
+
+			response, _ := admit(ac, map[string]string{"cert-injection.tanzu.vmware.com/trust-store": "windows"})
+			require.False(t, response.Allowed)
+			require.Contains(t, response.Result.Message, `invalid trust store strategy "windows"`)
+		})
+
+		it("requires a known default strategy", func() {
+			_, err := newAdmissionController("windows")
+			require.EqualError(t, err, `invalid trust store strategy "windows", must be one of debian, rhel, alpine, suse`)
+		})
+	})
+
+	when("java options are configured", func() {
+		var ctx = context.TODO()
+
+		admit := func(java certinjectionwebhook.JavaOptions, env ...corev1.EnvVar) *corev1.Pod {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+				Java:              java,
+			})
+			require.NoError(t, err)
+
+			bytes, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Labels: map[string]string{"some/label": ""}},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app", Env: env}},
+				},
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+
+			patch, err := jp.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(bytes)
+			require.NoError(t, err)
+			pod := &corev1.Pod{}
+			require.NoError(t, json.Unmarshal(patched, pod))
+			return pod
+		}
+
+		it("points the JVM to the truststore", func() {
+			pod := admit(certinjectionwebhook.JavaOptions{ToolOptions: true})
+
+			require.Equal(t, []corev1.EnvVar{{
+				Name:  "JAVA_TOOL_OPTIONS",
+				Value: "-Djavax.net.ssl.trustStore=/etc/ssl/certs/java/cacerts -Djavax.net.ssl.trustStoreType=PKCS12 -Djavax.net.ssl.trustStorePassword=changeit",
+			}}, pod.Spec.Containers[0].Env)
+		})
+
+		it("merges the options with the ones the container sets", func() {
+			pod := admit(
+				certinjectionwebhook.JavaOptions{ToolOptions: true, TrustStoreType: certs.JavaTrustStoreJKS},
+				corev1.EnvVar{Name: "JAVA_TOOL_OPTIONS", Value: "-Xmx512m -Djavax.net.ssl.trustStore=/old/cacerts  -Dfoo=bar"},
+			)
+
+			require.Equal(t, []corev1.EnvVar{{
+				Name:  "JAVA_TOOL_OPTIONS",
+				Value: "-Xmx512m -Dfoo=bar -Djavax.net.ssl.trustStore=/etc/ssl/certs/java/cacerts.jks -Djavax.net.ssl.trustStoreType=JKS -Djavax.net.ssl.trustStorePassword=changeit",
+			}}, pod.Spec.Containers[0].Env)
+			require.Contains(t, pod.Spec.InitContainers[0].Env, corev1.EnvVar{Name: "JAVA_TRUSTSTORE_TYPE", Value: "JKS"})
+		})
+
+		it("only writes the truststore by default", func() {
+			pod := admit(certinjectionwebhook.JavaOptions{TrustStoreType: certs.JavaTrustStoreJKS})
+
+			require.Empty(t, pod.Spec.Containers[0].Env)
+			require.Contains(t, pod.Spec.InitContainers[0].Env, corev1.EnvVar{Name: "JAVA_TRUSTSTORE_TYPE", Value: "JKS"})
+		})
+	})
+
+	when("runtime profiles are selected", func() {
+		var ctx = context.TODO()
+
+		admit := func(profiles []certinjectionwebhook.RuntimeProfile, annotations map[string]string, env ...corev1.EnvVar) (*admissionv1.AdmissionResponse, *corev1.Pod) {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+				RuntimeProfiles:   profiles,
+			})
+			require.NoError(t, err)
+
+			bytes, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "some-pod",
+					Labels:      map[string]string{"some/label": ""},
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app", Env: env}},
+				},
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			if !response.Allowed {
+				return response, nil
+			}
+
+			patch, err := jp.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(bytes)
+			require.NoError(t, err)
+			pod := &corev1.Pod{}
+			require.NoError(t, json.Unmarshal(patched, pod))
+			return response, pod
+		}
+
+		it("points the runtimes of the default profiles to the bundle", func() {
+			_, pod := admit([]certinjectionwebhook.RuntimeProfile{
+				certinjectionwebhook.RuntimeProfileNode,
+				certinjectionwebhook.RuntimeProfileOpenSSL,
+			}, nil)
+
+			require.Equal(t, []corev1.EnvVar{
+				{Name: "NODE_EXTRA_CA_CERTS", Value: "/etc/ssl/certs/ca-certificates.crt"},
+				{Name: "SSL_CERT_FILE", Value: "/etc/ssl/certs/ca-certificates.crt"},
+				{Name: "SSL_CERT_DIR", Value: "/etc/ssl/certs"},
+			}, pod.Spec.Containers[0].Env)
+		})
+
+		it("uses the profiles of the pod annotation and the paths of its strategy", func() {
+			_, pod := admit([]certinjectionwebhook.RuntimeProfile{certinjectionwebhook.RuntimeProfileNode}, map[string]string{
+				"cert-injection.tanzu.vmware.com/runtime-profiles": "python, git",
+				"cert-injection.tanzu.vmware.com/trust-store":      "rhel",
+			})
+
+			require.Equal(t, []corev1.EnvVar{
+				{Name: "REQUESTS_CA_BUNDLE", Value: "/etc/pki/tls/certs/ca-bundle.crt"},
+				{Name: "PIP_CERT", Value: "/etc/pki/tls/certs/ca-bundle.crt"},
+				{Name: "GIT_SSL_CAINFO", Value: "/etc/pki/tls/certs/ca-bundle.crt"},
+			}, pod.Spec.Containers[0].Env)
+		})
+
+		it("keeps the values the container sets", func() {
+			_, pod := admit([]certinjectionwebhook.RuntimeProfile{certinjectionwebhook.RuntimeProfileCurl}, nil,
+				corev1.EnvVar{Name: "CURL_CA_BUNDLE", Value: "/app/ca.pem"},
+			)
+
+			require.Equal(t, []corev1.EnvVar{{Name: "CURL_CA_BUNDLE", Value: "/app/ca.pem"}}, pod.Spec.Containers[0].Env)
+		})
+
+		it("sets no env vars by default", func() {
+			_, pod := admit(nil, nil)
+
+			require.Empty(t, pod.Spec.Containers[0].Env)
+		})
+
+		it("rejects pods annotated with an unknown profile", func() {
+			response, _ := admit(nil, map[string]string{"cert-injection.tanzu.vmware.com/runtime-profiles": "node,ruby"})
+
+			require.False(t, response.Allowed)
+			require.Contains(t, response.Result.Message, `invalid runtime profile "ruby", must be one of node, python, openssl, curl, git`)
+		})
+	})
+
+	when("mount options are set", func() {
+		var ctx = context.TODO()
+
+		admit := func(mount certinjectionwebhook.MountOptions, annotations map[string]string, mounts ...corev1.VolumeMount) (*admissionv1.AdmissionResponse, *corev1.Pod) {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+				Java:              certinjectionwebhook.JavaOptions{ToolOptions: true},
+				Mount:             mount,
+			})
+			require.NoError(t, err)
+
+			bytes, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "some-pod",
+					Labels:      map[string]string{"some/label": ""},
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "app", Image: "app", VolumeMounts: mounts}},
+				},
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+
+			patch, err := jp.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(bytes)
+			require.NoError(t, err)
+			pod := &corev1.Pod{}
+			require.NoError(t, json.Unmarshal(patched, pod))
+			return response, pod
+		}
+
+		it("mounts only the bundles of the strategy in file mode", func() {
+			_, pod := admit(certinjectionwebhook.MountOptions{Mode: certinjectionwebhook.MountModeFile}, map[string]string{
+				"cert-injection.tanzu.vmware.com/trust-store": "alpine",
+			})
+
+			require.Equal(t, []corev1.VolumeMount{
+				{Name: "ca-certs", MountPath: "/etc/ssl/certs/ca-certificates.crt", SubPath: "certs/ca-certificates.crt", ReadOnly: true},
+				{Name: "ca-certs", MountPath: "/etc/ssl/cert.pem", SubPath: "cert.pem", ReadOnly: true},
+			}, pod.Spec.Containers[0].VolumeMounts)
+			require.Empty(t, pod.Spec.Containers[0].Env)
+		})
+
+		it("mounts the extra files in file mode", func() {
+			_, pod := admit(certinjectionwebhook.MountOptions{
+				Mode:  certinjectionwebhook.MountModeFile,
+				Files: []string{"java/cacerts"},
+			}, nil)
+
+			require.Equal(t, []corev1.VolumeMount{
+				{Name: "ca-certs", MountPath: "/etc/ssl/certs/ca-certificates.crt", SubPath: "ca-certificates.crt", ReadOnly: true},
+				{Name: "ca-certs", MountPath: "/etc/ssl/certs/java/cacerts", SubPath: "java/cacerts", ReadOnly: true},
+			}, pod.Spec.Containers[0].VolumeMounts)
+			require.Contains(t, pod.Spec.Containers[0].Env[0].Value, "-Djavax.net.ssl.trustStore=/etc/ssl/certs/java/cacerts")
+		})
+
+		it("mounts the certificate directory at the mount path", func() {
+			_, pod := admit(certinjectionwebhook.MountOptions{Path: "/usr/local/share/certs"}, map[string]string{
+				"cert-injection.tanzu.vmware.com/trust-store": "rhel",
+			})
+
+			require.Equal(t, []corev1.VolumeMount{
+				{Name: "ca-certs", MountPath: "/usr/local/share/certs", SubPath: "tls/certs", ReadOnly: true},
+				{Name: "ca-certs", MountPath: "/etc/pki/ca-trust/extracted", SubPath: "ca-trust/extracted", ReadOnly: true},
+			}, pod.Spec.Containers[0].VolumeMounts)
+		})
+
+		it("warns and does not mount where the container already mounts another volume", func() {
+			existing := corev1.VolumeMount{Name: "certs", MountPath: "/etc/ssl/certs/"}
+			response, pod := admit(certinjectionwebhook.MountOptions{}, nil, existing)
+
+			require.Equal(t, []corev1.VolumeMount{existing}, pod.Spec.Containers[0].VolumeMounts)
+			require.Equal(t, []string{
+				`container "app" already mounts volume "certs" at "/etc/ssl/certs/", not mounting the CA certificates there`,
+			}, response.Warnings)
+		})
+
+		it("warns when the container mounts another volume that overlaps the ca certs", func() {
+			existing := corev1.VolumeMount{Name: "keystore", MountPath: "/etc/ssl/certs/java"}
+			response, pod := admit(certinjectionwebhook.MountOptions{}, nil, existing)
+
+			require.Equal(t, []corev1.VolumeMount{
+				existing,
+				{Name: "ca-certs", MountPath: "/etc/ssl/certs", ReadOnly: true},
+			}, pod.Spec.Containers[0].VolumeMounts)
+			require.Equal(t, []string{
+				`container "app" mounts volume "keystore" at "/etc/ssl/certs/java", which overlaps the CA certificates mounted at "/etc/ssl/certs"`,
+			}, response.Warnings)
+		})
+
+		it("does not warn about mounts next to the files in file mode", func() {
+			existing := corev1.VolumeMount{Name: "keystore", MountPath: "/etc/ssl/certs/java"}
+			response, pod := admit(certinjectionwebhook.MountOptions{Mode: certinjectionwebhook.MountModeFile}, nil, existing)
+
+			require.Len(t, pod.Spec.Containers[0].VolumeMounts, 2)
+			require.Empty(t, response.Warnings)
+		})
+
+		it("parses the mount options", func() {
+			options, err := certinjectionwebhook.ParseMountOptions("", "/etc/ssl/certs/", []string{" java/cacerts", ""})
+			require.NoError(t, err)
+			require.Equal(t, certinjectionwebhook.MountOptions{
+				Mode:  certinjectionwebhook.MountModeDirectory,
+				Path:  "/etc/ssl/certs",
+				Files: []string{"java/cacerts"},
+			}, options)
+
+			_, err = certinjectionwebhook.ParseMountOptions("subpath", "", nil)
+			require.EqualError(t, err, `invalid mount mode "subpath", must be one of "directory" or "file"`)
+
+			_, err = certinjectionwebhook.ParseMountOptions("", "etc/ssl/certs", nil)
+			require.EqualError(t, err, `invalid mount path "etc/ssl/certs", must be absolute`)
+
+			_, err = certinjectionwebhook.ParseMountOptions("file", "", []string{"/etc/passwd"})
+			require.EqualError(t, err, `invalid mount file "/etc/passwd", must be a relative path in the trust store`)
+		})
+	})
+
+	when("the injection mode is merge", func() {
+		const cert = "-----BEGIN CERTIFICATE-----\n-----END CERTIFICATE-----\n"
+
+		var ctx = context.TODO()
+
+		admit := func(pod *corev1.Pod) *corev1.Pod {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       cert,
+				Mode:              certinjectionwebhook.InjectionModeMerge,
+			})
+			require.NoError(t, err)
+
+			bytes, err := json.Marshal(pod)
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+			if response.Patch == nil {
+				return pod
+			}
+
+			patch, err := jp.DecodePatch(response.Patch)
+			require.NoError(t, err)
+			patched, err := patch.Apply(bytes)
+			require.NoError(t, err)
+			admitted := &corev1.Pod{}
+			require.NoError(t, json.Unmarshal(patched, admitted))
+			return admitted
+		}
+
+		newPod := func(annotations map[string]string) *corev1.Pod {
+			uid := int64(1000)
+			return &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        "some-pod",
+					Labels:      map[string]string{"some/label": ""},
+					Annotations: annotations,
+				},
+				Spec: corev1.PodSpec{
+					InitContainers: []corev1.Container{{Name: "init", Image: "init"}},
+					Containers: []corev1.Container{
+						{
+							Name:            "app",
+							Image:           "some-registry.io/app:1.0",
+							ImagePullPolicy: corev1.PullAlways,
+							SecurityContext: &corev1.SecurityContext{RunAsUser: &uid},
+						},
+						{Name: "sidecar", Image: "sidecar"},
+					},
+				},
+			}
+		}
+
+		it("installs the helper and runs it in the image of the first container", func() {
+			pod := admit(newPod(nil))
+
+			require.Contains(t, pod.Spec.Volumes, corev1.Volume{
+				Name:         "ca-certs-helper",
+				VolumeSource: corev1.VolumeSource{EmptyDir: &corev1.EmptyDirVolumeSource{}},
+			})
+			require.Len(t, pod.Spec.InitContainers, 3)
+
+			install := pod.Spec.InitContainers[0]
+			require.Equal(t, "setup-ca-certs", install.Name)
+			require.Equal(t, "some-ca-certs-image", install.Image)
+			require.Equal(t, []corev1.EnvVar{{Name: "CA_CERTS_HELPER_PATH", Value: "/ca-certs-helper/setup-ca-certs"}}, install.Env)
+			require.Equal(t, []corev1.VolumeMount{{Name: "ca-certs-helper", MountPath: "/ca-certs-helper"}}, install.VolumeMounts)
+
+			merge := pod.Spec.InitContainers[1]
+			require.Equal(t, "merge-ca-certs", merge.Name)
+			require.Equal(t, "some-registry.io/app:1.0", merge.Image)
+			require.Equal(t, corev1.PullAlways, merge.ImagePullPolicy)
+			require.Equal(t, []string{"/ca-certs-helper/setup-ca-certs"}, merge.Command)
+			require.Equal(t, []corev1.EnvVar{
+				{Name: "CA_CERTS_DATA_0", Value: cert},
+				{Name: "SYSTEM_CA_CERTS", Value: "/etc/ssl/certs/ca-certificates.crt"},
+			}, merge.Env)
+			require.Equal(t, "/workspace", merge.WorkingDir)
+			require.Equal(t, []corev1.VolumeMount{
+				{Name: "ca-certs", MountPath: "/workspace"},
+				{Name: "ca-certs-helper", MountPath: "/ca-certs-helper", ReadOnly: true},
+			}, merge.VolumeMounts)
+			require.Equal(t, int64(1000), *merge.SecurityContext.RunAsUser)
+			require.Nil(t, merge.SecurityContext.RunAsNonRoot)
+			require.False(t, *merge.SecurityContext.AllowPrivilegeEscalation)
+
+			require.Equal(t, "init", pod.Spec.InitContainers[2].Name)
+			require.Equal(t, []corev1.VolumeMount{{Name: "ca-certs", MountPath: "/etc/ssl/certs", ReadOnly: true}}, pod.Spec.InitContainers[2].VolumeMounts)
+			require.Empty(t, pod.Spec.InitContainers[2].Env)
+		})
+
+		it("reads the bundle of the image where the strategy expects it", func() {
+			pod := admit(newPod(map[string]string{"cert-injection.tanzu.vmware.com/trust-store": "rhel"}))
+
+			require.Contains(t, pod.Spec.InitContainers[1].Env, corev1.EnvVar{Name: "SYSTEM_CA_CERTS", Value: "/etc/pki/tls/certs/ca-bundle.crt"})
+			require.Contains(t, pod.Spec.InitContainers[1].Env, corev1.EnvVar{Name: "TRUST_STORE_STRATEGY", Value: "rhel"})
+		})
+
+		it("merges into the image of the first container that gets the ca certs", func() {
+			pod := admit(newPod(map[string]string{"cert-injection.tanzu.vmware.com/skip-ca-certs": "app"}))
+
+			require.Equal(t, "sidecar", pod.Spec.InitContainers[1].Image)
+		})
+
+		it("does not add the init containers again", func() {
+			pod := admit(newPod(nil))
+			again := admit(pod.DeepCopy())
+
+			require.Equal(t, pod, again)
+		})
+	})
+
+	when("ephemeral containers are added", func() {
+		var (
+			ctx = context.TODO()
+			ac  webhook.AdmissionController
+		)
+
+		it.Before(func() {
+			var err error
+			ac, err = certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				EnvVars:           []corev1.EnvVar{{Name: "HTTP_PROXY", Value: "http://my.proxy.com"}},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+			})
+			require.NoError(t, err)
+		})
+
+		debugContainer := func(name string) corev1.EphemeralContainer {
+			return corev1.EphemeralContainer{
+				EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: name, Image: "busybox"},
+			}
+		}
+
+		admit := func(operation admissionv1.Operation, subResource string, old, pod *corev1.Pod) *admissionv1.AdmissionResponse {
+			oldBytes, err := json.Marshal(old)
+			require.NoError(t, err)
+			bytes, err := json.Marshal(pod)
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Object:      runtime.RawExtension{Raw: bytes},
+				OldObject:   runtime.RawExtension{Raw: oldBytes},
+				Operation:   operation,
+				SubResource: subResource,
+				Resource:    metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+			return response
+		}
+
+		pod := func(volumes ...corev1.Volume) *corev1.Pod {
+			return &corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Labels: map[string]string{"some/label": ""}},
+				Spec: corev1.PodSpec{
+					Containers:          []corev1.Container{{Name: "container", Image: "image"}},
+					EphemeralContainers: []corev1.EphemeralContainer{debugContainer("existing-debugger")},
+					Volumes:             volumes,
+				},
+			}
+		}
+
+		it("sets the env vars and mounts the ca certs on new ephemeral containers", func() {
+			old := pod(corev1.Volume{Name: "ca-certs"})
+			updated := old.DeepCopy()
+			updated.Spec.EphemeralContainers = append(updated.Spec.EphemeralContainers, debugContainer("debugger"))
+
+			response := admit(admissionv1.Update, "ephemeralcontainers", old, updated)
+
+			expectedJSON := `[
+				{"op":"add","path":"/spec/ephemeralContainers/1/env","value":[{"name":"HTTP_PROXY","value":"http://my.proxy.com"}]},
+				{"op":"add","path":"/spec/ephemeralContainers/1/volumeMounts","value":[{"mountPath":"/etc/ssl/certs","name":"ca-certs","readOnly":true}]}
+			]`
+			var expectedPatch, actualPatch []jsonpatch.JsonPatchOperation
+			require.NoError(t, json.Unmarshal([]byte(expectedJSON), &expectedPatch))
+			require.NoError(t, json.Unmarshal(response.Patch, &actualPatch))
+			assert.ElementsMatch(t, expectedPatch, actualPatch)
+		})
+
+		it("mounts the ca certs where the strategy of the setup container expects them", func() {
+			old := pod(corev1.Volume{Name: "ca-certs"})
+			old.Spec.InitContainers = []corev1.Container{{
+				Name: "setup-ca-certs",
+				Env:  []corev1.EnvVar{{Name: "TRUST_STORE_STRATEGY", Value: "suse"}},
+			}}
+			updated := old.DeepCopy()
+			updated.Spec.EphemeralContainers = append(updated.Spec.EphemeralContainers, debugContainer("debugger"))
+
+			response := admit(admissionv1.Update, "ephemeralcontainers", old, updated)
+
+			expectedJSON := `[
+				{"op":"add","path":"/spec/ephemeralContainers/1/env","value":[{"name":"HTTP_PROXY","value":"http://my.proxy.com"}]},
+				{"op":"add","path":"/spec/ephemeralContainers/1/volumeMounts","value":[{"mountPath":"/var/lib/ca-certificates","name":"ca-certs","readOnly":true}]}
+			]`
+			var expectedPatch, actualPatch []jsonpatch.JsonPatchOperation
+			require.NoError(t, json.Unmarshal([]byte(expectedJSON), &expectedPatch))
+			require.NoError(t, json.Unmarshal(response.Patch, &actualPatch))
+			assert.ElementsMatch(t, expectedPatch, actualPatch)
+		})
+
+		it("mounts the ca certs where the containers of the pod mount them", func() {
+			old := pod(corev1.Volume{Name: "ca-certs"})
+			old.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+				{Name: "ca-certs", MountPath: "/etc/ssl/certs/ca-certificates.crt", SubPath: "ca-certificates.crt", ReadOnly: true},
+			}
+			updated := old.DeepCopy()
+			updated.Spec.EphemeralContainers = append(updated.Spec.EphemeralContainers, debugContainer("debugger"))
+
+			response := admit(admissionv1.Update, "ephemeralcontainers", old, updated)
+
+			expectedJSON := `[
+				{"op":"add","path":"/spec/ephemeralContainers/1/env","value":[{"name":"HTTP_PROXY","value":"http://my.proxy.com"}]},
+				{"op":"add","path":"/spec/ephemeralContainers/1/volumeMounts","value":[{"mountPath":"/etc/ssl/certs/ca-certificates.crt","subPath":"ca-certificates.crt","name":"ca-certs","readOnly":true}]}
+			]`
+			var expectedPatch, actualPatch []jsonpatch.JsonPatchOperation
+			require.NoError(t, json.Unmarshal([]byte(expectedJSON), &expectedPatch))
+			require.NoError(t, json.Unmarshal(response.Patch, &actualPatch))
+			assert.ElementsMatch(t, expectedPatch, actualPatch)
+		})
+
+		it("only sets the env vars when the pod has no ca certs volume", func() {
+			old := pod()
+			updated := old.DeepCopy()
+			updated.Spec.EphemeralContainers = append(updated.Spec.EphemeralContainers, debugContainer("debugger"))
 
+			response := admit(admissionv1.Update, "ephemeralcontainers", old, updated)
+
+			expectedJSON := `[
+				{"op":"add","path":"/spec/ephemeralContainers/1/env","value":[{"name":"HTTP_PROXY","value":"http://my.proxy.com"}]}
+			]`
+			var expectedPatch, actualPatch []jsonpatch.JsonPatchOperation
+			require.NoError(t, json.Unmarshal([]byte(expectedJSON), &expectedPatch))
+			require.NoError(t, json.Unmarshal(response.Patch, &actualPatch))
 			assert.ElementsMatch(t, expectedPatch, actualPatch)
 		})
 
+		it("lets other pod updates through", func() {
+			old := pod()
+			updated := old.DeepCopy()
+			updated.Spec.EphemeralContainers = append(updated.Spec.EphemeralContainers, debugContainer("debugger"))
+
+			require.Nil(t, admit(admissionv1.Update, "", old, updated).Patch)
+			require.Nil(t, admit(admissionv1.Update, "status", old, updated).Patch)
+		})
+	})
+
+	when("a namespace label is configured", func() {
+		const namespaceLabel = "cert-injection.tanzu.vmware.com/inject"
+
+		var (
+			ctx             = context.TODO()
+			namespaceLister corelisters.NamespaceLister
+		)
+
+		it.Before(func() {
+			indexer := cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+			for name, value := range map[string]string{
+				"enabled-namespace":  "enabled",
+				"disabled-namespace": "disabled",
+				"other-namespace":    "",
+			} {
+				ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: name}}
+				if value != "" {
+					ns.Labels = map[string]string{namespaceLabel: value}
+				}
+				require.NoError(t, indexer.Add(ns))
+			}
+			namespaceLister = corelisters.NewNamespaceLister(indexer)
+		})
+
+		admit := func(namespace string, podLabels map[string]string) *admissionv1.AdmissionResponse {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       "some-cert",
+				NamespaceLabel:    namespaceLabel,
+				NamespaceLister:   namespaceLister,
+			})
+			require.NoError(t, err)
+
+			bytes, err := json.Marshal(&corev1.Pod{
+				ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Labels: podLabels},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{{Name: "container", Image: "image"}},
+				},
+			})
+			require.NoError(t, err)
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Namespace: namespace,
+				Object:    runtime.RawExtension{Raw: bytes},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+			return response
+		}
+
+		it("injects all pods in namespaces that opted in", func() {
+			require.NotNil(t, admit("enabled-namespace", nil).Patch)
+		})
+
+		it("does not inject pods in namespaces that opted out", func() {
+			require.Nil(t, admit("disabled-namespace", map[string]string{"some/label": ""}).Patch)
+		})
+
+		it("selects pods by their labels in other namespaces", func() {
+			require.Nil(t, admit("other-namespace", nil).Patch)
+			require.NotNil(t, admit("other-namespace", map[string]string{"some/label": ""}).Patch)
+			require.NotNil(t, admit("unknown-namespace", map[string]string{"some/label": ""}).Patch)
+		})
 	})
 
 	it("#Path returns path", func() {
-		ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, []string{"label"}, nil, nil, "", "", corev1.LocalObjectReference{})
+		ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+			Labels: []string{"label"},
+		})
 		require.NoError(t, err)
 
 		require.Equal(t, ac.Path(), path)
 	})
 
 }
+
+// injectedAnnotation returns the InjectedAnnotation of pods injected with the
+// CA bundle by the default selector of a webhook without a version.
+func injectedAnnotation(caCertsData string, certificates int) string {
+	if caCertsData == "" {
+		return fmt.Sprintf(`{"certificates":%d,"selector":"default"}`, certificates)
+	}
+	return fmt.Sprintf(`{"bundleSHA256":"%s","certificates":%d,"selector":"default"}`, bundleSHA(caCertsData), certificates)
+}
+
+// injectedPatches returns the operations that set the InjectedLabel and the
+// InjectedAnnotation of a pod that has other labels and annotations or none.
+func injectedPatches(labelled, annotated bool, value string) []jsonpatch.JsonPatchOperation {
+	var patches []jsonpatch.JsonPatchOperation
+	if labelled {
+		patches = append(patches, jsonpatch.NewOperation("add", "/metadata/labels/cert-injection.tanzu.vmware.com~1injected", "true"))
+	} else {
+		patches = append(patches, jsonpatch.NewOperation("add", "/metadata/labels", map[string]interface{}{certinjectionwebhook.InjectedLabel: "true"}))
+	}
+	if annotated {
+		patches = append(patches, jsonpatch.NewOperation("add", "/metadata/annotations/cert-injection.tanzu.vmware.com~1injected", value))
+	} else {
+		patches = append(patches, jsonpatch.NewOperation("add", "/metadata/annotations", map[string]interface{}{certinjectionwebhook.InjectedAnnotation: value}))
+	}
+	return patches
+}
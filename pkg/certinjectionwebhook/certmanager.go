@@ -0,0 +1,219 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"knative.dev/pkg/system"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+const (
+	CASourceKindCertificate   = "Certificate"
+	CASourceKindIssuer        = "Issuer"
+	CASourceKindClusterIssuer = "ClusterIssuer"
+
+	// tlsCAKey is the key of the CA certificate in TLS Secrets issued by
+	// cert-manager.
+	tlsCAKey = "ca.crt"
+
+	// indirectResyncPeriod is how often the indirect sources are loaded
+	// again, since changes to the cert-manager and trust-manager resources
+	// and to the Secrets of ClusterIssuers are not watched.
+	indirectResyncPeriod = 5 * time.Minute
+)
+
+var (
+	certificateResource   = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}
+	issuerResource        = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "issuers"}
+	clusterIssuerResource = schema.GroupVersionResource{Group: "cert-manager.io", Version: "v1", Resource: "clusterissuers"}
+)
+
+// CertManagerOptions configure the CA sources issued by cert-manager.
+type CertManagerOptions struct {
+	// ClusterResourceNamespace is the namespace of the Secrets of
+	// ClusterIssuers.
+	ClusterResourceNamespace string
+
+	// RotationOverlap is how long the certificates that rotated out of a
+	// source keep being injected besides the new ones.
+	RotationOverlap time.Duration
+}
+
+// ParseCertManagerOptions validates the cluster resource namespace and the
+// rotation overlap.
+func ParseCertManagerOptions(clusterResourceNamespace string, rotationOverlap time.Duration) (CertManagerOptions, error) {
+	if clusterResourceNamespace == "" {
+		return CertManagerOptions{}, fmt.Errorf("invalid cert-manager cluster resource namespace %q, must not be empty", clusterResourceNamespace)
+	}
+	if rotationOverlap < 0 {
+		return CertManagerOptions{}, fmt.Errorf("invalid CA rotation overlap %q, must not be negative", rotationOverlap.String())
+	}
+	return CertManagerOptions{ClusterResourceNamespace: clusterResourceNamespace, RotationOverlap: rotationOverlap}, nil
+}
+
+// retiredCert is a certificate that rotated out of a source and is injected
+// until the overlap ends.
+type retiredCert struct {
+	pem, sha256 string
+	until       time.Time
+}
+
+// certManager returns whether the source is issued by cert-manager: a
+// Certificate, an Issuer, a ClusterIssuer or a TLS Secret. Their rotations
+// are overlapped.
+func (s CASource) certManager() bool {
+	switch s.Kind {
+	case CASourceKindCertificate, CASourceKindIssuer, CASourceKindClusterIssuer:
+		return true
+	default:
+		return s.Kind == CASourceKindSecret && s.Key == ""
+	}
+}
+
+// loadCertManager returns the CA certificates of the Secret of the
+// Certificate, Issuer or ClusterIssuer. The Secrets of Certificates and
+// Issuers in the system namespace are remembered so that their changes are
+// watched.
+func (s *CASourceSet) loadCertManager(ctx context.Context, source CASource) ([]byte, error) {
+	var (
+		resource = certificateResource
+		path     = []string{"spec", "secretName"}
+	)
+	switch source.Kind {
+	case CASourceKindIssuer:
+		resource, path = issuerResource, []string{"spec", "ca", "secretName"}
+	case CASourceKindClusterIssuer:
+		resource, path = clusterIssuerResource, []string{"spec", "ca", "secretName"}
+	}
+
+	var (
+		obj *unstructured.Unstructured
+		err error
+	)
+	if source.Kind == CASourceKindClusterIssuer {
+		obj, err = s.dynamicClient.Resource(resource).Get(ctx, source.Name, metav1.GetOptions{})
+	} else {
+		obj, err = s.dynamicClient.Resource(resource).Namespace(system.Namespace()).Get(ctx, source.Name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	secretName, _, _ := unstructured.NestedString(obj.Object, path...)
+	if secretName == "" {
+		if source.Kind == CASourceKindCertificate {
+			return nil, fmt.Errorf("certificate %q has no secretName", source.Name)
+		}
+		return nil, fmt.Errorf("%s %q is not a CA issuer", strings.ToLower(source.Kind), source.Name)
+	}
+
+	var secret *corev1.Secret
+	if source.Kind == CASourceKindClusterIssuer {
+		secret, err = s.client.CoreV1().Secrets(s.options.ClusterResourceNamespace).Get(ctx, secretName, metav1.GetOptions{})
+	} else {
+		s.setTarget(source, resolvedTarget{kind: CASourceKindSecret, name: secretName})
+		secret, err = s.secretLister.Secrets(system.Namespace()).Get(secretName)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return tlsSecretCAs(secret)
+}
+
+// tlsSecretCAs returns the ca.crt of the TLS Secret or else the CA
+// certificates of the chain in its tls.crt.
+func tlsSecretCAs(secret *corev1.Secret) ([]byte, error) {
+	if data := secret.Data[tlsCAKey]; len(data) > 0 {
+		return data, nil
+	}
+
+	chain, ok := secret.Data[corev1.TLSCertKey]
+	if !ok {
+		return nil, fmt.Errorf("secret %q has neither %q nor %q key", secret.Name, tlsCAKey, corev1.TLSCertKey)
+	}
+
+	var cas []byte
+	for block, rest := pem.Decode(chain); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("secret %q: failed to parse certificate: %v", secret.Name, err)
+		}
+		if cert.IsCA {
+			cas = append(cas, pem.EncodeToMemory(block)...)
+		}
+	}
+	return cas, nil
+}
+
+// rotate retires the certificates of the cert-manager source that are not
+// in its new data. Retired certificates are injected until the rotation
+// overlap ends or they expire. The lock must be held.
+func (s *CASourceSet) rotate(source CASource, data string, now time.Time) {
+	previous, ok := s.data[source]
+	if !source.certManager() || !ok {
+		return
+	}
+
+	current := map[string]bool{}
+	for _, c := range certs.Certificates(data) {
+		current[c.SHA256] = true
+	}
+
+	var retired []retiredCert
+	for _, r := range s.retired[source] {
+		if !current[r.sha256] {
+			retired = append(retired, r)
+		}
+	}
+	for _, p := range certs.Split(previous) {
+		infos := certs.Certificates(p)
+		if len(infos) == 0 || current[infos[0].SHA256] {
+			continue
+		}
+		until := now.Add(s.options.RotationOverlap)
+		if infos[0].NotAfter.Before(until) {
+			until = infos[0].NotAfter
+		}
+		retired = append(retired, retiredCert{pem: p, sha256: infos[0].SHA256, until: until})
+	}
+	s.retired[source] = retired
+}
+
+// nextResync returns when the indirect sources are loaded again: at the
+// end of the next rotation overlap, at the latest after the resync period.
+// It returns false if there are neither indirect sources nor rotations.
+func (s *CASourceSet) nextResync(now time.Time) (time.Duration, bool) {
+	var ok bool
+	for _, source := range s.sources {
+		ok = ok || source.indirect() || source.certManager()
+	}
+	if !ok {
+		return 0, false
+	}
+
+	next := indirectResyncPeriod
+	for _, retired := range s.retired {
+		for _, r := range retired {
+			if d := r.until.Sub(now); d > 0 && d < next {
+				next = d
+			}
+		}
+	}
+	return next, true
+}
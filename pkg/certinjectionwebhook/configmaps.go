@@ -0,0 +1,106 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"encoding/base64"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/logging"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+const (
+	CaCertConfigMapName     = "ca-cert"
+	HTTPProxyConfigMapName  = "http-proxy"
+	HTTPSProxyConfigMapName = "https-proxy"
+	NoProxyConfigMapName    = "no-proxy"
+
+	caCertConfigMapKey = "ca.crt"
+	proxyConfigMapKey  = "value"
+)
+
+// WatchConfigMaps keeps the CA bundle and proxy env vars of the admission
+// controller in sync with the ConfigMaps in the system namespace. The CA
+// bundle of the ca-cert ConfigMap is aggregated with the sources, if any.
+func WatchConfigMaps(ctx context.Context, cmw configmap.Watcher, ac *admissionController, sources *CASourceSet) {
+	logger := logging.FromContext(ctx)
+
+	if sources != nil {
+		sources.update = ac.updateCaCertsData
+		sources.expiry = ac.expiry
+		ac.loaded = append(ac.loaded, sources.loaded)
+	}
+
+	cmw.Watch(CaCertConfigMapName, func(cm *corev1.ConfigMap) {
+		caCertsData, err := base64.StdEncoding.DecodeString(cm.Data[caCertConfigMapKey])
+		if err != nil {
+			logger.Errorf("Error decoding %q from configmap %q, keeping previous ca certs: %v", caCertConfigMapKey, cm.Name, err)
+			return
+		}
+
+		warnings, err := certs.ValidateBundle(caCertsData, time.Now())
+		if err != nil {
+			logger.Errorf("Invalid ca certs in configmap %q, keeping previous ca certs: %v", cm.Name, err)
+			return
+		}
+		for _, w := range warnings {
+			logger.Warnf("Configmap %q: %s", cm.Name, w)
+		}
+
+		logger.Infof("Updating ca certs from configmap %q", cm.Name)
+		if sources != nil {
+			sources.setCACertConfigMap(string(caCertsData))
+			return
+		}
+		ac.UpdateCaCertsData(string(caCertsData))
+	})
+
+	var (
+		lock    sync.Mutex
+		proxies = map[string]string{}
+	)
+	proxyObserver := func(cm *corev1.ConfigMap) {
+		lock.Lock()
+		defer lock.Unlock()
+
+		proxies[cm.Name] = cm.Data[proxyConfigMapKey]
+
+		logger.Infof("Updating proxy env vars from configmap %q", cm.Name)
+		ac.UpdateEnvVars(proxyEnvVars(
+			proxies[HTTPProxyConfigMapName],
+			proxies[HTTPSProxyConfigMapName],
+			proxies[NoProxyConfigMapName],
+		))
+	}
+	cmw.Watch(HTTPProxyConfigMapName, proxyObserver)
+	cmw.Watch(HTTPSProxyConfigMapName, proxyObserver)
+	cmw.Watch(NoProxyConfigMapName, proxyObserver)
+}
+
+func proxyEnvVars(httpProxy, httpsProxy, noProxy string) []corev1.EnvVar {
+	var envVars []corev1.EnvVar
+
+	if httpProxy != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "HTTP_PROXY", Value: httpProxy})
+		envVars = append(envVars, corev1.EnvVar{Name: "http_proxy", Value: httpProxy})
+	}
+
+	if httpsProxy != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "HTTPS_PROXY", Value: httpsProxy})
+		envVars = append(envVars, corev1.EnvVar{Name: "https_proxy", Value: httpsProxy})
+	}
+
+	if noProxy != "" {
+		envVars = append(envVars, corev1.EnvVar{Name: "NO_PROXY", Value: noProxy})
+		envVars = append(envVars, corev1.EnvVar{Name: "no_proxy", Value: noProxy})
+	}
+
+	return envVars
+}
@@ -0,0 +1,104 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"regexp"
+	"strings"
+)
+
+const (
+	// SkipCACertsAnnotation lists the container patterns of a pod that do
+	// not get the ca certs mounted.
+	SkipCACertsAnnotation = "cert-injection.tanzu.vmware.com/skip-ca-certs"
+
+	// SkipEnvAnnotation lists the container patterns of a pod that do not
+	// get the proxy env vars.
+	SkipEnvAnnotation = "cert-injection.tanzu.vmware.com/skip-env"
+
+	imagePatternPrefix = "image:"
+)
+
+// containerFilter selects the containers that are injected. A container is
+// selected when it matches any include pattern, or there are none, and
+// matches no exclude pattern.
+type containerFilter struct {
+	include []containerPattern
+	exclude []containerPattern
+}
+
+func newContainerFilter(include, exclude []string) containerFilter {
+	return containerFilter{
+		include: containerPatterns(include),
+		exclude: containerPatterns(exclude),
+	}
+}
+
+// excluding returns a copy of the filter that also excludes the
+// comma-separated patterns.
+func (f containerFilter) excluding(patterns string) containerFilter {
+	if strings.TrimSpace(patterns) == "" {
+		return f
+	}
+
+	return containerFilter{
+		include: f.include,
+		exclude: append(append([]containerPattern{}, f.exclude...), containerPatterns(strings.Split(patterns, ","))...),
+	}
+}
+
+func (f containerFilter) selects(name, image string) bool {
+	for _, p := range f.exclude {
+		if p.matches(name, image) {
+			return false
+		}
+	}
+
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, p := range f.include {
+		if p.matches(name, image) {
+			return true
+		}
+	}
+	return false
+}
+
+// containerPattern matches the container name, or the image when prefixed
+// with "image:". "*" matches any sequence of characters and "?" a single
+// character.
+type containerPattern struct {
+	image bool
+	re    *regexp.Regexp
+}
+
+func containerPatterns(patterns []string) []containerPattern {
+	var res []containerPattern
+	for _, p := range patterns {
+		p = strings.TrimSpace(p)
+		if p == "" {
+			continue
+		}
+
+		image := strings.HasPrefix(p, imagePatternPrefix)
+		p = strings.TrimPrefix(p, imagePatternPrefix)
+
+		glob := regexp.QuoteMeta(p)
+		glob = strings.ReplaceAll(glob, `\*`, ".*")
+		glob = strings.ReplaceAll(glob, `\?`, ".")
+		res = append(res, containerPattern{
+			image: image,
+			re:    regexp.MustCompile("^" + glob + "$"),
+		})
+	}
+	return res
+}
+
+func (p containerPattern) matches(name, image string) bool {
+	if p.image {
+		return p.re.MatchString(image)
+	}
+	return p.re.MatchString(name)
+}
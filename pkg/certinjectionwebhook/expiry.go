@@ -0,0 +1,349 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/system"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/apis/certinjection/v1alpha1"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+const (
+	reasonCACertificateExpiring = "CACertificateExpiring"
+	reasonCACertificateExpired  = "CACertificateExpired"
+
+	day = 24 * time.Hour
+)
+
+// expiryDescriptor describes the metric of the expiry of the injected CA
+// certificates.
+var expiryDescriptor = metricdata.Descriptor{
+	Name:        "ca_cert_expiration_timestamp_seconds",
+	Description: "The time the injected CA certificate expires at, in seconds since the Unix epoch",
+	Unit:        metricdata.UnitDimensionless,
+	Type:        metricdata.TypeGaugeInt64,
+	LabelKeys: []metricdata.LabelKey{
+		{Key: "source_kind", Description: "The kind of the object the bundle is read from"},
+		{Key: "source_name", Description: "The name of the object the bundle is read from"},
+		{Key: "subject", Description: "The subject of the certificate"},
+		{Key: "sha256", Description: "The SHA-256 fingerprint of the certificate"},
+	},
+}
+
+// ParseExpiryThresholds parses durations like 72h or a number of days like
+// 30d and orders them from the longest to the shortest. Empty values are
+// skipped.
+func ParseExpiryThresholds(values []string) ([]time.Duration, error) {
+	var thresholds []time.Duration
+	seen := map[time.Duration]bool{}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		d, err := parseExpiryThreshold(v)
+		if err != nil || d <= 0 {
+			return nil, fmt.Errorf("invalid expiry threshold %q, must be a positive duration such as 30d or 72h", v)
+		}
+		if !seen[d] {
+			seen[d] = true
+			thresholds = append(thresholds, d)
+		}
+	}
+
+	sort.Slice(thresholds, func(i, j int) bool {
+		return thresholds[i] > thresholds[j]
+	})
+	return thresholds, nil
+}
+
+func parseExpiryThreshold(v string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		return time.Duration(n) * day, err
+	}
+	return time.ParseDuration(v)
+}
+
+// ExpiryMonitor keeps track of when the injected CA certificates expire. It
+// reports their expiry as a metric and, as they get within the thresholds,
+// with Events on the objects their bundles are read from and with warnings
+// on the pods they are injected into. It implements controller.Reconciler
+// for the Events and metricproducer.Producer for the metric.
+type ExpiryMonitor struct {
+	// thresholds are ordered from the longest to the shortest.
+	thresholds []time.Duration
+	recorder   record.EventRecorder
+
+	// enqueue enqueues the source with the key for reconciliation.
+	enqueue func(key types.NamespacedName)
+
+	lock    sync.Mutex
+	sources map[string]*expirySource
+}
+
+// expirySource is a bundle and the object it is read from.
+type expirySource struct {
+	ref   *corev1.ObjectReference
+	certs []certs.Certificate
+
+	// reported is the stage each certificate, by fingerprint, was last
+	// reported at.
+	reported map[string]int
+}
+
+func NewExpiryMonitor(thresholds []time.Duration, recorder record.EventRecorder) *ExpiryMonitor {
+	return &ExpiryMonitor{
+		thresholds: thresholds,
+		recorder:   recorder,
+		sources:    map[string]*expirySource{},
+	}
+}
+
+// caCertConfigMapReference refers to the ca-cert ConfigMap.
+func caCertConfigMapReference() *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       "ConfigMap",
+		Namespace:  system.Namespace(),
+		Name:       CaCertConfigMapName,
+	}
+}
+
+// policyReference refers to the CertInjectionPolicy.
+func policyReference(name string, uid types.UID) *corev1.ObjectReference {
+	return &corev1.ObjectReference{
+		APIVersion: v1alpha1.SchemeGroupVersion.String(),
+		Kind:       "CertInjectionPolicy",
+		Name:       name,
+		UID:        uid,
+	}
+}
+
+// expiryKey is the key of the bundle read from ref. The kind tells apart
+// objects of the same name, such as a Certificate and its Secret.
+func expiryKey(ref *corev1.ObjectReference) types.NamespacedName {
+	return types.NamespacedName{Namespace: ref.Namespace, Name: strings.ToLower(ref.Kind) + "/" + ref.Name}
+}
+
+// setSource monitors the certificates of caCertsData, which is read from
+// ref. Certificates that stay in the bundle are not reported again for the
+// stage they were already reported at.
+func (m *ExpiryMonitor) setSource(ref *corev1.ObjectReference, caCertsData string) {
+	if m == nil {
+		return
+	}
+	if caCertsData == "" {
+		m.removeSource(ref)
+		return
+	}
+
+	key := expiryKey(ref)
+	source := &expirySource{ref: ref, reported: map[string]int{}}
+	seen := map[string]bool{}
+	for _, c := range certs.Certificates(caCertsData) {
+		if !seen[c.SHA256] {
+			seen[c.SHA256] = true
+			source.certs = append(source.certs, c)
+		}
+	}
+
+	m.lock.Lock()
+	if previous, ok := m.sources[key.String()]; ok {
+		for fingerprint, stage := range previous.reported {
+			if seen[fingerprint] {
+				source.reported[fingerprint] = stage
+			}
+		}
+	}
+	m.sources[key.String()] = source
+	m.lock.Unlock()
+
+	if m.enqueue != nil {
+		m.enqueue(key)
+	}
+}
+
+// removeSource stops monitoring the bundle read from ref.
+func (m *ExpiryMonitor) removeSource(ref *corev1.ObjectReference) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sources, expiryKey(ref).String())
+}
+
+// stage returns how many thresholds the certificate that expires in
+// remaining is within, or one more than there are thresholds once it has
+// expired.
+func (m *ExpiryMonitor) stage(remaining time.Duration) int {
+	if remaining <= 0 {
+		return len(m.thresholds) + 1
+	}
+
+	stage := 0
+	for _, t := range m.thresholds {
+		if remaining <= t {
+			stage++
+		}
+	}
+	return stage
+}
+
+// untilNextStage returns how long it takes the certificate that expires in
+// remaining to get to the next stage, or false if it has expired.
+func (m *ExpiryMonitor) untilNextStage(remaining time.Duration) (time.Duration, bool) {
+	if remaining <= 0 {
+		return 0, false
+	}
+
+	for _, t := range m.thresholds {
+		if remaining > t {
+			return remaining - t, true
+		}
+	}
+	return remaining, true
+}
+
+// Reconcile emits Events for the certificates of the source with the key
+// that got to a new stage and requeues the source for the next one.
+func (m *ExpiryMonitor) Reconcile(ctx context.Context, key string) error {
+	if len(m.thresholds) == 0 {
+		return nil
+	}
+
+	type event struct {
+		reason, message string
+	}
+
+	m.lock.Lock()
+	source, ok := m.sources[key]
+	if !ok {
+		m.lock.Unlock()
+		return nil
+	}
+
+	now := time.Now()
+	var (
+		events []event
+		next   time.Duration
+	)
+	for _, c := range source.certs {
+		remaining := c.NotAfter.Sub(now)
+
+		if stage := m.stage(remaining); stage > source.reported[c.SHA256] {
+			source.reported[c.SHA256] = stage
+			if remaining <= 0 {
+				events = append(events, event{reasonCACertificateExpired, fmt.Sprintf("CA certificate %q (sha256 %s) expired on %s",
+					c.Subject, c.SHA256, c.NotAfter.UTC().Format(time.RFC3339))})
+			} else {
+				events = append(events, event{reasonCACertificateExpiring, fmt.Sprintf("CA certificate %q (sha256 %s) expires in %s, on %s",
+					c.Subject, c.SHA256, formatRemaining(remaining), c.NotAfter.UTC().Format(time.RFC3339))})
+			}
+		}
+
+		if d, ok := m.untilNextStage(remaining); ok && (next == 0 || d < next) {
+			next = d
+		}
+	}
+	ref := source.ref
+	m.lock.Unlock()
+
+	for _, e := range events {
+		m.recorder.Event(ref, corev1.EventTypeWarning, e.reason, e.message)
+	}
+
+	if next > 0 {
+		return controller.NewRequeueAfter(next)
+	}
+	return nil
+}
+
+// warnings returns the warnings about the certificates that are injected
+// into a pod and are within the longest threshold.
+func (m *ExpiryMonitor) warnings(caCerts []certs.Certificate) []string {
+	if m == nil || len(m.thresholds) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	var warnings []string
+	for _, c := range caCerts {
+		remaining := c.NotAfter.Sub(now)
+		switch {
+		case remaining <= 0:
+			warnings = append(warnings, fmt.Sprintf("injected CA %q expired on %s", c.Subject, c.NotAfter.UTC().Format(time.RFC3339)))
+		case remaining <= m.thresholds[0]:
+			warnings = append(warnings, fmt.Sprintf("injected CA %q expires in %s", c.Subject, formatRemaining(remaining)))
+		}
+	}
+	return warnings
+}
+
+// Read returns the expiry of the certificates of all sources.
+func (m *ExpiryMonitor) Read() []*metricdata.Metric {
+	now := time.Now()
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	keys := make([]string, 0, len(m.sources))
+	for key := range m.sources {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var series []*metricdata.TimeSeries
+	for _, key := range keys {
+		source := m.sources[key]
+		for _, c := range source.certs {
+			series = append(series, &metricdata.TimeSeries{
+				LabelValues: []metricdata.LabelValue{
+					metricdata.NewLabelValue(source.ref.Kind),
+					metricdata.NewLabelValue(source.ref.Name),
+					metricdata.NewLabelValue(c.Subject),
+					metricdata.NewLabelValue(c.SHA256),
+				},
+				Points:    []metricdata.Point{metricdata.NewInt64Point(now, c.NotAfter.Unix())},
+				StartTime: now,
+			})
+		}
+	}
+
+	return []*metricdata.Metric{{Descriptor: expiryDescriptor, TimeSeries: series}}
+}
+
+// formatRemaining formats the time until a certificate expires in days, or
+// in hours when it is less than a day.
+func formatRemaining(d time.Duration) string {
+	if d >= day {
+		return plural(int(d/day), "day")
+	}
+	return plural(int(math.Ceil(d.Hours())), "hour")
+}
+
+func plural(n int, unit string) string {
+	if n == 1 {
+		return fmt.Sprintf("%d %s", n, unit)
+	}
+	return fmt.Sprintf("%d %ss", n, unit)
+}
@@ -0,0 +1,173 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/metric/metricdata"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/system"
+	wtesting "knative.dev/pkg/webhook/testing"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestExpiryMonitor(t *testing.T) {
+	spec.Run(t, "Expiry Monitor", testExpiryMonitor)
+}
+
+func testExpiryMonitor(t *testing.T, when spec.G, it spec.S) {
+	const label = "some/label"
+
+	var (
+		ctx      = context.TODO()
+		key      = system.Namespace() + "/configmap/ca-cert"
+		recorder *record.FakeRecorder
+		monitor  *certinjectionwebhook.ExpiryMonitor
+	)
+
+	it.Before(func() {
+		thresholds, err := certinjectionwebhook.ParseExpiryThresholds([]string{"7d", "30d"})
+		require.NoError(t, err)
+
+		recorder = record.NewFakeRecorder(10)
+		monitor = certinjectionwebhook.NewExpiryMonitor(thresholds, recorder)
+	})
+
+	newAC := func(caCertsData string) caCertsAdmitter {
+		ac, err := certinjectionwebhook.NewAdmissionController("some-webhook", "/some-path", nil, certinjectionwebhook.AdmissionOptions{
+			Labels:            []string{label},
+			SetupCACertsImage: "some-ca-certs-image",
+			CACertsData:       caCertsData,
+			Expiry:            monitor,
+		})
+		require.NoError(t, err)
+		return ac
+	}
+
+	admit := func(ac caCertsAdmitter) *admissionv1.AdmissionResponse {
+		bytes, err := json.Marshal(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "some-pod",
+				Labels: map[string]string{label: ""},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			},
+		})
+		require.NoError(t, err)
+
+		response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+			Object:    runtime.RawExtension{Raw: bytes},
+			Operation: admissionv1.Create,
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		})
+		wtesting.ExpectAllowed(t, response)
+		return response
+	}
+
+	fingerprint := func(cert string) string {
+		block, _ := pem.Decode([]byte(cert))
+		sum := sha256.Sum256(block.Bytes)
+		return hex.EncodeToString(sum[:])
+	}
+
+	notAfter := func(cert string) time.Time {
+		block, _ := pem.Decode([]byte(cert))
+		c, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		return c.NotAfter
+	}
+
+	it("parses the thresholds", func() {
+		thresholds, err := certinjectionwebhook.ParseExpiryThresholds([]string{" 72h", "30d", "", "3d"})
+		require.NoError(t, err)
+		require.Equal(t, []time.Duration{30 * 24 * time.Hour, 72 * time.Hour}, thresholds)
+
+		_, err = certinjectionwebhook.ParseExpiryThresholds([]string{"soon"})
+		require.EqualError(t, err, `invalid expiry threshold "soon", must be a positive duration such as 30d or 72h`)
+
+		_, err = certinjectionwebhook.ParseExpiryThresholds([]string{"-1d"})
+		require.EqualError(t, err, `invalid expiry threshold "-1d", must be a positive duration such as 30d or 72h`)
+	})
+
+	it("warns about injected certificates that expire within the longest threshold", func() {
+		expiring := makeExpiringCert(t, "expiring", time.Now().Add(12*24*time.Hour+time.Hour))
+		ac := newAC(makeCert(t, "valid") + expiring)
+
+		response := admit(ac)
+		require.NotNil(t, response.Patch)
+		require.Equal(t, []string{`injected CA "CN=expiring" expires in 12 days`}, response.Warnings)
+	})
+
+	it("warns about injected certificates that have expired", func() {
+		expired := makeExpiringCert(t, "expired", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+
+		response := admit(newAC(expired))
+		require.Equal(t, []string{`injected CA "CN=expired" expired on 2020-01-01T00:00:00Z`}, response.Warnings)
+	})
+
+	it("emits an event once a certificate gets within a threshold", func() {
+		expiring := makeExpiringCert(t, "expiring", time.Now().Add(12*24*time.Hour+time.Hour))
+		newAC(makeCert(t, "valid") + expiring)
+
+		err := monitor.Reconcile(ctx, key)
+		requeue, after := controller.IsRequeueKey(err)
+		require.True(t, requeue)
+		require.InDelta(t, (5*24*time.Hour + time.Hour).Seconds(), after.Seconds(), 60)
+
+		require.Len(t, recorder.Events, 1)
+		require.Equal(t, fmt.Sprintf(`Warning CACertificateExpiring CA certificate "CN=expiring" (sha256 %s) expires in 12 days, on %s`,
+			fingerprint(expiring), notAfter(expiring).UTC().Format(time.RFC3339)), <-recorder.Events)
+
+		_ = monitor.Reconcile(ctx, key)
+		require.Empty(t, recorder.Events)
+	})
+
+	it("emits an event when a certificate has expired", func() {
+		expired := makeExpiringCert(t, "expired", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC))
+		newAC(expired)
+
+		require.NoError(t, monitor.Reconcile(ctx, key))
+		require.Len(t, recorder.Events, 1)
+		require.Equal(t, fmt.Sprintf(`Warning CACertificateExpired CA certificate "CN=expired" (sha256 %s) expired on 2020-01-01T00:00:00Z`,
+			fingerprint(expired)), <-recorder.Events)
+	})
+
+	it("exports the expiry of the certificates", func() {
+		cert := makeCert(t, "some-ca")
+		ac := newAC(cert)
+
+		metrics := monitor.Read()
+		require.Len(t, metrics, 1)
+		require.Equal(t, "ca_cert_expiration_timestamp_seconds", metrics[0].Descriptor.Name)
+		require.Len(t, metrics[0].TimeSeries, 1)
+		require.Equal(t, []metricdata.LabelValue{
+			metricdata.NewLabelValue("ConfigMap"),
+			metricdata.NewLabelValue("ca-cert"),
+			metricdata.NewLabelValue("CN=some-ca"),
+			metricdata.NewLabelValue(fingerprint(cert)),
+		}, metrics[0].TimeSeries[0].LabelValues)
+		require.Equal(t, notAfter(cert).Unix(), metrics[0].TimeSeries[0].Points[0].Value)
+
+		ac.UpdateCaCertsData("")
+		require.Empty(t, monitor.Read()[0].TimeSeries)
+	})
+}
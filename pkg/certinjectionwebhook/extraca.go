@@ -0,0 +1,233 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/logging"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+// DefaultExtraCAConfigMapName is the default name of the ConfigMap whose CA
+// certificates are injected besides the bundle into the pods of its
+// namespace.
+const DefaultExtraCAConfigMapName = "cert-injection-extra-ca"
+
+// ExtraCABundles are the CA certificates of the extra CA ConfigMaps by
+// namespace. They are appended to the bundle injected into the pods of the
+// namespace, be it the default bundle or that of a policy. Implements
+// controller.Reconciler
+type ExtraCABundles struct {
+	name   string
+	lister corelisters.ConfigMapLister
+
+	// mirror and stale are told about the namespaces whose extra CA
+	// certificates changed.
+	mirror *BundleMirror
+	stale  *StaleBundleDetector
+
+	lock sync.Mutex
+
+	// bundles are the validated PEM encoded certificates by namespace.
+	bundles map[string]string
+
+	// combined are the last bundles with the extra CA certificates by
+	// namespace, so that they are not combined again for every pod.
+	combined map[string]combinedBundle
+
+	// loaded is closed once the ConfigMaps have been loaded by Load. Until
+	// then admissions wait and no pod is reported as stale.
+	loaded   chan struct{}
+	loadOnce sync.Once
+}
+
+// combinedBundle is a bundle with the extra CA certificates of a namespace.
+type combinedBundle struct {
+	base, extra, bundle string
+}
+
+// NewExtraCABundles returns the extra CA certificates of the ConfigMaps
+// named name, which the mirror and the detector add to the bundles of the
+// namespaces. lister lists the ConfigMaps of that name.
+func NewExtraCABundles(name string, lister corelisters.ConfigMapLister, mirror *BundleMirror, stale *StaleBundleDetector) *ExtraCABundles {
+	e := &ExtraCABundles{
+		name:     name,
+		lister:   lister,
+		mirror:   mirror,
+		stale:    stale,
+		bundles:  map[string]string{},
+		combined: map[string]combinedBundle{},
+		loaded:   make(chan struct{}),
+	}
+	if mirror != nil {
+		mirror.extra = e
+	}
+	if stale != nil {
+		stale.extra = e
+	}
+	return e
+}
+
+// Load loads the ConfigMaps of the lister, which must have synced, and
+// marks the extra CA certificates as loaded. ConfigMaps that cannot be
+// loaded are left to the controller to retry.
+func (e *ExtraCABundles) Load(ctx context.Context) {
+	logger := logging.FromContext(ctx)
+
+	cms, err := e.lister.List(labels.Everything())
+	if err != nil {
+		logger.Errorf("Error listing configmaps %q: %v", e.name, err)
+	}
+	for _, cm := range cms {
+		if err := e.Reconcile(ctx, cm.Namespace+"/"+cm.Name); err != nil {
+			logger.Errorf("Error loading configmap %q in namespace %q: %v", cm.Name, cm.Namespace, err)
+		}
+	}
+
+	e.loadOnce.Do(func() { close(e.loaded) })
+	e.stale.resyncAll()
+}
+
+// hasLoaded returns whether the ConfigMaps have been loaded. A nil e has
+// nothing to load.
+func (e *ExtraCABundles) hasLoaded() bool {
+	if e == nil {
+		return true
+	}
+	select {
+	case <-e.loaded:
+		return true
+	default:
+		return false
+	}
+}
+
+// bundle returns caCertsData with the extra CA certificates of the
+// namespace. Certificates that are in both are injected once. Nothing is
+// added to an empty bundle, which injects env vars only.
+func (e *ExtraCABundles) bundle(namespace, caCertsData string) string {
+	if e == nil || caCertsData == "" {
+		return caCertsData
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	extra, ok := e.bundles[namespace]
+	if !ok {
+		return caCertsData
+	}
+	if c, ok := e.combined[namespace]; ok && c.base == caCertsData && c.extra == extra {
+		return c.bundle
+	}
+
+	ts := certs.NewTrustStore()
+	// Both bundles were validated when they were loaded.
+	_, _ = ts.Add("ca_certs", []byte(caCertsData))
+	_, _ = ts.Add("extra_ca", []byte(extra))
+	bundle := string(ts.Bundle())
+	e.combined[namespace] = combinedBundle{base: caCertsData, extra: extra, bundle: bundle}
+	return bundle
+}
+
+// data returns data with the extra CA certificates of the namespace.
+func (e *ExtraCABundles) data(namespace string, data *injectionData) *injectionData {
+	caCertsData := e.bundle(namespace, data.caCertsData)
+	if caCertsData == data.caCertsData {
+		return data
+	}
+
+	extended := *data
+	extended.caCertsData = caCertsData
+	extended.caCerts = certs.Certificates(caCertsData)
+	return &extended
+}
+
+// Reconcile loads the extra CA certificates of the ConfigMap with the key.
+// A ConfigMap that becomes invalid keeps its previous certificates and one
+// that is deleted is left out. The mirrored trust stores and the stale pods
+// of the namespace are updated when the certificates change. The key of the
+// name without a namespace loads all ConfigMaps.
+func (e *ExtraCABundles) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil || name != e.name {
+		return err
+	}
+	if namespace == "" {
+		e.Load(ctx)
+		return nil
+	}
+
+	var extra *string
+	cm, err := e.lister.ConfigMaps(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		logger.Infof("Configmap %q in namespace %q not found, leaving out its extra ca certs", name, namespace)
+	} else if err != nil {
+		return err
+	} else {
+		var data []byte
+		value, ok := cm.Data[caCertConfigMapKey]
+		if ok {
+			data = []byte(value)
+		} else {
+			data, ok = cm.BinaryData[caCertConfigMapKey]
+		}
+		if !ok {
+			logger.Errorf("Configmap %q in namespace %q is missing %q key, keeping its previous extra ca certs", name, namespace, caCertConfigMapKey)
+			return nil
+		}
+
+		decoded, err := decodeCACerts(data)
+		if err != nil {
+			logger.Errorf("Invalid extra ca certs in configmap %q in namespace %q, keeping its previous extra ca certs: %v", name, namespace, err)
+			return nil
+		}
+		warnings, err := certs.ValidateBundle(decoded, time.Now())
+		if err != nil {
+			logger.Errorf("Invalid extra ca certs in configmap %q in namespace %q, keeping its previous extra ca certs: %v", name, namespace, err)
+			return nil
+		}
+		for _, w := range warnings {
+			logger.Warnf("Configmap %q in namespace %q: %s", name, namespace, w)
+		}
+		if len(certs.Certificates(string(decoded))) > 0 {
+			s := string(decoded)
+			extra = &s
+		}
+	}
+
+	if !e.set(namespace, extra) {
+		return nil
+	}
+	logger.Infof("Updating extra ca certs of namespace %q from configmap %q", namespace, name)
+	e.mirror.resyncNamespace(namespace)
+	e.stale.resyncNamespace(namespace)
+	return nil
+}
+
+// set sets or, if extra is nil, removes the extra CA certificates of the
+// namespace and returns whether they changed.
+func (e *ExtraCABundles) set(namespace string, extra *string) bool {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	previous, ok := e.bundles[namespace]
+	if extra == nil {
+		delete(e.bundles, namespace)
+		delete(e.combined, namespace)
+		return ok
+	}
+	e.bundles[namespace] = *extra
+	return !ok || previous != *extra
+}
@@ -0,0 +1,87 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+const javaToolOptionsEnv = "JAVA_TOOL_OPTIONS"
+
+// javaTrustStoreProperties are the system properties set in
+// JAVA_TOOL_OPTIONS. Options a container already sets for them are replaced.
+var javaTrustStoreProperties = []string{
+	"javax.net.ssl.trustStore",
+	"javax.net.ssl.trustStoreType",
+	"javax.net.ssl.trustStorePassword",
+}
+
+// JavaOptions configure the Java truststore written by setup-ca-certs.
+type JavaOptions struct {
+	// ToolOptions points the JVMs of the containers that get the ca certs to
+	// the truststore with JAVA_TOOL_OPTIONS.
+	ToolOptions bool
+
+	TrustStoreType certs.JavaTrustStoreType
+}
+
+// javaToolOptions returns the JVM options for the truststore of type t
+// written by the strategy. ok is false when the truststore is not mounted.
+func javaToolOptions(strategy certs.Strategy, t certs.JavaTrustStoreType) (options []string, ok bool) {
+	path, ok := strategy.MountedPath(strategy.JavaTrustStorePath(t))
+	if !ok {
+		return nil, false
+	}
+
+	values := []string{path, string(t), certs.JavaTrustStorePassword}
+	for i, property := range javaTrustStoreProperties {
+		options = append(options, fmt.Sprintf("-D%s=%s", property, values[i]))
+	}
+	return options, true
+}
+
+// setJavaToolOptions adds options to the JAVA_TOOL_OPTIONS in env. Options
+// the container already sets are kept unless they set one of the truststore
+// properties. A JAVA_TOOL_OPTIONS read from a source is left as is.
+func setJavaToolOptions(env []corev1.EnvVar, options []string) []corev1.EnvVar {
+	for i := range env {
+		if env[i].Name != javaToolOptionsEnv {
+			continue
+		}
+		if env[i].ValueFrom != nil {
+			return env
+		}
+
+		var merged []string
+		for _, o := range strings.Fields(env[i].Value) {
+			if !isJavaTrustStoreOption(o) {
+				merged = append(merged, o)
+			}
+		}
+		env[i].Value = strings.Join(append(merged, options...), " ")
+		return env
+	}
+
+	return append(env, corev1.EnvVar{Name: javaToolOptionsEnv, Value: strings.Join(options, " ")})
+}
+
+func isJavaTrustStoreOption(option string) bool {
+	for _, property := range javaTrustStoreProperties {
+		if strings.HasPrefix(option, "-D"+property+"=") {
+			return true
+		}
+	}
+	return false
+}
+
+// injectedJavaTrustStoreType returns the type of the Java truststore the
+// setup-ca-certs init container of the pod was configured with.
+func injectedJavaTrustStoreType(pod *corev1.Pod) (certs.JavaTrustStoreType, error) {
+	return certs.ParseJavaTrustStoreType(setupCACertsEnv(pod, certs.JavaTrustStoreTypeEnv))
+}
@@ -0,0 +1,103 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+const (
+	mergeCACertsContainerName = "merge-ca-certs"
+
+	caCertsHelperVolumeName = "ca-certs-helper"
+	caCertsHelperDir        = "/ca-certs-helper"
+	caCertsHelperPath       = caCertsHelperDir + "/setup-ca-certs"
+
+	systemCACertsEnv = "SYSTEM_CA_CERTS"
+)
+
+// isCACertsInitContainer returns whether name is one of the init containers
+// that populate the ca-certs volume.
+func isCACertsInitContainer(name string) bool {
+	return name == setupCACertsContainerName || name == mergeCACertsContainerName
+}
+
+// mergeApp returns the first container that gets the ca certs. The injected
+// certificates are merged into the trust store of its image.
+func mergeApp(obj *corev1.Pod, containers containerFilter) (corev1.Container, bool) {
+	for _, c := range obj.Spec.Containers {
+		if containers.selects(c.Name, c.Image) {
+			return c, true
+		}
+	}
+	return corev1.Container{}, false
+}
+
+// mergeInitContainers turns setup, the setup-ca-certs container that writes
+// the trust store, into the container that installs the helper and a
+// container based on the image of app that runs the helper. It reads the
+// bundle of the image where strategy mounts the trust store and writes it
+// with the injected certificates to the ca-certs volume.
+func mergeInitContainers(setup, app corev1.Container, strategy certs.Strategy) []corev1.Container {
+	helperMount := corev1.VolumeMount{Name: caCertsHelperVolumeName, MountPath: caCertsHelperDir}
+
+	install := setup
+	install.Env = []corev1.EnvVar{{Name: certs.HelperPathEnv, Value: caCertsHelperPath}}
+	install.WorkingDir = ""
+	install.VolumeMounts = []corev1.VolumeMount{helperMount}
+
+	env := append([]corev1.EnvVar(nil), setup.Env...)
+	if bundle, ok := strategy.MountedPath(strategy.Bundles[0]); ok {
+		env = append(env, corev1.EnvVar{Name: systemCACertsEnv, Value: bundle})
+	}
+
+	helperMount.ReadOnly = true
+	merge := corev1.Container{
+		Name:            mergeCACertsContainerName,
+		Image:           app.Image,
+		Command:         []string{caCertsHelperPath},
+		Env:             env,
+		ImagePullPolicy: app.ImagePullPolicy,
+		WorkingDir:      setup.WorkingDir,
+		VolumeMounts:    append(append([]corev1.VolumeMount(nil), setup.VolumeMounts...), helperMount),
+		SecurityContext: mergeSecurityContext(setup.SecurityContext, app.SecurityContext),
+	}
+
+	return []corev1.Container{install, merge}
+}
+
+// mergeSecurityContext returns the hardened context of the setup container
+// that runs as the user of the application, which may well be root.
+func mergeSecurityContext(setup, app *corev1.SecurityContext) *corev1.SecurityContext {
+	sc := setup.DeepCopy()
+	sc.RunAsNonRoot = nil
+	if app != nil {
+		sc.RunAsUser = app.RunAsUser
+		sc.RunAsGroup = app.RunAsGroup
+		sc.RunAsNonRoot = app.RunAsNonRoot
+	}
+	return sc
+}
+
+// setCACertsInitContainers replaces the init containers that populate the
+// ca-certs volume with add, where the first of them was, or puts add first.
+func setCACertsInitContainers(initContainers, add []corev1.Container) []corev1.Container {
+	var rest []corev1.Container
+	at := 0
+	found := false
+	for _, c := range initContainers {
+		if isCACertsInitContainer(c.Name) {
+			if !found {
+				at, found = len(rest), true
+			}
+			continue
+		}
+		rest = append(rest, c)
+	}
+
+	res := append(append([]corev1.Container(nil), rest[:at]...), add...)
+	return append(res, rest[at:]...)
+}
@@ -0,0 +1,175 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+	admissionv1 "k8s.io/api/admission/v1"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/metrics"
+)
+
+// The outcomes of admissions.
+const (
+	outcomeInjected         = "injected"
+	outcomeUnchanged        = "unchanged"
+	outcomeSkippedNoMatch   = "skipped-no-match"
+	outcomeSkippedWindows   = "skipped-windows"
+	outcomeSkippedNamespace = "skipped-namespace"
+	outcomeSkippedUnhandled = "skipped-unhandled"
+	outcomeDecodeError      = "decode-error"
+	outcomeMutationFailed   = "mutation-failed"
+	outcomeNotLoaded        = "not-loaded"
+)
+
+// defaultSelector is the selector of the pods that are matched by the
+// labels, annotations and namespace label of the webhook rather than by a
+// policy.
+const defaultSelector = "default"
+
+// policySelector is the selector of the pods that are matched by the policy.
+func policySelector(name string) string {
+	return "policy/" + name
+}
+
+var (
+	admissionsM = stats.Int64(
+		"pod_admissions",
+		"The number of pod admissions by outcome",
+		stats.UnitDimensionless)
+	admissionLatencyM = stats.Float64(
+		"pod_admission_latencies",
+		"The time it took to admit pods in milliseconds",
+		stats.UnitMilliseconds)
+	patchSizeM = stats.Int64(
+		"pod_patch_size_bytes",
+		"The size of the patches of the injected pods",
+		stats.UnitBytes)
+
+	operationKey = tag.MustNewKey("operation")
+	outcomeKey   = tag.MustNewKey("outcome")
+	namespaceKey = tag.MustNewKey("namespace")
+	selectorKey  = tag.MustNewKey("selector")
+)
+
+// bundleDescriptor describes the metric of the bundles that are injected.
+var bundleDescriptor = metricdata.Descriptor{
+	Name:        "ca_bundle_certificates",
+	Description: "The number of certificates of the injected CA bundle",
+	Unit:        metricdata.UnitDimensionless,
+	Type:        metricdata.TypeGaugeInt64,
+	LabelKeys: []metricdata.LabelKey{
+		{Key: "source_kind", Description: "The kind of the object the bundle is read from"},
+		{Key: "source_name", Description: "The name of the object the bundle is read from"},
+		{Key: "sha256", Description: "The SHA-256 fingerprint of the bundle"},
+	},
+}
+
+// views aggregate the admission measures.
+var views = []*view.View{
+	{
+		Description: admissionsM.Description(),
+		Measure:     admissionsM,
+		Aggregation: view.Count(),
+		TagKeys:     []tag.Key{operationKey, outcomeKey, namespaceKey, selectorKey},
+	},
+	{
+		Description: admissionLatencyM.Description(),
+		Measure:     admissionLatencyM,
+		Aggregation: view.Distribution(metrics.Buckets125(1, 10000)...),
+		TagKeys:     []tag.Key{operationKey, outcomeKey},
+	},
+	{
+		Description: patchSizeM.Description(),
+		Measure:     patchSizeM,
+		Aggregation: view.Distribution(metrics.Buckets125(100, 1000000)...),
+		TagKeys:     []tag.Key{operationKey},
+	},
+}
+
+// RegisterMetrics registers the views of the admission metrics. The
+// metrics pipeline of sharedmain exports them.
+func RegisterMetrics() error {
+	return view.Register(views...)
+}
+
+// admission is what is known about an admission once it is decided.
+type admission struct {
+	outcome string
+
+	// selector is the policy or the default selector that matched the pod.
+	selector string
+}
+
+// reportAdmission records the admission of request with response, which
+// took d.
+func reportAdmission(ctx context.Context, request *admissionv1.AdmissionRequest, response *admissionv1.AdmissionResponse, a admission, d time.Duration) {
+	operation := string(request.Operation)
+	if request.SubResource != "" {
+		operation += "/" + request.SubResource
+	}
+
+	ctx, err := tag.New(ctx,
+		tag.Insert(operationKey, operation),
+		tag.Insert(outcomeKey, a.outcome),
+		tag.Insert(namespaceKey, request.Namespace),
+		tag.Insert(selectorKey, a.selector),
+	)
+	if err != nil {
+		logging.FromContext(ctx).Warnf("Error tagging admission metrics: %v", err)
+		return
+	}
+
+	measurements := []stats.Measurement{
+		admissionsM.M(1),
+		admissionLatencyM.M(float64(d.Microseconds()) / 1000),
+	}
+	if a.outcome == outcomeInjected {
+		measurements = append(measurements, patchSizeM.M(int64(len(response.Patch))))
+	}
+	metrics.RecordBatch(ctx, measurements...)
+}
+
+// Read implements metricproducer.Producer with the number of certificates
+// and the fingerprint of the bundles that are injected.
+func (ac *admissionController) Read() []*metricdata.Metric {
+	now := time.Now()
+
+	type bundle struct {
+		kind, name, caCertsData string
+		caCerts                 int
+	}
+
+	data := ac.data.Load()
+	bundles := []bundle{{"ConfigMap", CaCertConfigMapName, data.caCertsData, len(data.caCerts)}}
+	if ac.policies != nil {
+		for _, p := range *ac.policies.policies.Load() {
+			bundles = append(bundles, bundle{"CertInjectionPolicy", p.name, p.data.caCertsData, len(p.data.caCerts)})
+		}
+	}
+
+	var series []*metricdata.TimeSeries
+	for _, b := range bundles {
+		if b.caCertsData == "" {
+			continue
+		}
+		series = append(series, &metricdata.TimeSeries{
+			LabelValues: []metricdata.LabelValue{
+				metricdata.NewLabelValue(b.kind),
+				metricdata.NewLabelValue(b.name),
+				metricdata.NewLabelValue(bundleSHA256(b.caCertsData)),
+			},
+			Points:    []metricdata.Point{metricdata.NewInt64Point(now, int64(b.caCerts))},
+			StartTime: now,
+		})
+	}
+
+	return []*metricdata.Metric{{Descriptor: bundleDescriptor, TimeSeries: series}}
+}
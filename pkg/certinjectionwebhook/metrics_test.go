@@ -0,0 +1,152 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats/view"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"knative.dev/pkg/metrics"
+	wtesting "knative.dev/pkg/webhook/testing"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestMetrics(t *testing.T) {
+	spec.Run(t, "Metrics", testMetrics)
+}
+
+func testMetrics(t *testing.T, when spec.G, it spec.S) {
+	const label = "some/label"
+
+	var (
+		ctx         = context.TODO()
+		caCertsData string
+	)
+
+	newAC := func() interface {
+		caCertsAdmitter
+		Read() []*metricdata.Metric
+	} {
+		ac, err := certinjectionwebhook.NewAdmissionController("some-webhook", "/some-path", nil, certinjectionwebhook.AdmissionOptions{
+			Labels:            []string{label},
+			SetupCACertsImage: "some-ca-certs-image",
+			CACertsData:       caCertsData,
+		})
+		require.NoError(t, err)
+		return ac
+	}
+
+	admit := func(namespace string, raw []byte) {
+		response := newAC().Admit(ctx, &admissionv1.AdmissionRequest{
+			Namespace: namespace,
+			Object:    runtime.RawExtension{Raw: raw},
+			Operation: admissionv1.Create,
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		})
+		wtesting.ExpectAllowed(t, response)
+	}
+
+	podBytes := func(labels map[string]string, nodeSelector map[string]string) []byte {
+		bytes, err := json.Marshal(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Labels: labels},
+			Spec: corev1.PodSpec{
+				NodeSelector: nodeSelector,
+				Containers:   []corev1.Container{{Name: "app", Image: "app"}},
+			},
+		})
+		require.NoError(t, err)
+		return bytes
+	}
+
+	// row returns the row of the view with the tags.
+	row := func(name string, tags map[string]string) *view.Row {
+		rows, err := view.RetrieveData(name)
+		require.NoError(t, err)
+
+	rows:
+		for _, r := range rows {
+			for _, tag := range r.Tags {
+				if want, ok := tags[tag.Key.Name()]; ok && want != tag.Value {
+					continue rows
+				}
+			}
+			return r
+		}
+		return nil
+	}
+
+	it.Before(func() {
+		metrics.InitForTesting()
+		require.NoError(t, certinjectionwebhook.RegisterMetrics())
+
+		caCertsData = makeCert(t, "some-ca") + makeCert(t, "other-ca")
+	})
+
+	it("counts the admissions by outcome, namespace and selector", func() {
+		admit("injected-namespace", podBytes(map[string]string{label: ""}, nil))
+		admit("injected-namespace", podBytes(map[string]string{label: ""}, nil))
+		admit("no-match-namespace", podBytes(nil, nil))
+		admit("windows-namespace", podBytes(map[string]string{label: ""}, map[string]string{"kubernetes.io/os": "windows"}))
+		admit("decode-error-namespace", []byte("not a pod"))
+
+		for namespace, want := range map[string]struct {
+			outcome, selector string
+			count             int64
+		}{
+			"injected-namespace":     {"injected", "default", 2},
+			"no-match-namespace":     {"skipped-no-match", "", 1},
+			"windows-namespace":      {"skipped-windows", "", 1},
+			"decode-error-namespace": {"decode-error", "", 1},
+		} {
+			r := row("pod_admissions", map[string]string{
+				"operation": "CREATE",
+				"outcome":   want.outcome,
+				"namespace": namespace,
+				"selector":  want.selector,
+			})
+			require.NotNil(t, r, namespace)
+			require.Equal(t, want.count, r.Data.(*view.CountData).Value, namespace)
+		}
+	})
+
+	it("records the latency of the admissions and the size of the patches", func() {
+		admit("some-namespace", podBytes(map[string]string{label: ""}, nil))
+
+		latency := row("pod_admission_latencies", map[string]string{"operation": "CREATE", "outcome": "injected"})
+		require.NotNil(t, latency)
+		require.NotZero(t, latency.Data.(*view.DistributionData).Count)
+
+		size := row("pod_patch_size_bytes", map[string]string{"operation": "CREATE"})
+		require.NotNil(t, size)
+		require.NotZero(t, size.Data.(*view.DistributionData).Min)
+	})
+
+	it("reports the number of certificates and the fingerprint of the bundle", func() {
+		ac := newAC()
+
+		m := ac.Read()
+		require.Len(t, m, 1)
+		require.Equal(t, "ca_bundle_certificates", m[0].Descriptor.Name)
+		require.Len(t, m[0].TimeSeries, 1)
+		require.Equal(t, []metricdata.LabelValue{
+			metricdata.NewLabelValue("ConfigMap"),
+			metricdata.NewLabelValue("ca-cert"),
+			metricdata.NewLabelValue(bundleSHA(caCertsData)),
+		}, m[0].TimeSeries[0].LabelValues)
+		require.Equal(t, int64(2), m[0].TimeSeries[0].Points[0].Value)
+
+		ac.UpdateCaCertsData("")
+		require.Empty(t, ac.Read()[0].TimeSeries)
+	})
+}
@@ -0,0 +1,379 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/logging"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+// InjectionMode decides how the CA certificates get into the pods.
+type InjectionMode string
+
+const (
+	// InjectionModeInitContainer writes the trust store to an emptyDir
+	// volume with the setup-ca-certs init container.
+	InjectionModeInitContainer InjectionMode = "init-container"
+
+	// InjectionModeConfigMap mounts a copy of the trust store the webhook
+	// mirrors into the namespace of the pod.
+	InjectionModeConfigMap InjectionMode = "configmap"
+
+	// InjectionModeMerge installs the setup-ca-certs helper with the init
+	// container and runs it in a second init container based on the image
+	// of the application, which adds the injected certificates to the trust
+	// store of that image rather than to the one of the setup image.
+	InjectionModeMerge InjectionMode = "merge"
+)
+
+// ParseInjectionMode defaults to InjectionModeInitContainer when mode is
+// empty.
+func ParseInjectionMode(mode string) (InjectionMode, error) {
+	switch m := InjectionMode(mode); m {
+	case "":
+		return InjectionModeInitContainer, nil
+	case InjectionModeInitContainer, InjectionModeConfigMap, InjectionModeMerge:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid injection mode %q, must be one of %q, %q or %q",
+			mode, InjectionModeInitContainer, InjectionModeConfigMap, InjectionModeMerge)
+	}
+}
+
+const (
+	// MirrorLabel marks the ConfigMaps the webhook mirrors trust stores to.
+	MirrorLabel = "cert-injection.tanzu.vmware.com/mirror"
+
+	bundleHashAnnotation = "cert-injection.tanzu.vmware.com/bundle-sha256"
+
+	// defaultMirrorName is the name of the copies of the bundle of the
+	// ca-cert ConfigMap. Policies with their own cert source are mirrored
+	// to copies named after the policy.
+	defaultMirrorName = "cert-injection-ca-certs"
+
+	// maxMirrorSize leaves room for the metadata within the 1MiB limit of
+	// the API server.
+	maxMirrorSize = 1000 * 1000
+)
+
+// mirrorName returns the name of the copies of the bundle of the policy.
+func mirrorName(policy string) string {
+	name := defaultMirrorName + "-" + policy
+	if len(name) > 253 {
+		sum := sha256.Sum256([]byte(policy))
+		name = defaultMirrorName + "-" + hex.EncodeToString(sum[:])
+	}
+	return name
+}
+
+// BundleMirror builds the trust store of each CA bundle once and mirrors it
+// into a ConfigMap in every namespace with injected pods. Copies are
+// created when a pod is admitted and kept up to date by the mirror
+// controller. Implements controller.Reconciler
+type BundleMirror struct {
+	systemCACerts []byte
+
+	client kubernetes.Interface
+	lister corelisters.ConfigMapLister
+
+	// enqueue is set by NewMirrorController.
+	enqueue func(namespace, name string)
+
+	// extra adds the extra CA certificates of the namespace of a copy to
+	// its bundle. It is set by NewExtraCABundles.
+	extra *ExtraCABundles
+
+	lock sync.Mutex
+	// sources are the bundles by the name of their copies.
+	sources map[string]string
+	// bundles are the built trust stores by the hash of their bundle.
+	bundles map[string]*mirroredBundle
+	// copies are the hashes of the bundles of the copies by namespace and
+	// name. The trust stores they refer to are kept, such as those with
+	// the extra CA certificates of a namespace.
+	copies map[types.NamespacedName]string
+}
+
+// mirroredBundle is the trust store of a bundle as ConfigMap keys.
+type mirroredBundle struct {
+	configMap *certs.ConfigMap
+
+	// hash identifies the certificates of the trust store.
+	hash string
+}
+
+// caCertsConfigMap is the copy of a bundle a pod mounts.
+type caCertsConfigMap struct {
+	name   string
+	bundle *mirroredBundle
+}
+
+// NewBundleMirror returns a mirror of trust stores with the system CA
+// certificates and the injected bundles. lister lists the ConfigMaps with
+// the MirrorLabel.
+func NewBundleMirror(systemCACerts []byte, client kubernetes.Interface, lister corelisters.ConfigMapLister) *BundleMirror {
+	return &BundleMirror{
+		systemCACerts: systemCACerts,
+		client:        client,
+		lister:        lister,
+		sources:       map[string]string{},
+		bundles:       map[string]*mirroredBundle{},
+		copies:        map[types.NamespacedName]string{},
+	}
+}
+
+// setSource mirrors caCertsData to the ConfigMaps named name and updates
+// the copies that exist. Nothing is injected for an empty bundle, so it is
+// not mirrored either.
+func (m *BundleMirror) setSource(name, caCertsData string) {
+	if m == nil {
+		return
+	}
+	if caCertsData == "" {
+		m.removeSource(name)
+		return
+	}
+
+	m.lock.Lock()
+	previous, ok := m.sources[name]
+	m.sources[name] = caCertsData
+	m.lock.Unlock()
+
+	if !ok || previous != caCertsData {
+		m.resync(name)
+	}
+}
+
+// removeSource stops mirroring to the ConfigMaps named name. The copies are
+// left as they are for the pods that mount them.
+func (m *BundleMirror) removeSource(name string) {
+	if m == nil {
+		return
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.sources, name)
+}
+
+func (m *BundleMirror) source(name string) (string, bool) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	caCertsData, ok := m.sources[name]
+	return caCertsData, ok
+}
+
+// resync enqueues the copies named name.
+func (m *BundleMirror) resync(name string) {
+	if m.enqueue == nil {
+		return
+	}
+
+	copies, err := m.lister.List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, cm := range copies {
+		if cm.Name == name {
+			m.enqueue(cm.Namespace, cm.Name)
+		}
+	}
+}
+
+// resyncNamespace enqueues the copies in the namespace.
+func (m *BundleMirror) resyncNamespace(namespace string) {
+	if m == nil || m.enqueue == nil {
+		return
+	}
+
+	copies, err := m.lister.ConfigMaps(namespace).List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, cm := range copies {
+		if _, ok := m.source(cm.Name); ok {
+			m.enqueue(cm.Namespace, cm.Name)
+		}
+	}
+}
+
+// bundle returns the trust store of the system CA certificates and
+// caCertsData for the copy named name in the namespace. It is built once per
+// bundle and kept while a copy refers to it.
+func (m *BundleMirror) bundle(namespace, name, caCertsData string) (*mirroredBundle, error) {
+	sum := sha256.Sum256([]byte(caCertsData))
+	key := hex.EncodeToString(sum[:])
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.copies[types.NamespacedName{Namespace: namespace, Name: name}] = key
+	if b, ok := m.bundles[key]; ok {
+		return b, nil
+	}
+
+	store := certs.NewTrustStore()
+	// The system certificates that cannot be parsed were logged once by
+	// NewMirrorController.
+	_, _ = store.AddSystem("system_ca", m.systemCACerts)
+	if _, err := store.Add("cert_injection_webhook", []byte(caCertsData)); err != nil {
+		return nil, err
+	}
+
+	cm, err := store.ConfigMap()
+	if err != nil {
+		return nil, err
+	}
+	if size := cm.Size(); size > maxMirrorSize {
+		return nil, fmt.Errorf("trust store of %d certificates is %d bytes, more than fits into a configmap", store.Len(), size)
+	}
+
+	hash := sha256.Sum256(store.Bundle())
+	b := &mirroredBundle{configMap: cm, hash: hex.EncodeToString(hash[:])}
+
+	// Only keep the trust stores of the current bundles and of the copies.
+	current := map[string]bool{key: true}
+	for _, data := range m.sources {
+		s := sha256.Sum256([]byte(data))
+		current[hex.EncodeToString(s[:])] = true
+	}
+	for _, k := range m.copies {
+		current[k] = true
+	}
+	for k := range m.bundles {
+		if !current[k] {
+			delete(m.bundles, k)
+		}
+	}
+	m.bundles[key] = b
+
+	return b, nil
+}
+
+// forget lets the trust store of the copy named name in the namespace go
+// once no other copy refers to it.
+func (m *BundleMirror) forget(namespace, name string) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.copies, types.NamespacedName{Namespace: namespace, Name: name})
+}
+
+// ensure creates the copy of b named name in the namespace or updates it
+// when it holds another bundle.
+func (m *BundleMirror) ensure(ctx context.Context, namespace, name string, b *mirroredBundle) error {
+	configMaps := m.client.CoreV1().ConfigMaps(namespace)
+
+	existing, err := m.lister.ConfigMaps(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, b.configMapIn(namespace, name), metav1.CreateOptions{})
+		if !apierrors.IsAlreadyExists(err) {
+			return err
+		}
+
+		// The copy was created since the lister last saw it, or the
+		// ConfigMap is not ours.
+		existing, err = configMaps.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+		if _, ok := existing.Labels[MirrorLabel]; !ok {
+			return fmt.Errorf("configmap %q in namespace %q is not managed by the webhook", name, namespace)
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if existing.Annotations[bundleHashAnnotation] == b.hash {
+		return nil
+	}
+
+	logging.FromContext(ctx).Infof("Updating configmap %q in namespace %q", name, namespace)
+	updated := existing.DeepCopy()
+	desired := b.configMapIn(namespace, name)
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[bundleHashAnnotation] = b.hash
+	updated.Data = desired.Data
+	updated.BinaryData = desired.BinaryData
+	_, err = configMaps.Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+func (b *mirroredBundle) configMapIn(namespace, name string) *corev1.ConfigMap {
+	return &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      map[string]string{MirrorLabel: "true"},
+			Annotations: map[string]string{bundleHashAnnotation: b.hash},
+		},
+		Data:       b.configMap.Data,
+		BinaryData: b.configMap.BinaryData,
+	}
+}
+
+// Reconcile updates the copy with the key to the current bundle with the
+// extra CA certificates of its namespace. Copies of bundles that are no
+// longer mirrored are left as they are.
+func (m *BundleMirror) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	caCertsData, ok := m.source(name)
+	if !ok {
+		logger.Infof("No bundle is mirrored to configmap %q in namespace %q, leaving it as is", name, namespace)
+		m.forget(namespace, name)
+		return nil
+	}
+
+	if _, err := m.lister.ConfigMaps(namespace).Get(name); apierrors.IsNotFound(err) {
+		// The copy is created again when the next pod is admitted.
+		m.forget(namespace, name)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	b, err := m.bundle(namespace, name, m.extra.bundle(namespace, caCertsData))
+	if err != nil {
+		return err
+	}
+	return m.ensure(ctx, namespace, name, b)
+}
+
+func configMapVolumeItems(items []certs.Item) []corev1.KeyToPath {
+	res := make([]corev1.KeyToPath, 0, len(items))
+	for _, item := range items {
+		res = append(res, corev1.KeyToPath{Key: item.Key, Path: item.Path})
+	}
+	return res
+}
+
+func certsItems(items []corev1.KeyToPath) []certs.Item {
+	res := make([]certs.Item, 0, len(items))
+	for _, item := range items {
+		res = append(res, certs.Item{Key: item.Key, Path: item.Path})
+	}
+	return res
+}
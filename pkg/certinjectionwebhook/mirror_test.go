@@ -0,0 +1,255 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"testing"
+
+	jp "github.com/evanphx/json-patch/v5"
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	wtesting "knative.dev/pkg/webhook/testing"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestBundleMirror(t *testing.T) {
+	spec.Run(t, "Bundle Mirror", testBundleMirror)
+}
+
+func testBundleMirror(t *testing.T, when spec.G, it spec.S) {
+	const (
+		name      = "some-webhook"
+		path      = "/some-path"
+		namespace = "some-namespace"
+		copyName  = "cert-injection-ca-certs"
+	)
+
+	var (
+		ctx         = context.TODO()
+		systemCert  string
+		injected    string
+		indexer     cache.Indexer
+		client      *k8sfake.Clientset
+		mirror      *certinjectionwebhook.BundleMirror
+		newAC       func() caCertsAdmitter
+		getCopy     func() *corev1.ConfigMap
+		syncIndexer func()
+	)
+
+	it.Before(func() {
+		systemCert = makeCert(t, "system")
+		injected = makeCert(t, "injected")
+
+		indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		client = k8sfake.NewSimpleClientset()
+		mirror = certinjectionwebhook.NewBundleMirror([]byte(systemCert), client, corelisters.NewConfigMapLister(indexer))
+
+		newAC = func() caCertsAdmitter {
+			ac, err := certinjectionwebhook.NewAdmissionController(name, path, nil, certinjectionwebhook.AdmissionOptions{
+				Labels:            []string{"some/label"},
+				SetupCACertsImage: "some-ca-certs-image",
+				CACertsData:       injected,
+				Mirror:            mirror,
+			})
+			require.NoError(t, err)
+			return ac
+		}
+
+		getCopy = func() *corev1.ConfigMap {
+			cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, copyName, metav1.GetOptions{})
+			require.NoError(t, err)
+			return cm
+		}
+
+		syncIndexer = func() {
+			list, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+			require.NoError(t, err)
+			for i := range list.Items {
+				require.NoError(t, indexer.Add(&list.Items[i]))
+			}
+		}
+	})
+
+	admit := func(ac caCertsAdmitter, annotations map[string]string, dryRun bool) *corev1.Pod {
+		bytes, err := json.Marshal(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "some-pod",
+				Namespace:   namespace,
+				Labels:      map[string]string{"some/label": ""},
+				Annotations: annotations,
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			},
+		})
+		require.NoError(t, err)
+
+		response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+			Namespace: namespace,
+			Object:    runtime.RawExtension{Raw: bytes},
+			Operation: admissionv1.Create,
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			DryRun:    &dryRun,
+		})
+		wtesting.ExpectAllowed(t, response)
+
+		patch, err := jp.DecodePatch(response.Patch)
+		require.NoError(t, err)
+		patched, err := patch.Apply(bytes)
+		require.NoError(t, err)
+		pod := &corev1.Pod{}
+		require.NoError(t, json.Unmarshal(patched, pod))
+		return pod
+	}
+
+	it("mounts a copy of the trust store mirrored into the namespace instead of running setup-ca-certs", func() {
+		pod := admit(newAC(), nil, false)
+
+		require.Empty(t, pod.Spec.InitContainers)
+		require.Len(t, pod.Spec.Volumes, 1)
+		volume := pod.Spec.Volumes[0]
+		require.Equal(t, "ca-certs", volume.Name)
+		require.NotNil(t, volume.ConfigMap)
+		require.Equal(t, copyName, volume.ConfigMap.Name)
+		require.Contains(t, volume.ConfigMap.Items, corev1.KeyToPath{Key: "ca-certificates.crt", Path: "ca-certificates.crt"})
+		require.Contains(t, volume.ConfigMap.Items, corev1.KeyToPath{Key: "cacerts", Path: "java/cacerts"})
+		require.Len(t, volume.ConfigMap.Items, 4)
+		require.Equal(t, []corev1.VolumeMount{{Name: "ca-certs", MountPath: "/etc/ssl/certs", ReadOnly: true}}, pod.Spec.Containers[0].VolumeMounts)
+
+		cm := getCopy()
+		require.Equal(t, "true", cm.Labels[certinjectionwebhook.MirrorLabel])
+		require.Equal(t, systemCert+injected, cm.Data["ca-certificates.crt"])
+		require.Len(t, cm.Data, 3)
+		require.NotEmpty(t, cm.BinaryData["cacerts"])
+	})
+
+	it("leaves out system certificates that cannot be parsed", func() {
+		invalid := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")})
+		mirror = certinjectionwebhook.NewBundleMirror([]byte(systemCert+string(invalid)), client, corelisters.NewConfigMapLister(indexer))
+
+		pod := admit(newAC(), nil, false)
+
+		require.Empty(t, pod.Spec.InitContainers)
+		require.Equal(t, systemCert+injected, getCopy().Data["ca-certificates.crt"])
+	})
+
+	it("lays the trust store out for the strategy of the pod", func() {
+		pod := admit(newAC(), map[string]string{"cert-injection.tanzu.vmware.com/trust-store": "rhel"}, false)
+
+		require.Contains(t, pod.Spec.Volumes[0].ConfigMap.Items, corev1.KeyToPath{Key: "ca-certificates.crt", Path: "tls/certs/ca-bundle.crt"})
+		require.Contains(t, pod.Spec.Volumes[0].ConfigMap.Items, corev1.KeyToPath{Key: "cacerts", Path: "ca-trust/extracted/java/cacerts"})
+		require.Equal(t, []corev1.VolumeMount{
+			{Name: "ca-certs", MountPath: "/etc/pki/tls/certs", SubPath: "tls/certs", ReadOnly: true},
+			{Name: "ca-certs", MountPath: "/etc/pki/ca-trust/extracted", SubPath: "ca-trust/extracted", ReadOnly: true},
+		}, pod.Spec.Containers[0].VolumeMounts)
+	})
+
+	it("does not create the copy for dry runs", func() {
+		pod := admit(newAC(), nil, true)
+
+		require.NotNil(t, pod.Spec.Volumes[0].ConfigMap)
+		list, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Empty(t, list.Items)
+	})
+
+	it("falls back to setup-ca-certs when a configmap of the same name is not a copy", func() {
+		_, err := client.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Name: copyName, Namespace: namespace},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		pod := admit(newAC(), nil, false)
+
+		require.NotNil(t, pod.Spec.Volumes[0].EmptyDir)
+		require.Equal(t, "setup-ca-certs", pod.Spec.InitContainers[0].Name)
+		require.Empty(t, getCopy().Data)
+	})
+
+	it("updates the copies when the bundle changes", func() {
+		ac := newAC()
+		admit(ac, nil, false)
+		syncIndexer()
+
+		other := makeCert(t, "other")
+		ac.UpdateCaCertsData(other)
+		require.NoError(t, mirror.Reconcile(ctx, namespace+"/"+copyName))
+
+		require.Equal(t, systemCert+other, getCopy().Data["ca-certificates.crt"])
+	})
+
+	it("leaves copies of bundles that are no longer mirrored", func() {
+		ac := newAC()
+		admit(ac, nil, false)
+		syncIndexer()
+
+		ac.UpdateCaCertsData("")
+		require.NoError(t, mirror.Reconcile(ctx, namespace+"/"+copyName))
+
+		require.Equal(t, systemCert+injected, getCopy().Data["ca-certificates.crt"])
+	})
+
+	it("mounts the copy into ephemeral containers where the strategy of the volume expects it", func() {
+		ac := newAC()
+		pod := admit(ac, map[string]string{"cert-injection.tanzu.vmware.com/trust-store": "alpine"}, false)
+
+		old, err := json.Marshal(pod)
+		require.NoError(t, err)
+		pod.Spec.EphemeralContainers = []corev1.EphemeralContainer{{
+			EphemeralContainerCommon: corev1.EphemeralContainerCommon{Name: "debugger", Image: "busybox"},
+		}}
+		bytes, err := json.Marshal(pod)
+		require.NoError(t, err)
+
+		response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+			Namespace:   namespace,
+			Object:      runtime.RawExtension{Raw: bytes},
+			OldObject:   runtime.RawExtension{Raw: old},
+			Operation:   admissionv1.Update,
+			SubResource: "ephemeralcontainers",
+			Resource:    metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		})
+		wtesting.ExpectAllowed(t, response)
+
+		patch, err := jp.DecodePatch(response.Patch)
+		require.NoError(t, err)
+		patched, err := patch.Apply(bytes)
+		require.NoError(t, err)
+		updated := &corev1.Pod{}
+		require.NoError(t, json.Unmarshal(patched, updated))
+
+		require.Equal(t, []corev1.VolumeMount{
+			{Name: "ca-certs", MountPath: "/etc/ssl/certs", SubPath: "certs", ReadOnly: true},
+			{Name: "ca-certs", MountPath: "/etc/ssl/cert.pem", SubPath: "cert.pem", ReadOnly: true},
+		}, updated.Spec.EphemeralContainers[0].VolumeMounts)
+	})
+
+	it("parses the injection mode", func() {
+		mode, err := certinjectionwebhook.ParseInjectionMode("")
+		require.NoError(t, err)
+		require.Equal(t, certinjectionwebhook.InjectionModeInitContainer, mode)
+
+		mode, err = certinjectionwebhook.ParseInjectionMode("configmap")
+		require.NoError(t, err)
+		require.Equal(t, certinjectionwebhook.InjectionModeConfigMap, mode)
+
+		mode, err = certinjectionwebhook.ParseInjectionMode("merge")
+		require.NoError(t, err)
+		require.Equal(t, certinjectionwebhook.InjectionModeMerge, mode)
+
+		_, err = certinjectionwebhook.ParseInjectionMode("sidecar")
+		require.EqualError(t, err, `invalid injection mode "sidecar", must be one of "init-container", "configmap" or "merge"`)
+	})
+}
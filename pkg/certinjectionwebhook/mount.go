@@ -0,0 +1,158 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+// MountMode decides how the trust store is mounted into the containers.
+type MountMode string
+
+const (
+	// MountModeDirectory mounts the certificate directories of the trust
+	// store strategy over the ones of the image.
+	MountModeDirectory MountMode = "directory"
+
+	// MountModeFile mounts only the CA bundles, and any extra files, with a
+	// subPath so that the other files in the directories of the image stay
+	// in place.
+	MountModeFile MountMode = "file"
+)
+
+// ParseMountMode defaults to MountModeDirectory when mode is empty.
+func ParseMountMode(mode string) (MountMode, error) {
+	switch m := MountMode(mode); m {
+	case "":
+		return MountModeDirectory, nil
+	case MountModeDirectory, MountModeFile:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid mount mode %q, must be one of %q or %q", mode, MountModeDirectory, MountModeFile)
+	}
+}
+
+// MountOptions configure where the trust store is mounted into the
+// containers.
+type MountOptions struct {
+	Mode MountMode
+
+	// Path overrides where the certificate directory of the strategy is
+	// mounted when set.
+	Path string
+
+	// Files are paths in the trust store that are mounted besides the
+	// bundles in file mode.
+	Files []string
+}
+
+// ParseMountOptions validates the options and defaults the mode. Empty
+// files are skipped.
+func ParseMountOptions(mode, mountPath string, files []string) (MountOptions, error) {
+	m, err := ParseMountMode(mode)
+	if err != nil {
+		return MountOptions{}, err
+	}
+
+	options := MountOptions{Mode: m}
+	if mountPath != "" {
+		if !path.IsAbs(mountPath) {
+			return MountOptions{}, fmt.Errorf("invalid mount path %q, must be absolute", mountPath)
+		}
+		options.Path = path.Clean(mountPath)
+	}
+
+	for _, f := range files {
+		f = strings.TrimSpace(f)
+		if f == "" {
+			continue
+		}
+		if path.IsAbs(f) || path.Clean(f) != f || f == ".." || strings.HasPrefix(f, "../") {
+			return MountOptions{}, fmt.Errorf("invalid mount file %q, must be a relative path in the trust store", f)
+		}
+		options.Files = append(options.Files, f)
+	}
+
+	return options, nil
+}
+
+// apply returns the strategy mounted the way the options configure.
+func (o MountOptions) apply(strategy certs.Strategy) certs.Strategy {
+	if o.Path != "" {
+		strategy = strategy.WithMountPath(o.Path)
+	}
+	if o.Mode == MountModeFile {
+		strategy = strategy.WithFileMounts(o.Files)
+	}
+	return strategy
+}
+
+// injectedMounts returns the ca-certs volume mounts of the first container
+// of the pod that has any. They reflect the mount options the pod was
+// injected with.
+func injectedMounts(pod *corev1.Pod) []certs.Mount {
+	containers := append(append([]corev1.Container(nil), pod.Spec.InitContainers...), pod.Spec.Containers...)
+	for _, c := range containers {
+		if isCACertsInitContainer(c.Name) {
+			continue
+		}
+
+		var mounts []certs.Mount
+		for _, m := range c.VolumeMounts {
+			if m.Name == caCertsVolumeName {
+				mounts = append(mounts, certs.Mount{Path: m.MountPath, SubPath: m.SubPath})
+			}
+		}
+		if len(mounts) > 0 {
+			return mounts
+		}
+	}
+	return nil
+}
+
+// addCACertsVolumeMounts adds the ca-certs mounts to the mounts of the
+// container. A mount at a path the container already mounts another volume
+// at is skipped, as the pod would be invalid otherwise. The warnings report
+// those and the mounts of other volumes that hide or are hidden by the CA
+// certificates.
+func addCACertsVolumeMounts(container string, mounts []corev1.VolumeMount, add []corev1.VolumeMount) ([]corev1.VolumeMount, []string) {
+	var warnings []string
+
+	var allowed []corev1.VolumeMount
+	for _, a := range add {
+		conflict := false
+		for _, m := range mounts {
+			if m.Name == caCertsVolumeName {
+				continue
+			}
+
+			existing, mounted := path.Clean(m.MountPath), path.Clean(a.MountPath)
+			switch {
+			case existing == mounted:
+				conflict = true
+				warnings = append(warnings, fmt.Sprintf("container %q already mounts volume %q at %q, not mounting the CA certificates there",
+					container, m.Name, m.MountPath))
+			case isWithin(existing, mounted), isWithin(mounted, existing):
+				warnings = append(warnings, fmt.Sprintf("container %q mounts volume %q at %q, which overlaps the CA certificates mounted at %q",
+					container, m.Name, m.MountPath, a.MountPath))
+			}
+		}
+		if !conflict {
+			allowed = append(allowed, a)
+		}
+	}
+
+	return addVolumeMounts(mounts, allowed), warnings
+}
+
+// isWithin returns whether p is below the directory dir.
+func isWithin(dir, p string) bool {
+	return dir == "/" || strings.HasPrefix(p, dir+"/")
+}
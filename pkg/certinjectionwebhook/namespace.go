@@ -0,0 +1,39 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// NamespaceInjectionEnabled injects every pod in a namespace that has
+	// the namespace label set to it.
+	NamespaceInjectionEnabled = "enabled"
+
+	// NamespaceInjectionDisabled keeps the webhook away from a namespace
+	// that has the namespace label set to it, regardless of pod labels,
+	// annotations and policies.
+	NamespaceInjectionDisabled = "disabled"
+)
+
+// webhookNamespaceSelector is the namespaceSelector of the
+// MutatingWebhookConfiguration. Pods in namespaces that have not opted in
+// can still be selected by their own labels and annotations, so only the
+// namespaces that opted out are excluded.
+func webhookNamespaceSelector(label string) *metav1.LabelSelector {
+	if label == "" {
+		return &metav1.LabelSelector{}
+	}
+
+	return &metav1.LabelSelector{
+		MatchExpressions: []metav1.LabelSelectorRequirement{
+			{
+				Key:      label,
+				Operator: metav1.LabelSelectorOpNotIn,
+				Values:   []string{NamespaceInjectionDisabled},
+			},
+		},
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// policy is a single injection rule: the pods it selects and what gets
+// injected into them.
+type policy struct {
+	name     string
+	priority int32
+
+	selector podSelector
+
+	data *injectionData
+
+	// inheritCACerts and inheritProxy are set when the policy has no cert
+	// source or proxy. Its pods are then injected with the ca-cert bundle
+	// or the proxy env vars of the ConfigMaps.
+	inheritCACerts bool
+	inheritProxy   bool
+
+	// warnings are problems with the policy that do not keep it from being
+	// applied.
+	warnings []string
+}
+
+func (p *policy) matches(pod *corev1.Pod, namespaceLabels map[string]string) bool {
+	return p.selector.matches(pod, namespaceLabels)
+}
+
+// dataWith returns the data of the policy with the CA bundle and the proxy
+// env vars of global for those it inherits.
+func (p *policy) dataWith(global *injectionData) *injectionData {
+	if !p.inheritCACerts && !p.inheritProxy {
+		return p.data
+	}
+
+	data := *p.data
+	if p.inheritCACerts {
+		data.caCertsData = global.caCertsData
+		data.caCerts = global.caCerts
+		data.caCertsConfigMap = global.caCertsConfigMap
+	}
+	if p.inheritProxy {
+		data.envVars = global.envVars
+		data.envPrecedence = global.envPrecedence
+	}
+	return &data
+}
+
+// PolicySet is the in-memory view of the CertInjectionPolicies evaluated by
+// Admit. Policies are kept ordered by precedence: highest priority first,
+// ties broken by name.
+type PolicySet struct {
+	policies   atomic.Pointer[[]*policy]
+	updateLock sync.Mutex
+}
+
+func NewPolicySet() *PolicySet {
+	ps := &PolicySet{}
+	ps.policies.Store(&[]*policy{})
+	return ps
+}
+
+// set adds the policy or replaces the policy with the same name.
+func (ps *PolicySet) set(p *policy) {
+	ps.update(func(policies []*policy) []*policy {
+		return append(without(policies, p.name), p)
+	})
+}
+
+// remove removes the policy with the given name.
+func (ps *PolicySet) remove(name string) {
+	ps.update(func(policies []*policy) []*policy {
+		return without(policies, name)
+	})
+}
+
+// match returns the policy with the highest precedence that selects the pod
+// or nil if there is none.
+func (ps *PolicySet) match(pod *corev1.Pod, namespaceLabels map[string]string) *policy {
+	if ps == nil {
+		return nil
+	}
+
+	for _, p := range *ps.policies.Load() {
+		if p.matches(pod, namespaceLabels) {
+			return p
+		}
+	}
+	return nil
+}
+
+func (ps *PolicySet) update(f func([]*policy) []*policy) {
+	ps.updateLock.Lock()
+	defer ps.updateLock.Unlock()
+
+	policies := f(*ps.policies.Load())
+	sort.SliceStable(policies, func(i, j int) bool {
+		if policies[i].priority != policies[j].priority {
+			return policies[i].priority > policies[j].priority
+		}
+		return policies[i].name < policies[j].name
+	})
+	ps.policies.Store(&policies)
+}
+
+func without(policies []*policy, name string) []*policy {
+	res := make([]*policy, 0, len(policies))
+	for _, p := range policies {
+		if p.name != name {
+			res = append(res, p)
+		}
+	}
+	return res
+}
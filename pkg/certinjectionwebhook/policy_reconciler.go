@@ -0,0 +1,270 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/system"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/apis/certinjection/v1alpha1"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+const (
+	reasonPolicyLoaded          = "PolicyLoaded"
+	reasonCertSourceUnavailable = "CertSourceUnavailable"
+	reasonInvalidPodSelector    = "InvalidPodSelector"
+	reasonInvalidProxy          = "InvalidProxy"
+	reasonInvalidTrustStore     = "InvalidTrustStore"
+	reasonInvalidJava           = "InvalidJava"
+	reasonInvalidRuntimeProfile = "InvalidRuntimeProfile"
+	reasonInvalidMount          = "InvalidMount"
+	reasonInvalidCACerts        = "InvalidCACerts"
+)
+
+// Implements controller.Reconciler
+type policyReconciler struct {
+	dynamicClient   dynamic.Interface
+	policyLister    cache.GenericLister
+	configMapLister corelisters.ConfigMapLister
+
+	policies *PolicySet
+
+	// mirror mirrors the bundles of the policies in configmap mode.
+	mirror *BundleMirror
+
+	// expiry monitors the expiry of the bundles of the policies.
+	expiry *ExpiryMonitor
+
+	// stale detects the pods injected with an outdated bundle of a policy.
+	stale *StaleBundleDetector
+}
+
+func NewPolicyReconciler(
+	dynamicClient dynamic.Interface,
+	policyLister cache.GenericLister,
+	configMapLister corelisters.ConfigMapLister,
+	policies *PolicySet,
+	mirror *BundleMirror,
+	expiry *ExpiryMonitor,
+	stale *StaleBundleDetector,
+) *policyReconciler {
+	return &policyReconciler{
+		dynamicClient:   dynamicClient,
+		policyLister:    policyLister,
+		configMapLister: configMapLister,
+		policies:        policies,
+		mirror:          mirror,
+		expiry:          expiry,
+		stale:           stale,
+	}
+}
+
+func (r *policyReconciler) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	_, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	obj, err := r.policyLister.Get(name)
+	if apierrors.IsNotFound(err) {
+		logger.Infof("Removing CertInjectionPolicy %q", name)
+		r.policies.remove(name)
+		r.mirror.removeSource(mirrorName(name))
+		r.expiry.removeSource(policyReference(name, ""))
+		r.stale.removeBundle(policySelector(name))
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	u, ok := obj.(*unstructured.Unstructured)
+	if !ok {
+		return fmt.Errorf("unexpected object type %T for CertInjectionPolicy %q", obj, name)
+	}
+
+	cip := &v1alpha1.CertInjectionPolicy{}
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(u.UnstructuredContent(), cip); err != nil {
+		return fmt.Errorf("error converting CertInjectionPolicy %q: %v", name, err)
+	}
+
+	status := cip.Status.DeepCopy()
+	status.ObservedGeneration = cip.Generation
+
+	p, reason, err := r.policyFor(cip)
+	if err != nil {
+		logger.Errorf("CertInjectionPolicy %q is not ready: %v", name, err)
+		r.policies.remove(name)
+		r.mirror.removeSource(mirrorName(name))
+		r.expiry.removeSource(policyReference(name, cip.UID))
+		r.stale.removeBundle(policySelector(name))
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               v1alpha1.ConditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             reason,
+			Message:            err.Error(),
+			ObservedGeneration: cip.Generation,
+		})
+	} else {
+		for _, w := range p.warnings {
+			logger.Warnf("CertInjectionPolicy %q: %s", name, w)
+		}
+		r.policies.set(p)
+		if p.data.caCertsConfigMap != "" {
+			r.mirror.setSource(p.data.caCertsConfigMap, p.data.caCertsData)
+		} else {
+			r.mirror.removeSource(mirrorName(name))
+		}
+		r.expiry.setSource(policyReference(name, cip.UID), p.data.caCertsData)
+		if p.inheritCACerts {
+			r.stale.inheritBundle(policySelector(name))
+		} else {
+			r.stale.setBundle(policySelector(name), p.data.caCertsData)
+		}
+		meta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               v1alpha1.ConditionReady,
+			Status:             metav1.ConditionTrue,
+			Reason:             reasonPolicyLoaded,
+			Message:            strings.Join(p.warnings, "; "),
+			ObservedGeneration: cip.Generation,
+		})
+	}
+
+	return r.updateStatus(ctx, cip, status)
+}
+
+// policyFor returns the policy for cip or the reason it cannot be loaded.
+func (r *policyReconciler) policyFor(cip *v1alpha1.CertInjectionPolicy) (*policy, string, error) {
+	selector, err := newPolicySelector(cip.Spec.PodSelector)
+	if err != nil {
+		return nil, reasonInvalidPodSelector, err
+	}
+
+	if cip.Spec.TrustStore != "" {
+		if _, err := certs.StrategyFor(cip.Spec.TrustStore); err != nil {
+			return nil, reasonInvalidTrustStore, err
+		}
+	}
+
+	var warnings []string
+	data := &injectionData{
+		setupCACertsImage: cip.Spec.SetupCACertsImage,
+		trustStore:        cip.Spec.TrustStore,
+	}
+
+	if java := cip.Spec.Java; java != nil {
+		javaTrustStoreType, err := certs.ParseJavaTrustStoreType(java.TrustStoreType)
+		if err != nil {
+			return nil, reasonInvalidJava, err
+		}
+		data.java = &JavaOptions{
+			ToolOptions:    java.ToolOptions,
+			TrustStoreType: javaTrustStoreType,
+		}
+	}
+
+	if len(cip.Spec.RuntimeProfiles) > 0 {
+		if data.runtimeProfiles, err = ParseRuntimeProfiles(cip.Spec.RuntimeProfiles); err != nil {
+			return nil, reasonInvalidRuntimeProfile, err
+		}
+	}
+
+	if mount := cip.Spec.Mount; mount != nil {
+		options, err := ParseMountOptions(mount.Mode, mount.Path, mount.Files)
+		if err != nil {
+			return nil, reasonInvalidMount, err
+		}
+		data.mount = &options
+	}
+
+	if containers := cip.Spec.Containers; containers != nil {
+		if f := containers.CACerts; f != nil {
+			data.caCertsContainers = newContainerFilter(f.Include, f.Exclude)
+		}
+		if f := containers.Env; f != nil {
+			data.envContainers = newContainerFilter(f.Include, f.Exclude)
+		}
+	}
+
+	if proxy := cip.Spec.Proxy; proxy != nil {
+		data.envVars = proxyEnvVars(proxy.HTTPProxy, proxy.HTTPSProxy, proxy.NoProxy)
+		data.envPrecedence, err = ParseProxyEnvPrecedence(proxy.Precedence)
+		if err != nil {
+			return nil, reasonInvalidProxy, err
+		}
+	}
+
+	if source := cip.Spec.CertSource; source != nil && source.ConfigMap != nil {
+		caCertsData, err := r.configMapData(source.ConfigMap)
+		if err != nil {
+			return nil, reasonCertSourceUnavailable, err
+		}
+		if warnings, err = certs.ValidateBundle([]byte(caCertsData), time.Now()); err != nil {
+			return nil, reasonInvalidCACerts, fmt.Errorf("invalid CA certificates in configmap %q: %v", source.ConfigMap.Name, err)
+		}
+		data.caCertsData = caCertsData
+		data.caCerts = certs.Certificates(caCertsData)
+		data.caCertsConfigMap = mirrorName(cip.Name)
+	}
+
+	return &policy{
+		name:           cip.Name,
+		priority:       cip.Spec.Priority,
+		selector:       selector,
+		data:           data,
+		inheritCACerts: data.caCertsConfigMap == "",
+		inheritProxy:   cip.Spec.Proxy == nil,
+		warnings:       warnings,
+	}, "", nil
+}
+
+func (r *policyReconciler) configMapData(ref *v1alpha1.ConfigMapKeyReference) (string, error) {
+	cm, err := r.configMapLister.ConfigMaps(system.Namespace()).Get(ref.Name)
+	if err != nil {
+		return "", fmt.Errorf("error fetching configmap %q: %v", ref.Name, err)
+	}
+
+	data, ok := cm.Data[ref.Key]
+	if !ok {
+		return "", fmt.Errorf("configmap %q is missing %q key", ref.Name, ref.Key)
+	}
+	return data, nil
+}
+
+func (r *policyReconciler) updateStatus(ctx context.Context, cip *v1alpha1.CertInjectionPolicy, status *v1alpha1.CertInjectionPolicyStatus) error {
+	if equality.Semantic.DeepEqual(&cip.Status, status) {
+		return nil
+	}
+
+	updated := cip.DeepCopy()
+	updated.Status = *status
+
+	content, err := runtime.DefaultUnstructuredConverter.ToUnstructured(updated)
+	if err != nil {
+		return err
+	}
+
+	_, err = r.dynamicClient.Resource(v1alpha1.CertInjectionPolicyResource).
+		UpdateStatus(ctx, &unstructured.Unstructured{Object: content}, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to update CertInjectionPolicy %q status: %v", cip.Name, err)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// ProxyEnvPrecedence decides what happens when a container already sets one
+// of the injected env vars.
+type ProxyEnvPrecedence string
+
+const (
+	// ProxyEnvPrecedenceOverride replaces the container's value.
+	ProxyEnvPrecedenceOverride ProxyEnvPrecedence = "override"
+
+	// ProxyEnvPrecedenceKeep leaves the container's value as is.
+	ProxyEnvPrecedenceKeep ProxyEnvPrecedence = "keep"
+
+	// ProxyEnvPrecedenceMerge combines the NO_PROXY host lists and keeps
+	// the container's value for all other env vars.
+	ProxyEnvPrecedenceMerge ProxyEnvPrecedence = "merge"
+)
+
+// ParseProxyEnvPrecedence defaults to ProxyEnvPrecedenceOverride when
+// precedence is empty.
+func ParseProxyEnvPrecedence(precedence string) (ProxyEnvPrecedence, error) {
+	switch p := ProxyEnvPrecedence(precedence); p {
+	case "":
+		return ProxyEnvPrecedenceOverride, nil
+	case ProxyEnvPrecedenceOverride, ProxyEnvPrecedenceKeep, ProxyEnvPrecedenceMerge:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid proxy env precedence %q, must be one of %q, %q or %q",
+			precedence, ProxyEnvPrecedenceOverride, ProxyEnvPrecedenceKeep, ProxyEnvPrecedenceMerge)
+	}
+}
+
+// setEnvVar sets envVar in env. Env vars that are already set are updated in
+// place according to precedence so that admitting a pod again does not
+// duplicate them.
+func setEnvVar(env []corev1.EnvVar, envVar corev1.EnvVar, precedence ProxyEnvPrecedence) []corev1.EnvVar {
+	for i := range env {
+		if env[i].Name != envVar.Name {
+			continue
+		}
+
+		switch precedence {
+		case ProxyEnvPrecedenceKeep:
+		case ProxyEnvPrecedenceMerge:
+			if isNoProxy(envVar.Name) && env[i].ValueFrom == nil {
+				env[i].Value = mergeNoProxy(env[i].Value, envVar.Value)
+			}
+		default:
+			env[i] = envVar
+		}
+		return env
+	}
+	return append(env, envVar)
+}
+
+func isNoProxy(name string) bool {
+	return name == "NO_PROXY" || name == "no_proxy"
+}
+
+// mergeNoProxy returns the entries of a followed by the entries of b that are
+// not in a.
+func mergeNoProxy(a, b string) string {
+	var (
+		entries []string
+		seen    = map[string]bool{}
+	)
+	for _, entry := range strings.Split(a+","+b, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" || seen[entry] {
+			continue
+		}
+		seen[entry] = true
+		entries = append(entries, entry)
+	}
+	return strings.Join(entries, ",")
+}
@@ -7,6 +7,7 @@ import (
 	"context"
 	"fmt"
 
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	admissionlisters "k8s.io/client-go/listers/admissionregistration/v1"
@@ -18,6 +19,8 @@ import (
 	certresources "knative.dev/pkg/webhook/certificates/resources"
 )
 
+var reinvocationPolicy = admissionregistrationv1.IfNeededReinvocationPolicy
+
 // Implements controller.Reconciler
 type reconciler struct {
 	name string
@@ -27,7 +30,8 @@ type reconciler struct {
 	mwhlister    admissionlisters.MutatingWebhookConfigurationLister
 	secretlister corelisters.SecretLister
 
-	secretName string
+	secretName        string
+	namespaceSelector *metav1.LabelSelector
 }
 
 func NewReconciler(name string,
@@ -35,14 +39,16 @@ func NewReconciler(name string,
 	k8sClient kubernetes.Interface,
 	mwhlister admissionlisters.MutatingWebhookConfigurationLister,
 	secretlister corelisters.SecretLister,
-	secretName string) *reconciler {
+	secretName string,
+	namespaceSelector *metav1.LabelSelector) *reconciler {
 	return &reconciler{
-		name:         name,
-		path:         path,
-		k8sClient:    k8sClient,
-		mwhlister:    mwhlister,
-		secretlister: secretlister,
-		secretName:   secretName,
+		name:              name,
+		path:              path,
+		k8sClient:         k8sClient,
+		mwhlister:         mwhlister,
+		secretlister:      secretlister,
+		secretName:        secretName,
+		namespaceSelector: namespaceSelector,
 	}
 }
 
@@ -81,6 +87,11 @@ func (r *reconciler) reconcileMutatingWebhook(ctx context.Context, caCert []byte
 			return fmt.Errorf("missing service reference for webhook: %s", wh.Name)
 		}
 		webhook.Webhooks[i].ClientConfig.Service.Path = ptr.String(r.path)
+		webhook.Webhooks[i].NamespaceSelector = r.namespaceSelector
+		// Containers added by webhooks running after this one still need the
+		// ca certs and env vars.
+		webhook.Webhooks[i].ReinvocationPolicy = &reinvocationPolicy
+		webhook.Webhooks[i].Rules = webhookRules
 	}
 
 	if ok, err := kmp.SafeEqual(configuredWebhook, webhook); err != nil {
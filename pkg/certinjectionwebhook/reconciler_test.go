@@ -34,8 +34,15 @@ func testReconciler(t *testing.T, when spec.G, it spec.S) {
 		caSecretName = "some-secret"
 	)
 	var (
-		path     = "/some-path"
-		certData = []byte("some-cert")
+		path               = "/some-path"
+		certData           = []byte("some-cert")
+		reinvocationPolicy = admissionregistrationv1.IfNeededReinvocationPolicy
+		allScopes          = admissionregistrationv1.AllScopes
+		namespaceSelector  = &metav1.LabelSelector{
+			MatchExpressions: []metav1.LabelSelectorRequirement{
+				{Key: "some-label", Operator: metav1.LabelSelectorOpNotIn, Values: []string{"disabled"}},
+			},
+		}
 	)
 
 	when("#Reconcile", func() {
@@ -58,12 +65,13 @@ func testReconciler(t *testing.T, when spec.G, it spec.S) {
 					mwhcLister,
 					secretLister,
 					caSecretName,
+					namespaceSelector,
 				)
 
 				return r, actionRecorderList, eventList
 			})
 
-		it("Updates the webhook with the ca cert secret", func() {
+		it("Updates the webhook with the ca cert secret, namespace selector, reinvocation policy and rules", func() {
 			caSecret := &corev1.Secret{
 				ObjectMeta: metav1.ObjectMeta{
 					Name:      caSecretName,
@@ -110,6 +118,28 @@ func testReconciler(t *testing.T, when spec.G, it spec.S) {
 										},
 										CABundle: certData,
 									},
+									NamespaceSelector:  namespaceSelector,
+									ReinvocationPolicy: &reinvocationPolicy,
+									Rules: []admissionregistrationv1.RuleWithOperations{
+										{
+											Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Create},
+											Rule: admissionregistrationv1.Rule{
+												APIGroups:   []string{""},
+												APIVersions: []string{"v1"},
+												Resources:   []string{"pods"},
+												Scope:       &allScopes,
+											},
+										},
+										{
+											Operations: []admissionregistrationv1.OperationType{admissionregistrationv1.Update},
+											Rule: admissionregistrationv1.Rule{
+												APIGroups:   []string{""},
+												APIVersions: []string{"v1"},
+												Resources:   []string{"pods/ephemeralcontainers"},
+												Scope:       &allScopes,
+											},
+										},
+									},
 								},
 							},
 						},
@@ -0,0 +1,151 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"knative.dev/pkg/logging"
+)
+
+// InjectedAnnotation records on injected pods what they were injected with.
+const InjectedAnnotation = "cert-injection.tanzu.vmware.com/injected"
+
+const (
+	reasonInjected         = "CACertsInjected"
+	reasonInjectionSkipped = "CACertsInjectionSkipped"
+)
+
+// injectionRecord is the value of the InjectedAnnotation.
+type injectionRecord struct {
+	// BundleSHA256 is the SHA-256 fingerprint of the injected CA bundle. It
+	// is empty when only env vars were injected.
+	BundleSHA256 string `json:"bundleSHA256,omitempty"`
+
+	// Certificates is the number of certificates of the CA bundle.
+	Certificates int `json:"certificates"`
+
+	// Selector is the default selector or the policy that matched the pod.
+	Selector string `json:"selector"`
+
+	// Version is the version of the webhook.
+	Version string `json:"version,omitempty"`
+}
+
+// bundleSHA256 returns the SHA-256 fingerprint of the CA bundle or an empty
+// string if there is none.
+func bundleSHA256(caCertsData string) string {
+	if caCertsData == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(caCertsData))
+	return hex.EncodeToString(sum[:])
+}
+
+func (ac *admissionController) injectionRecord(data *injectionData, selector string) injectionRecord {
+	return injectionRecord{
+		BundleSHA256: bundleSHA256(data.caCertsData),
+		Certificates: len(data.caCerts),
+		Selector:     selector,
+		Version:      ac.version,
+	}
+}
+
+// markInjected sets the InjectedAnnotation of the pod to the record and
+// adds the InjectedLabel.
+func markInjected(pod *corev1.Pod, record injectionRecord) error {
+	value, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+
+	labels := make(map[string]string, len(pod.Labels)+1)
+	for k, v := range pod.Labels {
+		labels[k] = v
+	}
+	labels[InjectedLabel] = "true"
+	pod.Labels = labels
+
+	annotations := make(map[string]string, len(pod.Annotations)+1)
+	for k, v := range pod.Annotations {
+		annotations[k] = v
+	}
+	annotations[InjectedAnnotation] = string(value)
+	pod.Annotations = annotations
+	return nil
+}
+
+// recordInjected emits an Event about the injection of the pod.
+func (ac *admissionController) recordInjected(ctx context.Context, req *admissionv1.AdmissionRequest, pod *corev1.Pod, record injectionRecord) {
+	message := fmt.Sprintf("Injected proxy env vars into pod %s matched by %s", podName(pod), record.Selector)
+	if record.BundleSHA256 != "" {
+		message = fmt.Sprintf("Injected CA bundle %s (%d certificates) into pod %s matched by %s",
+			record.BundleSHA256, record.Certificates, podName(pod), record.Selector)
+	}
+	ac.recordEvent(ctx, req, pod, corev1.EventTypeNormal, reasonInjected, message)
+}
+
+// recordSkipped emits an Event about the pod that is deliberately not
+// injected although it is selected.
+func (ac *admissionController) recordSkipped(ctx context.Context, req *admissionv1.AdmissionRequest, pod *corev1.Pod, why string) {
+	ac.recordEvent(ctx, req, pod, corev1.EventTypeNormal, reasonInjectionSkipped,
+		fmt.Sprintf("Skipped injection into pod %s: %s", podName(pod), why))
+}
+
+func (ac *admissionController) recordEvent(ctx context.Context, req *admissionv1.AdmissionRequest, pod *corev1.Pod, eventType, reason, message string) {
+	if ac.recorder == nil || (req.DryRun != nil && *req.DryRun) {
+		return
+	}
+
+	ref := podEventReference(req.Namespace, pod)
+	if ref == nil {
+		logging.FromContext(ctx).Debugf("pod %s has no name or controller to emit the %s Event on", podName(pod), reason)
+		return
+	}
+	ac.recorder.Event(ref, eventType, reason, message)
+}
+
+// podEventReference returns the object the Events about the pod are emitted
+// on. Pods named by the API server after admission from their generateName
+// cannot be referenced yet, so their Events are emitted on the controller of
+// the pod instead. It returns nil if there is none.
+func podEventReference(namespace string, pod *corev1.Pod) *corev1.ObjectReference {
+	if pod.Name != "" {
+		return &corev1.ObjectReference{
+			APIVersion: "v1",
+			Kind:       "Pod",
+			Namespace:  namespace,
+			Name:       pod.Name,
+			UID:        pod.UID,
+		}
+	}
+
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return nil
+	}
+	return &corev1.ObjectReference{
+		APIVersion: owner.APIVersion,
+		Kind:       owner.Kind,
+		Namespace:  namespace,
+		Name:       owner.Name,
+		UID:        owner.UID,
+	}
+}
+
+// podName returns the name of the pod or its generateName followed by a *
+// if it is not named yet.
+func podName(pod *corev1.Pod) string {
+	if pod.Name == "" && pod.GenerateName != "" {
+		return fmt.Sprintf("%q", pod.GenerateName+"*")
+	}
+	return fmt.Sprintf("%q", pod.Name)
+}
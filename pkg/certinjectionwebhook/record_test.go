@@ -0,0 +1,115 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestInjectionRecord(t *testing.T) {
+	spec.Run(t, "Injection Record", testInjectionRecord)
+}
+
+func testInjectionRecord(t *testing.T, when spec.G, it spec.S) {
+	const label = "some/label"
+
+	var (
+		ctx         = context.TODO()
+		caCertsData string
+		recorder    *record.FakeRecorder
+		ac          caCertsAdmitter
+	)
+
+	it.Before(func() {
+		caCertsData = makeCert(t, "some-ca") + makeCert(t, "other-ca")
+		recorder = record.NewFakeRecorder(10)
+		recorder.IncludeObject = true
+
+		var err error
+		ac, err = certinjectionwebhook.NewAdmissionController("some-webhook", "/some-path", nil, certinjectionwebhook.AdmissionOptions{
+			Labels:            []string{label},
+			SetupCACertsImage: "some-ca-certs-image",
+			CACertsData:       caCertsData,
+			Version:           "v1.2.3",
+			Recorder:          recorder,
+		})
+		require.NoError(t, err)
+	})
+
+	pod := func() *corev1.Pod {
+		return &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "some-namespace", Name: "some-pod", Labels: map[string]string{label: ""}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			},
+		}
+	}
+
+	admit := func(pod *corev1.Pod, dryRun bool) *corev1.Pod {
+		return admitPod(t, ctx, ac, pod, dryRun)
+	}
+
+	it("annotates injected pods with the bundle, the selector and the version", func() {
+		injected := admit(pod(), false)
+
+		require.JSONEq(t, fmt.Sprintf(`{"bundleSHA256":"%s","certificates":2,"selector":"default","version":"v1.2.3"}`, bundleSHA(caCertsData)),
+			injected.Annotations[certinjectionwebhook.InjectedAnnotation])
+		require.Nil(t, admit(injected, false))
+	})
+
+	it("emits an Event on injected pods", func() {
+		admit(pod(), false)
+
+		require.Len(t, recorder.Events, 1)
+		require.Equal(t, fmt.Sprintf(`Normal CACertsInjected Injected CA bundle %s (2 certificates) into pod "some-pod" matched by default involvedObject{kind=Pod,apiVersion=v1}`, bundleSHA(caCertsData)),
+			<-recorder.Events)
+	})
+
+	it("emits the Event on the controller of pods that are not named yet", func() {
+		p := pod()
+		p.Name = ""
+		p.GenerateName = "some-pod-"
+		controller := true
+		p.OwnerReferences = []metav1.OwnerReference{{
+			APIVersion: "apps/v1",
+			Kind:       "ReplicaSet",
+			Name:       "some-replicaset",
+			Controller: &controller,
+		}}
+		admit(p, false)
+
+		require.Len(t, recorder.Events, 1)
+		require.Equal(t, fmt.Sprintf(`Normal CACertsInjected Injected CA bundle %s (2 certificates) into pod "some-pod-*" matched by default involvedObject{kind=ReplicaSet,apiVersion=apps/v1}`, bundleSHA(caCertsData)),
+			<-recorder.Events)
+	})
+
+	it("emits an Event on selected pods that are skipped", func() {
+		p := pod()
+		p.Spec.NodeSelector = map[string]string{"kubernetes.io/os": "windows"}
+		require.Nil(t, admit(p, false))
+
+		require.Len(t, recorder.Events, 1)
+		require.Equal(t, `Normal CACertsInjectionSkipped Skipped injection into pod "some-pod": Windows pods are not injected involvedObject{kind=Pod,apiVersion=v1}`,
+			<-recorder.Events)
+	})
+
+	it("does not emit Events on pods that are not selected or on dry runs", func() {
+		p := pod()
+		p.Labels = nil
+		require.Nil(t, admit(p, false))
+
+		require.NotNil(t, admit(pod(), true))
+		require.Empty(t, recorder.Events)
+	})
+}
@@ -0,0 +1,449 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+)
+
+const (
+	// AutoRestartAnnotation opts Deployments, StatefulSets and DaemonSets in
+	// to a rollout restart once the CA bundle of their pods changes.
+	AutoRestartAnnotation = "cert-injection.tanzu.vmware.com/auto-restart"
+
+	// MaintenanceWindowAnnotation restricts the restarts in the namespace to
+	// daily windows in UTC, e.g. 22:00-04:00.
+	MaintenanceWindowAnnotation = "cert-injection.tanzu.vmware.com/maintenance-window"
+
+	// restartedAtAnnotation is the pod template annotation that kubectl
+	// rollout restart sets.
+	restartedAtAnnotation = "kubectl.kubernetes.io/restartedAt"
+
+	// restartedForAnnotation records the fingerprint of the bundle the
+	// workload was restarted for, so that it is restarted once per bundle.
+	restartedForAnnotation = "cert-injection.tanzu.vmware.com/restarted-for-bundle"
+
+	reasonRolloutRestarted = "RolloutRestarted"
+
+	// restartRetryDelay is how long a restart waits for rollouts in progress
+	// to complete.
+	restartRetryDelay = 30 * time.Second
+)
+
+// RestartOptions configure the rollout restarts of the workloads whose pods
+// are injected with a CA bundle that is no longer current.
+type RestartOptions struct {
+	// Concurrency is the number of restarted workloads that may roll out at
+	// the same time.
+	Concurrency int
+
+	// Interval is the minimum time between two restarts.
+	Interval time.Duration
+}
+
+// ParseRestartOptions validates the concurrency and the interval of the
+// restarts.
+func ParseRestartOptions(concurrency int, interval time.Duration) (RestartOptions, error) {
+	if concurrency < 1 {
+		return RestartOptions{}, fmt.Errorf("invalid restart concurrency %d, must be at least 1", concurrency)
+	}
+	if interval < 0 {
+		return RestartOptions{}, fmt.Errorf("invalid restart interval %q, must not be negative", interval.String())
+	}
+	return RestartOptions{Concurrency: concurrency, Interval: interval}, nil
+}
+
+// MaintenanceWindows are daily windows in UTC.
+type MaintenanceWindows []maintenanceWindow
+
+// maintenanceWindow is the time of day a window starts and ends at. It
+// spans midnight if it ends before it starts.
+type maintenanceWindow struct {
+	start, end time.Duration
+}
+
+// ParseMaintenanceWindows parses comma separated windows like 22:00-04:00.
+// Empty values are skipped.
+func ParseMaintenanceWindows(value string) (MaintenanceWindows, error) {
+	var windows MaintenanceWindows
+	for _, v := range strings.Split(value, ",") {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		start, end, ok := strings.Cut(v, "-")
+		s, err := parseTimeOfDay(start)
+		e, err2 := parseTimeOfDay(end)
+		if !ok || err != nil || err2 != nil || s == e {
+			return nil, fmt.Errorf("invalid maintenance window %q, must be like 22:00-04:00", v)
+		}
+		windows = append(windows, maintenanceWindow{start: s, end: e})
+	}
+	return windows, nil
+}
+
+func parseTimeOfDay(v string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(v))
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Until returns how long it takes until one of the windows is open at now,
+// zero if one is open or there are none.
+func (w MaintenanceWindows) Until(now time.Time) time.Duration {
+	if len(w) == 0 {
+		return 0
+	}
+
+	now = now.UTC()
+	midnight := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, time.UTC)
+	timeOfDay := now.Sub(midnight)
+
+	var until time.Duration = -1
+	for _, window := range w {
+		if window.contains(timeOfDay) {
+			return 0
+		}
+		d := window.start - timeOfDay
+		if d < 0 {
+			d += day
+		}
+		if until < 0 || d < until {
+			until = d
+		}
+	}
+	return until
+}
+
+func (w maintenanceWindow) contains(timeOfDay time.Duration) bool {
+	if w.start < w.end {
+		return w.start <= timeOfDay && timeOfDay < w.end
+	}
+	return timeOfDay >= w.start || timeOfDay < w.end
+}
+
+// restartTarget is a workload that can be restarted.
+type restartTarget struct {
+	kind, namespace, name string
+}
+
+func (t restartTarget) String() string {
+	return fmt.Sprintf("%s %s/%s", t.kind, t.namespace, t.name)
+}
+
+// WorkloadListers list the ReplicaSets the pods belong to and the
+// workloads that are restarted.
+type WorkloadListers struct {
+	ReplicaSets  appslisters.ReplicaSetLister
+	Deployments  appslisters.DeploymentLister
+	StatefulSets appslisters.StatefulSetLister
+	DaemonSets   appslisters.DaemonSetLister
+}
+
+// Restarter restarts the rollout of the workloads that opted in with the
+// AutoRestartAnnotation once the StaleBundleDetector reports their pods.
+type Restarter struct {
+	options         RestartOptions
+	client          kubernetes.Interface
+	podLister       corelisters.PodLister
+	namespaceLister corelisters.NamespaceLister
+	workloads       WorkloadListers
+	stale           *StaleBundleDetector
+	recorder        record.EventRecorder
+	limiter         *rate.Limiter
+
+	lock sync.Mutex
+
+	// rolling are the restarted workloads whose rollout may not have
+	// completed yet, with the generation the restart patched them to or -1
+	// while they are being patched. The rollout of a generation the
+	// listers have not seen yet is not complete.
+	rolling map[restartTarget]int64
+}
+
+func NewRestarter(
+	options RestartOptions,
+	client kubernetes.Interface,
+	podLister corelisters.PodLister,
+	namespaceLister corelisters.NamespaceLister,
+	workloads WorkloadListers,
+	stale *StaleBundleDetector,
+	recorder record.EventRecorder,
+) *Restarter {
+	limit := rate.Inf
+	if options.Interval > 0 {
+		limit = rate.Every(options.Interval)
+	}
+	return &Restarter{
+		options:         options,
+		client:          client,
+		podLister:       podLister,
+		namespaceLister: namespaceLister,
+		workloads:       workloads,
+		stale:           stale,
+		recorder:        recorder,
+		limiter:         rate.NewLimiter(limit, 1),
+		rolling:         map[restartTarget]int64{},
+	}
+}
+
+// Reconcile restarts the workload of the stale pod with the key if it opted
+// in and was not restarted for the current bundle yet. Restarts outside the
+// maintenance windows of the namespace, beyond the concurrency or the rate
+// are requeued.
+func (r *Restarter) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	current, stale := r.stale.current(types.NamespacedName{Namespace: namespace, Name: name})
+	if !stale {
+		return nil
+	}
+
+	pod, err := r.podLister.Pods(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	target, ok, err := r.resolve(pod)
+	if err != nil || !ok {
+		return err
+	}
+
+	obj, template, _, err := r.get(target)
+	if apierrors.IsNotFound(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if obj.GetAnnotations()[AutoRestartAnnotation] != "true" || template.Annotations[restartedForAnnotation] == bundleOrNone(current) {
+		return nil
+	}
+
+	windows, err := r.maintenanceWindows(namespace)
+	if err != nil {
+		logger.Warnf("Not restarting %s: %v", target, err)
+		return nil
+	}
+	if until := windows.Until(time.Now()); until > 0 {
+		logger.Infof("Restarting %s in the maintenance window of namespace %q in %s", target, namespace, until)
+		return controller.NewRequeueAfter(until)
+	}
+
+	if !r.acquire(target) {
+		return controller.NewRequeueAfter(restartRetryDelay)
+	}
+
+	reservation := r.limiter.Reserve()
+	if delay := reservation.Delay(); delay > 0 {
+		reservation.Cancel()
+		r.release(target)
+		return controller.NewRequeueAfter(delay)
+	}
+
+	generation, err := r.patch(ctx, target, current)
+	if err != nil {
+		r.release(target)
+		return err
+	}
+	r.patched(target, generation)
+	logger.Infof("Restarted %s for CA bundle %s", target, bundleOrNone(current))
+
+	if r.recorder != nil {
+		r.recorder.Event(&corev1.ObjectReference{
+			APIVersion: "apps/v1",
+			Kind:       target.kind,
+			Namespace:  target.namespace,
+			Name:       target.name,
+			UID:        obj.GetUID(),
+		}, corev1.EventTypeNormal, reasonRolloutRestarted, fmt.Sprintf("Restarted the rollout for CA bundle %s", bundleOrNone(current)))
+	}
+	return nil
+}
+
+// resolve follows the controllers of the pod to the workload to restart,
+// e.g. from the ReplicaSet of the pod to its Deployment. It returns false if
+// the pod does not belong to a Deployment, StatefulSet or DaemonSet.
+func (r *Restarter) resolve(pod *corev1.Pod) (restartTarget, bool, error) {
+	owner := metav1.GetControllerOf(pod)
+	for owner != nil {
+		switch owner.Kind {
+		case "Deployment", "StatefulSet", "DaemonSet":
+			return restartTarget{kind: owner.Kind, namespace: pod.Namespace, name: owner.Name}, true, nil
+		case "ReplicaSet":
+			rs, err := r.workloads.ReplicaSets.ReplicaSets(pod.Namespace).Get(owner.Name)
+			if apierrors.IsNotFound(err) {
+				return restartTarget{}, false, nil
+			} else if err != nil {
+				return restartTarget{}, false, err
+			}
+			owner = metav1.GetControllerOf(rs)
+		default:
+			return restartTarget{}, false, nil
+		}
+	}
+	return restartTarget{}, false, nil
+}
+
+// get returns the workload, its pod template and whether its rollout has
+// completed.
+func (r *Restarter) get(t restartTarget) (metav1.Object, *corev1.PodTemplateSpec, bool, error) {
+	switch t.kind {
+	case "Deployment":
+		d, err := r.workloads.Deployments.Deployments(t.namespace).Get(t.name)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		replicas := int32(1)
+		if d.Spec.Replicas != nil {
+			replicas = *d.Spec.Replicas
+		}
+		complete := d.Status.ObservedGeneration >= d.Generation &&
+			d.Status.UpdatedReplicas == replicas &&
+			d.Status.Replicas == replicas &&
+			d.Status.AvailableReplicas == replicas
+		return d, &d.Spec.Template, complete, nil
+	case "StatefulSet":
+		s, err := r.workloads.StatefulSets.StatefulSets(t.namespace).Get(t.name)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		replicas := int32(1)
+		if s.Spec.Replicas != nil {
+			replicas = *s.Spec.Replicas
+		}
+		complete := s.Status.ObservedGeneration >= s.Generation &&
+			s.Status.UpdatedReplicas == replicas &&
+			s.Status.ReadyReplicas == replicas
+		return s, &s.Spec.Template, complete, nil
+	case "DaemonSet":
+		ds, err := r.workloads.DaemonSets.DaemonSets(t.namespace).Get(t.name)
+		if err != nil {
+			return nil, nil, false, err
+		}
+		complete := ds.Status.ObservedGeneration >= ds.Generation &&
+			ds.Status.UpdatedNumberScheduled == ds.Status.DesiredNumberScheduled &&
+			ds.Status.NumberAvailable == ds.Status.DesiredNumberScheduled
+		return ds, &ds.Spec.Template, complete, nil
+	default:
+		return nil, nil, false, fmt.Errorf("cannot restart %s", t)
+	}
+}
+
+// patch sets the annotations of the pod template of the workload that
+// restart its rollout like kubectl rollout restart and returns the
+// generation of the patched workload.
+func (r *Restarter) patch(ctx context.Context, t restartTarget, bundle string) (int64, error) {
+	patch, err := json.Marshal(map[string]interface{}{
+		"spec": map[string]interface{}{
+			"template": map[string]interface{}{
+				"metadata": map[string]interface{}{
+					"annotations": map[string]string{
+						restartedAtAnnotation:  time.Now().UTC().Format(time.RFC3339),
+						restartedForAnnotation: bundleOrNone(bundle),
+					},
+				},
+			},
+		},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	var obj metav1.Object
+	apps := r.client.AppsV1()
+	switch t.kind {
+	case "Deployment":
+		obj, err = apps.Deployments(t.namespace).Patch(ctx, t.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "StatefulSet":
+		obj, err = apps.StatefulSets(t.namespace).Patch(ctx, t.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	case "DaemonSet":
+		obj, err = apps.DaemonSets(t.namespace).Patch(ctx, t.name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+	default:
+		return 0, fmt.Errorf("cannot restart %s", t)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return obj.GetGeneration(), nil
+}
+
+// acquire records the rollout of the workload unless it is still rolling
+// out or as many restarted workloads as the concurrency allows are.
+// Workloads whose rollout has completed are forgotten. The workloads are
+// read from the listers.
+func (r *Restarter) acquire(t restartTarget) bool {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for rolling, generation := range r.rolling {
+		if generation < 0 {
+			continue
+		}
+		obj, _, complete, err := r.get(rolling)
+		if apierrors.IsNotFound(err) || (err == nil && complete && obj.GetGeneration() >= generation) {
+			delete(r.rolling, rolling)
+		}
+	}
+	if _, ok := r.rolling[t]; ok || len(r.rolling) >= r.options.Concurrency {
+		return false
+	}
+	r.rolling[t] = -1
+	return true
+}
+
+// patched records the generation the restart patched the workload to.
+func (r *Restarter) patched(t restartTarget, generation int64) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.rolling[t] = generation
+}
+
+// release forgets the rollout of the workload that was not restarted.
+func (r *Restarter) release(t restartTarget) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.rolling, t)
+}
+
+func (r *Restarter) maintenanceWindows(namespace string) (MaintenanceWindows, error) {
+	if r.namespaceLister == nil {
+		return nil, nil
+	}
+
+	ns, err := r.namespaceLister.Get(namespace)
+	if apierrors.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return ParseMaintenanceWindows(ns.Annotations[MaintenanceWindowAnnotation])
+}
@@ -0,0 +1,290 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	appslisters "k8s.io/client-go/listers/apps/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+	"knative.dev/pkg/controller"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestRestarter(t *testing.T) {
+	spec.Run(t, "Restarter", testRestarter)
+}
+
+func testRestarter(t *testing.T, when spec.G, it spec.S) {
+	const (
+		label     = "some/label"
+		namespace = "some-namespace"
+		hash      = "5d8f7c6b9"
+	)
+
+	var (
+		ctx              = context.TODO()
+		caCertsData      string
+		podIndexer       cache.Indexer
+		namespaceIndexer cache.Indexer
+		workloadIndexer  cache.Indexer
+		client           *k8sfake.Clientset
+		recorder         *record.FakeRecorder
+		detector         *certinjectionwebhook.StaleBundleDetector
+		ac               caCertsAdmitter
+	)
+
+	it.Before(func() {
+		caCertsData = makeCert(t, "some-ca")
+		podIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		namespaceIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		workloadIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		client = k8sfake.NewSimpleClientset()
+		recorder = record.NewFakeRecorder(10)
+		detector = certinjectionwebhook.NewStaleBundleDetector(corelisters.NewPodLister(podIndexer), nil)
+
+		var err error
+		ac, err = certinjectionwebhook.NewAdmissionController("some-webhook", "/some-path", nil, certinjectionwebhook.AdmissionOptions{
+			Labels:            []string{label},
+			SetupCACertsImage: "some-ca-certs-image",
+			CACertsData:       caCertsData,
+			Stale:             detector,
+		})
+		require.NoError(t, err)
+	})
+
+	newRestarter := func(concurrency int, interval time.Duration) *certinjectionwebhook.Restarter {
+		options, err := certinjectionwebhook.ParseRestartOptions(concurrency, interval)
+		require.NoError(t, err)
+		return certinjectionwebhook.NewRestarter(options, client, corelisters.NewPodLister(podIndexer),
+			corelisters.NewNamespaceLister(namespaceIndexer), certinjectionwebhook.WorkloadListers{
+				ReplicaSets:  appslisters.NewReplicaSetLister(workloadIndexer),
+				Deployments:  appslisters.NewDeploymentLister(workloadIndexer),
+				StatefulSets: appslisters.NewStatefulSetLister(workloadIndexer),
+				DaemonSets:   appslisters.NewDaemonSetLister(workloadIndexer),
+			}, detector, recorder)
+	}
+
+	// sync updates the listers with the Deployment like the informer.
+	sync := func(name string) {
+		d, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.NoError(t, workloadIndexer.Update(d))
+	}
+
+	// deploy creates the Deployment and its ReplicaSet and adds them to the
+	// listers, admits a pod of it, adds the injected pod to the lister and
+	// returns its key.
+	deploy := func(name string, annotations map[string]string) string {
+		controller := true
+		d, err := client.AppsV1().Deployments(namespace).Create(ctx, &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name, Annotations: annotations},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		require.NoError(t, workloadIndexer.Add(d))
+		rs, err := client.AppsV1().ReplicaSets(namespace).Create(ctx, &appsv1.ReplicaSet{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name + "-" + hash,
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "apps/v1",
+					Kind:       "Deployment",
+					Name:       name,
+					Controller: &controller,
+				}},
+			},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+		require.NoError(t, workloadIndexer.Add(rs))
+
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: namespace,
+				Name:      name + "-" + hash + "-x2x4z",
+				Labels:    map[string]string{label: "", "pod-template-hash": hash},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "apps/v1",
+					Kind:       "ReplicaSet",
+					Name:       name + "-" + hash,
+					Controller: &controller,
+				}},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			},
+		}
+		injected := admitPod(t, ctx, ac, pod, false)
+		require.NoError(t, podIndexer.Add(injected))
+		return namespace + "/" + injected.Name
+	}
+
+	optIn := map[string]string{certinjectionwebhook.AutoRestartAnnotation: "true"}
+
+	// rotate changes the bundle and reports the pods with the keys as stale.
+	rotate := func(keys ...string) string {
+		updated := makeCert(t, "updated-ca")
+		ac.UpdateCaCertsData(updated)
+		for _, key := range keys {
+			require.NoError(t, detector.Reconcile(ctx, key))
+		}
+		return updated
+	}
+
+	template := func(name string) map[string]string {
+		d, err := client.AppsV1().Deployments(namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return d.Spec.Template.Annotations
+	}
+
+	requireRequeued := func(err error) time.Duration {
+		requeued, after := controller.IsRequeueKey(err)
+		require.True(t, requeued, "expected a requeue, got %v", err)
+		return after
+	}
+
+	it("restarts the Deployment of stale pods once per bundle", func() {
+		key := deploy("some-deployment", optIn)
+		updated := rotate(key)
+		restarter := newRestarter(1, 0)
+
+		require.NoError(t, restarter.Reconcile(ctx, key))
+
+		annotations := template("some-deployment")
+		require.Equal(t, bundleSHA(updated), annotations["cert-injection.tanzu.vmware.com/restarted-for-bundle"])
+		require.NotEmpty(t, annotations["kubectl.kubernetes.io/restartedAt"])
+		require.Len(t, recorder.Events, 1)
+		require.Equal(t, fmt.Sprintf("Normal RolloutRestarted Restarted the rollout for CA bundle %s", bundleSHA(updated)), <-recorder.Events)
+
+		require.Equal(t, 30*time.Second, requireRequeued(restarter.Reconcile(ctx, key)))
+		require.Empty(t, recorder.Events)
+
+		sync("some-deployment")
+		require.NoError(t, restarter.Reconcile(ctx, key))
+		require.Empty(t, recorder.Events)
+	})
+
+	it("does not restart workloads that did not opt in", func() {
+		key := deploy("some-deployment", nil)
+		rotate(key)
+
+		require.NoError(t, newRestarter(1, 0).Reconcile(ctx, key))
+		require.Empty(t, template("some-deployment"))
+		require.Empty(t, recorder.Events)
+	})
+
+	it("does not restart workloads of pods that are not stale", func() {
+		key := deploy("some-deployment", optIn)
+		require.NoError(t, detector.Reconcile(ctx, key))
+
+		require.NoError(t, newRestarter(1, 0).Reconcile(ctx, key))
+		require.Empty(t, template("some-deployment"))
+	})
+
+	it("waits for rollouts in progress beyond the concurrency", func() {
+		key := deploy("some-deployment", optIn)
+		otherKey := deploy("other-deployment", optIn)
+		rotate(key, otherKey)
+		restarter := newRestarter(1, 0)
+
+		require.NoError(t, restarter.Reconcile(ctx, key))
+		require.Equal(t, 30*time.Second, requireRequeued(restarter.Reconcile(ctx, otherKey)))
+		require.Empty(t, template("other-deployment"))
+
+		d, err := client.AppsV1().Deployments(namespace).Get(ctx, "some-deployment", metav1.GetOptions{})
+		require.NoError(t, err)
+		d.Status = appsv1.DeploymentStatus{Replicas: 1, UpdatedReplicas: 1, AvailableReplicas: 1}
+		_, err = client.AppsV1().Deployments(namespace).UpdateStatus(ctx, d, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		require.Equal(t, 30*time.Second, requireRequeued(restarter.Reconcile(ctx, otherKey)))
+
+		sync("some-deployment")
+
+		require.NoError(t, restarter.Reconcile(ctx, otherKey))
+		require.NotEmpty(t, template("other-deployment"))
+	})
+
+	it("limits the rate of the restarts", func() {
+		key := deploy("some-deployment", optIn)
+		otherKey := deploy("other-deployment", optIn)
+		rotate(key, otherKey)
+		restarter := newRestarter(2, time.Hour)
+
+		require.NoError(t, restarter.Reconcile(ctx, key))
+		after := requireRequeued(restarter.Reconcile(ctx, otherKey))
+		require.Greater(t, after, 59*time.Minute)
+		require.Empty(t, template("other-deployment"))
+	})
+
+	it("restarts in the maintenance windows of the namespace only", func() {
+		key := deploy("some-deployment", optIn)
+		rotate(key)
+
+		start := time.Now().UTC().Add(2 * time.Hour)
+		require.NoError(t, namespaceIndexer.Add(&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: namespace,
+				Annotations: map[string]string{
+					certinjectionwebhook.MaintenanceWindowAnnotation: fmt.Sprintf("%s-%s", start.Format("15:04"), start.Add(time.Hour).Format("15:04")),
+				},
+			},
+		}))
+
+		after := requireRequeued(newRestarter(1, 0).Reconcile(ctx, key))
+		require.Greater(t, after, time.Hour)
+		require.LessOrEqual(t, after, 2*time.Hour)
+		require.Empty(t, template("some-deployment"))
+	})
+
+	when("ParseRestartOptions", func() {
+		it("requires a concurrency of at least 1 and a non-negative interval", func() {
+			_, err := certinjectionwebhook.ParseRestartOptions(0, time.Minute)
+			require.EqualError(t, err, "invalid restart concurrency 0, must be at least 1")
+
+			_, err = certinjectionwebhook.ParseRestartOptions(1, -time.Minute)
+			require.EqualError(t, err, `invalid restart interval "-1m0s", must not be negative`)
+		})
+	})
+
+	when("ParseMaintenanceWindows", func() {
+		at := func(hour, minute int) time.Time {
+			return time.Date(2024, 1, 1, hour, minute, 0, 0, time.UTC)
+		}
+
+		it("parses windows that span midnight", func() {
+			windows, err := certinjectionwebhook.ParseMaintenanceWindows("22:00-04:00, 12:00-12:30")
+			require.NoError(t, err)
+
+			require.Equal(t, time.Duration(0), windows.Until(at(23, 0)))
+			require.Equal(t, time.Duration(0), windows.Until(at(3, 59)))
+			require.Equal(t, time.Duration(0), windows.Until(at(12, 15)))
+			require.Equal(t, 8*time.Hour, windows.Until(at(4, 0)))
+			require.Equal(t, 9*time.Hour+30*time.Minute, windows.Until(at(12, 30)))
+		})
+
+		it("is always open without windows", func() {
+			windows, err := certinjectionwebhook.ParseMaintenanceWindows("")
+			require.NoError(t, err)
+			require.Equal(t, time.Duration(0), windows.Until(at(12, 0)))
+		})
+
+		it("rejects invalid windows", func() {
+			for _, value := range []string{"22:00", "22:00-25:00", "10:00-10:00", "night"} {
+				_, err := certinjectionwebhook.ParseMaintenanceWindows(value)
+				require.EqualError(t, err, fmt.Sprintf("invalid maintenance window %q, must be like 22:00-04:00", value))
+			}
+		})
+	})
+}
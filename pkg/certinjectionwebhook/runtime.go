@@ -0,0 +1,122 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+// RuntimeProfilesAnnotation selects the runtime profiles of a pod as a comma
+// separated list, e.g. "node,python,git". It takes precedence over the
+// profiles of the policy.
+const RuntimeProfilesAnnotation = "cert-injection.tanzu.vmware.com/runtime-profiles"
+
+// RuntimeProfile names the env vars that point a runtime to the trust store.
+type RuntimeProfile string
+
+const (
+	RuntimeProfileNode    RuntimeProfile = "node"
+	RuntimeProfilePython  RuntimeProfile = "python"
+	RuntimeProfileOpenSSL RuntimeProfile = "openssl"
+	RuntimeProfileCurl    RuntimeProfile = "curl"
+	RuntimeProfileGit     RuntimeProfile = "git"
+)
+
+// trustEnvVar is an env var set to the path of the CA bundle or, for dir, of
+// the directory of hashed certificates.
+type trustEnvVar struct {
+	name string
+	dir  bool
+}
+
+var runtimeProfileEnvVars = map[RuntimeProfile][]trustEnvVar{
+	RuntimeProfileNode:    {{name: "NODE_EXTRA_CA_CERTS"}},
+	RuntimeProfilePython:  {{name: "REQUESTS_CA_BUNDLE"}, {name: "PIP_CERT"}},
+	RuntimeProfileOpenSSL: {{name: "SSL_CERT_FILE"}, {name: "SSL_CERT_DIR", dir: true}},
+	RuntimeProfileCurl:    {{name: "CURL_CA_BUNDLE"}},
+	RuntimeProfileGit:     {{name: "GIT_SSL_CAINFO"}},
+}
+
+var runtimeProfiles = []RuntimeProfile{
+	RuntimeProfileNode,
+	RuntimeProfilePython,
+	RuntimeProfileOpenSSL,
+	RuntimeProfileCurl,
+	RuntimeProfileGit,
+}
+
+// ParseRuntimeProfiles parses the names of runtime profiles. Empty names are
+// ignored and duplicates are dropped.
+func ParseRuntimeProfiles(names []string) ([]RuntimeProfile, error) {
+	var (
+		profiles []RuntimeProfile
+		seen     = map[RuntimeProfile]bool{}
+	)
+	for _, name := range names {
+		p := RuntimeProfile(strings.TrimSpace(name))
+		if p == "" || seen[p] {
+			continue
+		}
+		if _, ok := runtimeProfileEnvVars[p]; !ok {
+			valid := make([]string, 0, len(runtimeProfiles))
+			for _, v := range runtimeProfiles {
+				valid = append(valid, string(v))
+			}
+			return nil, fmt.Errorf("invalid runtime profile %q, must be one of %s", name, strings.Join(valid, ", "))
+		}
+		seen[p] = true
+		profiles = append(profiles, p)
+	}
+	return profiles, nil
+}
+
+// podRuntimeProfiles returns the profiles set by the pod annotation or else
+// profiles.
+func podRuntimeProfiles(pod *corev1.Pod, profiles []RuntimeProfile) ([]RuntimeProfile, error) {
+	annotation, ok := pod.Annotations[RuntimeProfilesAnnotation]
+	if !ok {
+		return profiles, nil
+	}
+
+	profiles, err := ParseRuntimeProfiles(strings.Split(annotation, ","))
+	if err != nil {
+		return nil, fmt.Errorf("invalid %s annotation: %v", RuntimeProfilesAnnotation, err)
+	}
+	return profiles, nil
+}
+
+// runtimeEnvVars returns the env vars of the profiles pointing to where the
+// strategy mounts the CA bundle and the certificate directory. Env vars whose
+// file is not mounted are left out.
+func runtimeEnvVars(strategy certs.Strategy, profiles []RuntimeProfile) []corev1.EnvVar {
+	bundle, hasBundle := strategy.MountedPath(strategy.Bundles[0])
+	dir, hasDir := strategy.MountedPath(strategy.Dirs[0])
+
+	var envVars []corev1.EnvVar
+	for _, p := range profiles {
+		for _, e := range runtimeProfileEnvVars[p] {
+			switch {
+			case e.dir && hasDir:
+				envVars = append(envVars, corev1.EnvVar{Name: e.name, Value: dir})
+			case !e.dir && hasBundle:
+				envVars = append(envVars, corev1.EnvVar{Name: e.name, Value: bundle})
+			}
+		}
+	}
+	return envVars
+}
+
+// setRuntimeEnvVars sets envVars in env. Values the container already sets
+// are kept, the container may point the runtime to a bundle of its own.
+func setRuntimeEnvVars(env []corev1.EnvVar, envVars []corev1.EnvVar) []corev1.EnvVar {
+	for _, envVar := range envVars {
+		env = setEnvVar(env, envVar, ProxyEnvPrecedenceKeep)
+	}
+	return env
+}
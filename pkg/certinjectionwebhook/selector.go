@@ -0,0 +1,221 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/apis/certinjection/v1alpha1"
+)
+
+// podSelector selects a pod when any of its terms matches.
+type podSelector []selectorTerm
+
+func (s podSelector) matches(pod *corev1.Pod, namespaceLabels map[string]string) bool {
+	for _, term := range s {
+		if term.matches(pod, namespaceLabels) {
+			return true
+		}
+	}
+	return false
+}
+
+// selectorTerm matches a pod when all of its label, annotation and
+// namespace label requirements are met.
+type selectorTerm struct {
+	labels      []requirement
+	annotations []requirement
+	namespaces  []requirement
+}
+
+func (t selectorTerm) matches(pod *corev1.Pod, namespaceLabels map[string]string) bool {
+	for _, r := range t.labels {
+		if !r.matches(pod.Labels) {
+			return false
+		}
+	}
+	for _, r := range t.annotations {
+		if !r.matches(pod.Annotations) {
+			return false
+		}
+	}
+	for _, r := range t.namespaces {
+		if !r.matches(namespaceLabels) {
+			return false
+		}
+	}
+	return true
+}
+
+// requirement has the semantics of a metav1.LabelSelectorRequirement except
+// that a key ending in "*" matches every key with that prefix.
+type requirement struct {
+	key      string
+	prefix   bool
+	operator metav1.LabelSelectorOperator
+	values   map[string]struct{}
+}
+
+func newRequirement(key string, operator metav1.LabelSelectorOperator, values []string) (requirement, error) {
+	r := requirement{
+		key:      strings.TrimSuffix(key, "*"),
+		prefix:   strings.HasSuffix(key, "*"),
+		operator: operator,
+		values:   map[string]struct{}{},
+	}
+	for _, v := range values {
+		r.values[v] = struct{}{}
+	}
+
+	if key == "" {
+		return requirement{}, fmt.Errorf("key must not be empty")
+	}
+
+	switch operator {
+	case metav1.LabelSelectorOpIn, metav1.LabelSelectorOpNotIn:
+		if len(values) == 0 {
+			return requirement{}, fmt.Errorf("values for key %q must be non-empty for operator %q", key, operator)
+		}
+	case metav1.LabelSelectorOpExists, metav1.LabelSelectorOpDoesNotExist:
+		if len(values) != 0 {
+			return requirement{}, fmt.Errorf("values for key %q must be empty for operator %q", key, operator)
+		}
+	default:
+		return requirement{}, fmt.Errorf("invalid operator %q for key %q", operator, key)
+	}
+
+	return r, nil
+}
+
+func (r requirement) matches(m map[string]string) bool {
+	var found, valueFound bool
+	for k, v := range m {
+		if k != r.key && !(r.prefix && strings.HasPrefix(k, r.key)) {
+			continue
+		}
+		found = true
+		if _, ok := r.values[v]; ok {
+			valueFound = true
+		}
+	}
+
+	switch r.operator {
+	case metav1.LabelSelectorOpIn:
+		return valueFound
+	case metav1.LabelSelectorOpNotIn:
+		return !valueFound
+	case metav1.LabelSelectorOpExists:
+		return found
+	case metav1.LabelSelectorOpDoesNotExist:
+		return !found
+	}
+	return false
+}
+
+// newKeySelector selects pods that have any of the label or annotation keys.
+func newKeySelector(labelKeys, annotationKeys []string) (podSelector, error) {
+	var s podSelector
+	for _, key := range labelKeys {
+		r, err := newRequirement(key, metav1.LabelSelectorOpExists, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid label: %v", err)
+		}
+		s = append(s, selectorTerm{labels: []requirement{r}})
+	}
+	for _, key := range annotationKeys {
+		r, err := newRequirement(key, metav1.LabelSelectorOpExists, nil)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotation: %v", err)
+		}
+		s = append(s, selectorTerm{annotations: []requirement{r}})
+	}
+	return s, nil
+}
+
+func newPolicySelector(ps v1alpha1.PodSelector) (podSelector, error) {
+	s, err := newKeySelector(ps.Labels, ps.Annotations)
+	if err != nil {
+		return nil, err
+	}
+
+	if ps.LabelSelector == nil && ps.AnnotationSelector == nil && ps.NamespaceSelector == nil {
+		return s, nil
+	}
+
+	var term selectorTerm
+	if ls := ps.LabelSelector; ls != nil {
+		term.labels, err = requirements(ls.MatchLabels, ls.MatchExpressions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid labelSelector: %v", err)
+		}
+	}
+	if as := ps.AnnotationSelector; as != nil {
+		var expressions []metav1.LabelSelectorRequirement
+		for _, e := range as.MatchExpressions {
+			expressions = append(expressions, metav1.LabelSelectorRequirement{
+				Key:      e.Key,
+				Operator: e.Operator,
+				Values:   e.Values,
+			})
+		}
+		term.annotations, err = requirements(as.MatchAnnotations, expressions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid annotationSelector: %v", err)
+		}
+	}
+	if ns := ps.NamespaceSelector; ns != nil {
+		term.namespaces, err = requirements(ns.MatchLabels, ns.MatchExpressions)
+		if err != nil {
+			return nil, fmt.Errorf("invalid namespaceSelector: %v", err)
+		}
+	}
+
+	return append(s, term), nil
+}
+
+func requirements(matchValues map[string]string, expressions []metav1.LabelSelectorRequirement) ([]requirement, error) {
+	keys := make([]string, 0, len(matchValues))
+	for k := range matchValues {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var res []requirement
+	for _, k := range keys {
+		r, err := newRequirement(k, metav1.LabelSelectorOpIn, []string{matchValues[k]})
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+
+	for _, e := range expressions {
+		r, err := newRequirement(e.Key, e.Operator, e.Values)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r)
+	}
+
+	return res, nil
+}
+
+// newNamespaceSelector selects the pods in namespaces that have the label
+// set to NamespaceInjectionEnabled.
+func newNamespaceSelector(label string) (podSelector, error) {
+	if label == "" {
+		return nil, nil
+	}
+
+	r, err := newRequirement(label, metav1.LabelSelectorOpIn, []string{NamespaceInjectionEnabled})
+	if err != nil {
+		return nil, fmt.Errorf("invalid namespace label: %v", err)
+	}
+	return podSelector{{namespaces: []requirement{r}}}, nil
+}
@@ -0,0 +1,442 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/system"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+const (
+	CASourceKindSecret    = "Secret"
+	CASourceKindConfigMap = "ConfigMap"
+)
+
+var pemBegin = []byte("-----BEGIN ")
+
+// CASource is a key of a Secret or ConfigMap in the system namespace that
+// holds CA certificates as PEM or base64 encoded PEM, a TLS Secret, a
+// cert-manager Certificate, Issuer or ClusterIssuer, or a trust-manager
+// Bundle. The Key is empty for the latter.
+type CASource struct {
+	Kind, Name, Key string
+}
+
+func (s CASource) String() string {
+	if s.Key == "" {
+		return fmt.Sprintf("%s/%s", strings.ToLower(s.Kind), s.Name)
+	}
+	return fmt.Sprintf("%s/%s/%s", strings.ToLower(s.Kind), s.Name, s.Key)
+}
+
+// ParseCASources parses references like secret/registry-ca/ca.crt,
+// configmap/ldap-ca, secret/internal-tls, certificate/internal-ca,
+// issuer/internal-ca, clusterissuer/internal-ca or bundle/internal-ca. The
+// key of ConfigMaps defaults to ca.crt; Secrets without a key are TLS
+// Secrets. Empty values and duplicates are skipped.
+func ParseCASources(values []string) ([]CASource, error) {
+	var sources []CASource
+	seen := map[CASource]bool{}
+	for _, v := range values {
+		v = strings.TrimSpace(v)
+		if v == "" {
+			continue
+		}
+
+		source, ok := parseCASource(v)
+		if !ok {
+			return nil, fmt.Errorf("invalid CA source %q, must be like secret/<name>/<key>, configmap/<name>/<key>, secret/<name>, certificate/<name>, issuer/<name>, clusterissuer/<name> or bundle/<name>", v)
+		}
+
+		if !seen[source] {
+			seen[source] = true
+			sources = append(sources, source)
+		}
+	}
+	return sources, nil
+}
+
+func parseCASource(v string) (CASource, bool) {
+	parts := strings.Split(v, "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[1] == "" {
+		return CASource{}, false
+	}
+
+	source := CASource{Name: parts[1]}
+	if len(parts) == 3 {
+		if parts[2] == "" {
+			return CASource{}, false
+		}
+		source.Key = parts[2]
+	}
+
+	switch strings.ToLower(parts[0]) {
+	case "secret":
+		source.Kind = CASourceKindSecret
+	case "configmap":
+		source.Kind = CASourceKindConfigMap
+		if source.Key == "" {
+			source.Key = caCertConfigMapKey
+		}
+	case "certificate":
+		source.Kind = CASourceKindCertificate
+	case "issuer":
+		source.Kind = CASourceKindIssuer
+	case "clusterissuer":
+		source.Kind = CASourceKindClusterIssuer
+	case "bundle":
+		source.Kind = CASourceKindBundle
+	default:
+		return CASource{}, false
+	}
+	if source.indirect() && source.Key != "" {
+		return CASource{}, false
+	}
+	return source, true
+}
+
+// reference refers to the object the certificates of the source are read
+// from, or that refers to them for indirect sources.
+func (s CASource) reference() *corev1.ObjectReference {
+	ref := &corev1.ObjectReference{
+		APIVersion: "v1",
+		Kind:       s.Kind,
+		Namespace:  system.Namespace(),
+		Name:       s.Name,
+	}
+	switch s.Kind {
+	case CASourceKindCertificate, CASourceKindIssuer:
+		ref.APIVersion = certificateResource.GroupVersion().String()
+	case CASourceKindClusterIssuer:
+		ref.APIVersion = clusterIssuerResource.GroupVersion().String()
+		ref.Namespace = ""
+	case CASourceKindBundle:
+		ref.APIVersion = bundleResource.GroupVersion().String()
+		ref.Namespace = ""
+	}
+	return ref
+}
+
+// indirect returns whether the source is a cert-manager or trust-manager
+// resource that refers to the Secret or ConfigMap with the certificates.
+// These resources are not watched but loaded periodically.
+func (s CASource) indirect() bool {
+	switch s.Kind {
+	case CASourceKindCertificate, CASourceKindIssuer, CASourceKindClusterIssuer, CASourceKindBundle:
+		return true
+	default:
+		return false
+	}
+}
+
+// resolvedTarget is the Secret or ConfigMap in the system namespace an
+// indirect source refers to.
+type resolvedTarget struct {
+	kind, name string
+}
+
+// CASourceSet aggregates the CA certificates of the ca-cert ConfigMap and of
+// the sources into the bundle injected by default. Certificates found in
+// more than one source are injected once.
+type CASourceSet struct {
+	sources         []CASource
+	options         CertManagerOptions
+	client          kubernetes.Interface
+	dynamicClient   dynamic.Interface
+	secretLister    corelisters.SecretLister
+	configMapLister corelisters.ConfigMapLister
+
+	// update sets the CA bundle injected by default.
+	update func(caCertsData string)
+
+	// expiry monitors the certificates of the ca-cert ConfigMap and of each
+	// source under the object they are read from.
+	expiry *ExpiryMonitor
+
+	lock sync.Mutex
+
+	// caCertConfigMap is the bundle of the ca-cert ConfigMap.
+	caCertConfigMap string
+
+	// data are the PEM encoded certificates of the sources that were loaded.
+	data map[CASource]string
+
+	// targets are the Secrets and ConfigMaps in the system namespace the
+	// indirect sources refer to.
+	targets map[CASource]resolvedTarget
+
+	// retired are the certificates that rotated out of the cert-manager
+	// sources.
+	retired map[CASource][]retiredCert
+
+	// bundle is the last bundle that was published.
+	bundle *string
+
+	// pending are the sources that have not been loaded yet. The bundle is
+	// held back until each of them was loaded once, so that pods are not
+	// injected with part of it.
+	pending map[CASource]bool
+
+	// loaded is closed once the first bundle is published.
+	loaded chan struct{}
+}
+
+func NewCASourceSet(
+	sources []CASource,
+	options CertManagerOptions,
+	client kubernetes.Interface,
+	dynamicClient dynamic.Interface,
+	secretLister corelisters.SecretLister,
+	configMapLister corelisters.ConfigMapLister,
+) *CASourceSet {
+	pending := map[CASource]bool{}
+	for _, source := range sources {
+		pending[source] = true
+	}
+	return &CASourceSet{
+		sources:         sources,
+		options:         options,
+		client:          client,
+		dynamicClient:   dynamicClient,
+		secretLister:    secretLister,
+		configMapLister: configMapLister,
+		data:            map[CASource]string{},
+		targets:         map[CASource]resolvedTarget{},
+		retired:         map[CASource][]retiredCert{},
+		pending:         pending,
+		loaded:          make(chan struct{}),
+	}
+}
+
+// watches returns whether obj, a Secret or ConfigMap of the kind, is one of
+// the sources or the target of an indirect source.
+func (s *CASourceSet) watches(kind string, obj interface{}) bool {
+	object, ok := obj.(interface {
+		GetNamespace() string
+		GetName() string
+	})
+	if !ok || object.GetNamespace() != system.Namespace() {
+		return false
+	}
+	for _, source := range s.sources {
+		if source.Kind == kind && source.Name == object.GetName() {
+			return true
+		}
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, target := range s.targets {
+		if target.kind == kind && target.name == object.GetName() {
+			return true
+		}
+	}
+	return false
+}
+
+// setCACertConfigMap sets the bundle of the ca-cert ConfigMap.
+func (s *CASourceSet) setCACertConfigMap(caCertsData string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.caCertConfigMap = caCertsData
+	s.publish(time.Now())
+}
+
+// Reconcile loads the sources of the Secret or ConfigMap with the key and
+// the indirect sources and updates the injected bundle. Sources that are
+// invalid keep their previous certificates and are retried; sources that
+// are missing are left out. The indirect sources are requeued to load them
+// again. The sources are loaded without holding the lock, since the
+// indirect ones are read from the API server.
+func (s *CASourceSet) Reconcile(ctx context.Context, key string) error {
+	logger := logging.FromContext(ctx)
+
+	_, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+
+	// loaded are the sources that were loaded or found missing, with nil
+	// data for the latter.
+	loaded := map[CASource][]byte{}
+	var errs []error
+	for _, source := range s.sources {
+		if source.Name != name && !source.indirect() {
+			continue
+		}
+
+		data, err := s.load(ctx, source)
+		if apierrors.IsNotFound(err) {
+			logger.Warnf("CA source %s not found, leaving it out: %v", source, err)
+			loaded[source] = nil
+			continue
+		} else if err != nil {
+			logger.Errorf("Error loading CA source %s, keeping its previous ca certs: %v", source, err)
+			errs = append(errs, fmt.Errorf("error loading CA source %s: %w", source, err))
+			continue
+		}
+
+		warnings, err := certs.ValidateBundle(data, time.Now())
+		if err != nil {
+			logger.Errorf("Invalid ca certs in CA source %s, keeping its previous ca certs: %v", source, err)
+			errs = append(errs, fmt.Errorf("invalid ca certs in CA source %s: %w", source, err))
+			continue
+		}
+		for _, w := range warnings {
+			logger.Warnf("CA source %s: %s", source, w)
+		}
+		loaded[source] = data
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for source, data := range loaded {
+		delete(s.pending, source)
+		if data == nil {
+			delete(s.data, source)
+			delete(s.retired, source)
+			continue
+		}
+		s.rotate(source, string(data), now)
+		s.data[source] = string(data)
+	}
+
+	s.publish(now)
+
+	if len(errs) > 0 {
+		return errors.Join(errs...)
+	}
+	if next, ok := s.nextResync(now); ok {
+		return controller.NewRequeueAfter(next)
+	}
+	return nil
+}
+
+// setTarget remembers the Secret or ConfigMap the indirect source refers
+// to so that its changes are watched.
+func (s *CASourceSet) setTarget(source CASource, target resolvedTarget) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.targets[source] = target
+}
+
+// load returns the decoded certificates of the source.
+func (s *CASourceSet) load(ctx context.Context, source CASource) ([]byte, error) {
+	var (
+		data []byte
+		ok   bool
+	)
+	switch source.Kind {
+	case CASourceKindSecret:
+		secret, err := s.secretLister.Secrets(system.Namespace()).Get(source.Name)
+		if err != nil {
+			return nil, err
+		}
+		if source.Key == "" {
+			return tlsSecretCAs(secret)
+		}
+		data, ok = secret.Data[source.Key]
+	case CASourceKindConfigMap:
+		cm, err := s.configMapLister.ConfigMaps(system.Namespace()).Get(source.Name)
+		if err != nil {
+			return nil, err
+		}
+		var value string
+		if value, ok = cm.Data[source.Key]; ok {
+			data = []byte(value)
+		} else {
+			data, ok = cm.BinaryData[source.Key]
+		}
+	case CASourceKindBundle:
+		return s.loadBundle(ctx, source)
+	default:
+		return s.loadCertManager(ctx, source)
+	}
+	if !ok {
+		return nil, fmt.Errorf("%s %q is missing %q key", strings.ToLower(source.Kind), source.Name, source.Key)
+	}
+	return decodeCACerts(data)
+}
+
+// publish updates the injected bundle if it changed and every source was
+// loaded. Retired certificates are injected until their overlap ends. The
+// lock must be held.
+func (s *CASourceSet) publish(now time.Time) {
+	if len(s.pending) > 0 {
+		return
+	}
+
+	ts := certs.NewTrustStore()
+	// The bundles were validated when they were loaded.
+	_, _ = ts.Add("ca-cert", []byte(s.caCertConfigMap))
+	for i, source := range s.sources {
+		if data, ok := s.data[source]; ok {
+			_, _ = ts.Add(fmt.Sprintf("source_%d", i), []byte(data))
+		}
+	}
+	s.expiry.setSource(caCertConfigMapReference(), s.caCertConfigMap)
+	for i, source := range s.sources {
+		data := s.data[source]
+		var retired []retiredCert
+		for _, r := range s.retired[source] {
+			if r.until.After(now) {
+				retired = append(retired, r)
+				data += "\n" + r.pem
+				_, _ = ts.Add(fmt.Sprintf("retired_%d", i), []byte(r.pem))
+			}
+		}
+		s.retired[source] = retired
+		s.expiry.setSource(source.reference(), data)
+	}
+
+	bundle := string(ts.Bundle())
+	if s.bundle != nil && *s.bundle == bundle {
+		return
+	}
+	if s.bundle == nil {
+		defer close(s.loaded)
+	}
+	s.bundle = &bundle
+
+	if s.update != nil {
+		s.update(bundle)
+	}
+}
+
+// decodeCACerts returns the PEM data as is and decodes anything else as
+// base64 encoded PEM.
+func decodeCACerts(data []byte) ([]byte, error) {
+	if bytes.Contains(data, pemBegin) {
+		return data, nil
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(data)), ""))
+	if err != nil {
+		return nil, fmt.Errorf("ca certs are neither PEM nor base64 encoded PEM: %v", err)
+	}
+	return decoded, nil
+}
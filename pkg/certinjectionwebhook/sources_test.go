@@ -0,0 +1,435 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	jp "github.com/evanphx/json-patch/v5"
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/configmap"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/system"
+	wtesting "knative.dev/pkg/webhook/testing"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestCASources(t *testing.T) {
+	spec.Run(t, "CA Sources", testCASources)
+}
+
+func testCASources(t *testing.T, when spec.G, it spec.S) {
+	const label = "some/label"
+
+	var (
+		ctx              = context.TODO()
+		cmw              *configmap.ManualWatcher
+		secretIndexer    cache.Indexer
+		configMapIndexer cache.Indexer
+		client           *k8sfake.Clientset
+		dynamicClient    *dynamicfake.FakeDynamicClient
+		set              *certinjectionwebhook.CASourceSet
+		monitor          *certinjectionwebhook.ExpiryMonitor
+		ac               caCertsAdmitter
+		registryCA       string
+		ldapCA           string
+	)
+
+	certManagerResources := map[schema.GroupVersionResource]string{
+		{Group: "cert-manager.io", Version: "v1", Resource: "certificates"}:        "CertificateList",
+		{Group: "cert-manager.io", Version: "v1", Resource: "issuers"}:             "IssuerList",
+		{Group: "cert-manager.io", Version: "v1", Resource: "clusterissuers"}:      "ClusterIssuerList",
+		{Group: "trust.cert-manager.io", Version: "v1alpha1", Resource: "bundles"}: "BundleList",
+	}
+
+	certManagerObject := func(kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+		metadata := map[string]interface{}{"name": name}
+		if namespace != "" {
+			metadata["namespace"] = namespace
+		}
+		apiVersion := "cert-manager.io/v1"
+		if kind == "Bundle" {
+			apiVersion = "trust.cert-manager.io/v1alpha1"
+		}
+		return &unstructured.Unstructured{Object: map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       kind,
+			"metadata":   metadata,
+			"spec":       spec,
+		}}
+	}
+
+	it.Before(func() {
+		registryCA = makeCert(t, "registry-ca")
+		ldapCA = makeCert(t, "ldap-ca")
+
+		cmw = &configmap.ManualWatcher{Namespace: system.Namespace()}
+		secretIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		configMapIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		client = k8sfake.NewSimpleClientset()
+		dynamicClient = dynamicfake.NewSimpleDynamicClientWithCustomListKinds(
+			runtime.NewScheme(),
+			certManagerResources,
+			certManagerObject("Certificate", system.Namespace(), "internal-ca", map[string]interface{}{"secretName": "internal-ca-tls"}),
+			certManagerObject("Issuer", system.Namespace(), "internal-issuer", map[string]interface{}{"ca": map[string]interface{}{"secretName": "internal-issuer-ca"}}),
+			certManagerObject("ClusterIssuer", "", "cluster-issuer", map[string]interface{}{"ca": map[string]interface{}{"secretName": "cluster-issuer-ca"}}),
+			certManagerObject("ClusterIssuer", "", "acme", map[string]interface{}{"acme": map[string]interface{}{}}),
+			certManagerObject("Bundle", "", "trust-bundle", map[string]interface{}{"target": map[string]interface{}{"configMap": map[string]interface{}{"key": "trust-bundle.pem"}}}),
+			certManagerObject("Bundle", "", "secret-bundle", map[string]interface{}{"target": map[string]interface{}{"secret": map[string]interface{}{"key": "bundle.pem"}}}),
+		)
+	})
+
+	// watch aggregates the sources with the ca-cert configmap into the
+	// bundle of the admission controller.
+	watch := func(overlap time.Duration, values ...string) {
+		sources, err := certinjectionwebhook.ParseCASources(values)
+		require.NoError(t, err)
+		options, err := certinjectionwebhook.ParseCertManagerOptions("cert-manager", overlap)
+		require.NoError(t, err)
+
+		set = certinjectionwebhook.NewCASourceSet(sources, options, client, dynamicClient,
+			corelisters.NewSecretLister(secretIndexer), corelisters.NewConfigMapLister(configMapIndexer))
+
+		monitor = certinjectionwebhook.NewExpiryMonitor(nil, nil)
+		admissionController, err := certinjectionwebhook.NewAdmissionController("some-webhook", "/some-path", nil, certinjectionwebhook.AdmissionOptions{
+			Labels:            []string{label},
+			SetupCACertsImage: "some-ca-certs-image",
+			Expiry:            monitor,
+		})
+		require.NoError(t, err)
+		ac = admissionController
+
+		certinjectionwebhook.WatchConfigMaps(ctx, cmw, admissionController, set)
+	}
+
+	podBytes := func() []byte {
+		bytes, err := json.Marshal(&corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "some-pod", Labels: map[string]string{label: ""}},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			},
+		})
+		require.NoError(t, err)
+		return bytes
+	}
+
+	admit := func(ctx context.Context) *admissionv1.AdmissionResponse {
+		return ac.Admit(ctx, &admissionv1.AdmissionRequest{
+			Namespace: "some-namespace",
+			Object:    runtime.RawExtension{Raw: podBytes()},
+			Operation: admissionv1.Create,
+			Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		})
+	}
+
+	// injected returns the CA certificates injected into a pod.
+	injected := func() []string {
+		bytes := podBytes()
+		response := admit(ctx)
+		wtesting.ExpectAllowed(t, response)
+		if response.Patch == nil {
+			return nil
+		}
+
+		patch, err := jp.DecodePatch(response.Patch)
+		require.NoError(t, err)
+		patched, err := patch.Apply(bytes)
+		require.NoError(t, err)
+
+		var result corev1.Pod
+		require.NoError(t, json.Unmarshal(patched, &result))
+		if len(result.Spec.InitContainers) == 0 {
+			return nil
+		}
+
+		var caCerts []string
+		for _, env := range result.Spec.InitContainers[0].Env {
+			caCerts = append(caCerts, env.Value)
+		}
+		return caCerts
+	}
+
+	secret := func(namespace, name, key string, value []byte) *corev1.Secret {
+		return &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string][]byte{key: value},
+		}
+	}
+
+	configMap := func(name, key, value string) *corev1.ConfigMap {
+		return &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: system.Namespace(), Name: name},
+			Data:       map[string]string{key: value},
+		}
+	}
+
+	reconcile := func(name string) error {
+		return set.Reconcile(ctx, system.Namespace()+"/"+name)
+	}
+
+	// requeued reconciles the cert-manager sources and returns when they are
+	// loaded again.
+	requeued := func(name string) time.Duration {
+		requeue, after := controller.IsRequeueKey(reconcile(name))
+		require.True(t, requeue)
+		return after
+	}
+
+	when("Secret and ConfigMap keys", func() {
+		it.Before(func() {
+			watch(0, "secret/registry-ca/ca.crt", "configmap/ldap-ca")
+		})
+
+		it("injects the certificates of PEM and base64 encoded sources", func() {
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "registry-ca", "ca.crt", []byte(registryCA))))
+			require.NoError(t, configMapIndexer.Add(configMap("ldap-ca", "ca.crt", base64.StdEncoding.EncodeToString([]byte(ldapCA)))))
+			require.NoError(t, reconcile("registry-ca"))
+			require.NoError(t, reconcile("ldap-ca"))
+
+			require.Equal(t, []string{registryCA, ldapCA}, injected())
+		})
+
+		it("aggregates the sources with the ca-cert configmap and dedupes the certificates", func() {
+			caCert := makeCert(t, "some-ca")
+			cmw.OnChange(configMap("ca-cert", "ca.crt", base64.StdEncoding.EncodeToString([]byte(caCert+registryCA))))
+			require.NoError(t, reconcile("ldap-ca"))
+
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "registry-ca", "ca.crt", []byte(registryCA+ldapCA))))
+			require.NoError(t, reconcile("registry-ca"))
+
+			require.Equal(t, []string{caCert, registryCA, ldapCA}, injected())
+		})
+
+		it("holds the bundle back from the pods to inject until every source was loaded once", func() {
+			caCert := makeCert(t, "some-ca")
+			cmw.OnChange(configMap("ca-cert", "ca.crt", base64.StdEncoding.EncodeToString([]byte(caCert))))
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "registry-ca", "ca.crt", []byte(registryCA))))
+			require.NoError(t, reconcile("registry-ca"))
+
+			response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+				Namespace: "some-namespace",
+				Object:    runtime.RawExtension{Raw: []byte(`{"metadata":{"name":"other-pod"}}`)},
+				Operation: admissionv1.Create,
+				Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+			})
+			wtesting.ExpectAllowed(t, response)
+			require.Nil(t, response.Patch)
+
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			response = admit(canceled)
+			wtesting.ExpectAllowed(t, response)
+			require.Nil(t, response.Patch)
+			require.Equal(t, []string{"CA bundle sources have not been loaded yet, letting the pod through without injecting it"}, response.Warnings)
+
+			require.NoError(t, reconcile("ldap-ca"))
+			require.Equal(t, []string{caCert, registryCA}, injected())
+		})
+
+		it("keeps holding the bundle back while a source fails to load", func() {
+			require.NoError(t, reconcile("ldap-ca"))
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "registry-ca", "ca.crt", []byte("not a certificate"))))
+			require.Error(t, reconcile("registry-ca"))
+
+			canceled, cancel := context.WithCancel(ctx)
+			cancel()
+			require.Nil(t, admit(canceled).Patch)
+
+			require.NoError(t, secretIndexer.Update(secret(system.Namespace(), "registry-ca", "ca.crt", []byte(registryCA))))
+			require.NoError(t, reconcile("registry-ca"))
+			require.Equal(t, []string{registryCA}, injected())
+		})
+
+		it("monitors the expiry of the certificates of each source under the object they are read from", func() {
+			caCert := makeCert(t, "some-ca")
+			cmw.OnChange(configMap("ca-cert", "ca.crt", base64.StdEncoding.EncodeToString([]byte(caCert))))
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "registry-ca", "ca.crt", []byte(registryCA))))
+			require.NoError(t, reconcile("registry-ca"))
+			require.NoError(t, configMapIndexer.Add(configMap("ldap-ca", "ca.crt", ldapCA)))
+			require.NoError(t, reconcile("ldap-ca"))
+
+			var monitored []string
+			for _, series := range monitor.Read()[0].TimeSeries {
+				monitored = append(monitored, series.LabelValues[0].Value+"/"+series.LabelValues[1].Value+" "+series.LabelValues[2].Value)
+			}
+			require.ElementsMatch(t, []string{
+				"ConfigMap/ca-cert CN=some-ca",
+				"Secret/registry-ca CN=registry-ca",
+				"ConfigMap/ldap-ca CN=ldap-ca",
+			}, monitored)
+		})
+
+		it("keeps the previous certificates of invalid sources and leaves out missing ones", func() {
+			require.NoError(t, reconcile("ldap-ca"))
+			s := secret(system.Namespace(), "registry-ca", "ca.crt", []byte(registryCA))
+			require.NoError(t, secretIndexer.Add(s))
+			require.NoError(t, reconcile("registry-ca"))
+
+			require.NoError(t, secretIndexer.Update(secret(system.Namespace(), "registry-ca", "ca.crt", []byte("not a certificate"))))
+			require.Error(t, reconcile("registry-ca"))
+			require.Equal(t, []string{registryCA}, injected())
+
+			require.NoError(t, secretIndexer.Update(secret(system.Namespace(), "registry-ca", "other.crt", []byte(registryCA))))
+			require.EqualError(t, reconcile("registry-ca"), `error loading CA source secret/registry-ca/ca.crt: secret "registry-ca" is missing "ca.crt" key`)
+			require.Equal(t, []string{registryCA}, injected())
+
+			require.NoError(t, secretIndexer.Delete(s))
+			require.NoError(t, reconcile("registry-ca"))
+			require.Nil(t, injected())
+		})
+	})
+
+	when("cert-manager sources", func() {
+		it("injects the ca.crt of the Secret of a Certificate and keeps the rotated CA during the overlap", func() {
+			watch(2*time.Minute, "certificate/internal-ca")
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "internal-ca-tls", "ca.crt", []byte(registryCA))))
+
+			require.Equal(t, 5*time.Minute, requeued("internal-ca"))
+			require.Equal(t, []string{registryCA}, injected())
+
+			require.NoError(t, secretIndexer.Update(secret(system.Namespace(), "internal-ca-tls", "ca.crt", []byte(ldapCA))))
+			after := requeued("internal-ca-tls")
+			require.Greater(t, after, time.Minute)
+			require.LessOrEqual(t, after, 2*time.Minute)
+			require.Equal(t, []string{ldapCA, registryCA}, injected())
+		})
+
+		it("replaces rotated CAs right away without an overlap", func() {
+			watch(0, "certificate/internal-ca")
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "internal-ca-tls", "ca.crt", []byte(registryCA))))
+			requeued("internal-ca")
+
+			require.NoError(t, secretIndexer.Update(secret(system.Namespace(), "internal-ca-tls", "ca.crt", []byte(ldapCA))))
+			requeued("internal-ca-tls")
+			require.Equal(t, []string{ldapCA}, injected())
+		})
+
+		it("injects the CA certificates of the tls.crt chain of TLS Secrets and Issuers", func() {
+			watch(0, "secret/internal-tls", "issuer/internal-issuer")
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "internal-tls", "tls.crt", []byte(makeLeafCert(t, "some-service")+registryCA))))
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "internal-issuer-ca", "tls.crt", []byte(ldapCA))))
+
+			requeued("internal-tls")
+			require.Equal(t, []string{registryCA, ldapCA}, injected())
+		})
+
+		it("reads the Secrets of ClusterIssuers from the cluster resource namespace", func() {
+			watch(0, "clusterissuer/cluster-issuer")
+			_, err := client.CoreV1().Secrets("cert-manager").Create(ctx, secret("cert-manager", "cluster-issuer-ca", "tls.crt", []byte(registryCA)), metav1.CreateOptions{})
+			require.NoError(t, err)
+
+			requeued("cluster-issuer")
+			require.Equal(t, []string{registryCA}, injected())
+		})
+
+		it("retries issuers that are not CA issuers", func() {
+			watch(0, "clusterissuer/acme")
+
+			require.EqualError(t, reconcile("acme"), `error loading CA source clusterissuer/acme: clusterissuer "acme" is not a CA issuer`)
+		})
+	})
+
+	when("trust-manager sources", func() {
+		it("injects the certificates of the ConfigMap and Secret targets of Bundles", func() {
+			watch(0, "bundle/trust-bundle", "bundle/secret-bundle")
+			require.NoError(t, configMapIndexer.Add(configMap("trust-bundle", "trust-bundle.pem", registryCA)))
+			require.NoError(t, secretIndexer.Add(secret(system.Namespace(), "secret-bundle", "bundle.pem", []byte(ldapCA))))
+
+			require.Equal(t, 5*time.Minute, requeued("trust-bundle"))
+			require.Equal(t, []string{registryCA, ldapCA}, injected())
+
+			require.NoError(t, configMapIndexer.Update(configMap("trust-bundle", "trust-bundle.pem", registryCA+ldapCA)))
+			requeued("trust-bundle")
+			require.Equal(t, []string{registryCA, ldapCA}, injected())
+		})
+
+		it("leaves out Bundles that do not exist", func() {
+			watch(0, "bundle/missing-bundle")
+
+			requeued("missing-bundle")
+			require.Nil(t, injected())
+		})
+	})
+
+	when("ParseCASources", func() {
+		it("parses Secret and ConfigMap keys and cert-manager and trust-manager sources", func() {
+			sources, err := certinjectionwebhook.ParseCASources([]string{
+				"secret/registry-ca/ca.pem", " ConfigMap/ldap-ca ", "", "secret/registry-ca/ca.pem",
+				"secret/internal-tls", "certificate/internal-ca", "issuer/internal-issuer", "clusterissuer/cluster-issuer",
+				"bundle/trust-bundle",
+			})
+			require.NoError(t, err)
+			require.Equal(t, []certinjectionwebhook.CASource{
+				{Kind: "Secret", Name: "registry-ca", Key: "ca.pem"},
+				{Kind: "ConfigMap", Name: "ldap-ca", Key: "ca.crt"},
+				{Kind: "Secret", Name: "internal-tls"},
+				{Kind: "Certificate", Name: "internal-ca"},
+				{Kind: "Issuer", Name: "internal-issuer"},
+				{Kind: "ClusterIssuer", Name: "cluster-issuer"},
+				{Kind: "Bundle", Name: "trust-bundle"},
+			}, sources)
+		})
+
+		it("rejects invalid references", func() {
+			for _, value := range []string{"registry-ca", "pod/some-pod/ca.crt", "secret//ca.crt", "secret/registry-ca/", "certificate/internal-ca/ca.crt", "bundle/trust-bundle/ca.crt"} {
+				_, err := certinjectionwebhook.ParseCASources([]string{value})
+				require.EqualError(t, err, `invalid CA source "`+value+`", must be like secret/<name>/<key>, configmap/<name>/<key>, secret/<name>, certificate/<name>, issuer/<name>, clusterissuer/<name> or bundle/<name>`)
+			}
+		})
+	})
+
+	when("ParseCertManagerOptions", func() {
+		it("requires a namespace and a non-negative overlap", func() {
+			_, err := certinjectionwebhook.ParseCertManagerOptions("", time.Hour)
+			require.EqualError(t, err, `invalid cert-manager cluster resource namespace "", must not be empty`)
+
+			_, err = certinjectionwebhook.ParseCertManagerOptions("cert-manager", -time.Hour)
+			require.EqualError(t, err, `invalid CA rotation overlap "-1h0m0s", must not be negative`)
+		})
+	})
+}
+
+// makeLeafCert returns a certificate that is not a CA.
+func makeLeafCert(t *testing.T, cn string) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
@@ -0,0 +1,323 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+)
+
+// InjectedLabel marks the pods the webhook injected, which are watched for
+// CA bundles that are no longer current.
+const InjectedLabel = "cert-injection.tanzu.vmware.com/injected"
+
+const reasonCABundleStale = "CABundleStale"
+
+// stalePodsDescriptor describes the metric of the pods injected with a CA
+// bundle that is no longer current.
+var stalePodsDescriptor = metricdata.Descriptor{
+	Name:        "stale_pods",
+	Description: "The number of running pods injected with a CA bundle that is no longer current",
+	Unit:        metricdata.UnitDimensionless,
+	Type:        metricdata.TypeGaugeInt64,
+	LabelKeys: []metricdata.LabelKey{
+		{Key: "namespace", Description: "The namespace of the pods"},
+		{Key: "owner_kind", Description: "The kind of the workload the pods belong to"},
+		{Key: "owner_name", Description: "The name of the workload the pods belong to"},
+	},
+}
+
+// StaleBundleDetector compares the CA bundle recorded on the injected pods
+// with the current bundle of the selector that matched them. It keeps an
+// inventory of the running pods that need a restart to trust the current
+// bundle.
+type StaleBundleDetector struct {
+	podLister corelisters.PodLister
+	recorder  record.EventRecorder
+
+	// resync enqueues all injected pods for reconciliation.
+	resync func()
+
+	// enqueue enqueues the injected pod with the key for reconciliation.
+	enqueue func(key types.NamespacedName)
+
+	// restart enqueues the stale pod with the key for the Restarter. It is
+	// nil unless workloads are restarted automatically.
+	restart func(key types.NamespacedName)
+
+	// extra adds the extra CA certificates of the namespace of a pod to the
+	// bundle of its selector. It is set by NewExtraCABundles.
+	extra *ExtraCABundles
+
+	lock sync.Mutex
+
+	// bundles are the current bundles by selector.
+	bundles map[string]string
+
+	// inherited are the selectors whose pods are injected with the bundle
+	// of defaultSelector, such as policies without a cert source.
+	inherited map[string]bool
+
+	// stale are the stale pods by key.
+	stale map[types.NamespacedName]stalePod
+}
+
+// stalePod is a pod injected with a CA bundle that is no longer current.
+type stalePod struct {
+	owner workload
+
+	// current is the fingerprint of the bundle the pod was reported as stale
+	// against.
+	current string
+}
+
+// workload is the kind and name of the workload a pod belongs to. Both are
+// empty for pods without a controller.
+type workload struct {
+	kind, name string
+}
+
+func NewStaleBundleDetector(podLister corelisters.PodLister, recorder record.EventRecorder) *StaleBundleDetector {
+	return &StaleBundleDetector{
+		podLister: podLister,
+		recorder:  recorder,
+		bundles:   map[string]string{},
+		inherited: map[string]bool{},
+		stale:     map[types.NamespacedName]stalePod{},
+	}
+}
+
+// setBundle sets the current CA bundle of the selector and checks the
+// injected pods again if it changed.
+func (d *StaleBundleDetector) setBundle(selector, caCertsData string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	current, ok := d.bundles[selector]
+	inherited := d.inherited[selector]
+	d.bundles[selector] = caCertsData
+	delete(d.inherited, selector)
+	d.lock.Unlock()
+
+	if !ok || inherited || current != caCertsData {
+		d.resyncAll()
+	}
+}
+
+// inheritBundle makes the bundle of defaultSelector the current CA bundle
+// of the selector and checks the injected pods again if it changed.
+func (d *StaleBundleDetector) inheritBundle(selector string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	inherited := d.inherited[selector]
+	d.inherited[selector] = true
+	delete(d.bundles, selector)
+	d.lock.Unlock()
+
+	if !inherited {
+		d.resyncAll()
+	}
+}
+
+// resyncAll checks all injected pods again.
+func (d *StaleBundleDetector) resyncAll() {
+	if d != nil && d.resync != nil {
+		d.resync()
+	}
+}
+
+// resyncNamespace checks the injected pods of the namespace again.
+func (d *StaleBundleDetector) resyncNamespace(namespace string) {
+	if d == nil || d.enqueue == nil {
+		return
+	}
+
+	pods, err := d.podLister.Pods(namespace).List(labels.Everything())
+	if err != nil {
+		return
+	}
+	for _, pod := range pods {
+		d.enqueue(types.NamespacedName{Namespace: pod.Namespace, Name: pod.Name})
+	}
+}
+
+// removeBundle forgets the bundle of the selector. The pods it matched are
+// no longer reported as stale.
+func (d *StaleBundleDetector) removeBundle(selector string) {
+	if d == nil {
+		return
+	}
+
+	d.lock.Lock()
+	_, ok := d.bundles[selector]
+	inherited := d.inherited[selector]
+	delete(d.bundles, selector)
+	delete(d.inherited, selector)
+	d.lock.Unlock()
+
+	if ok || inherited {
+		d.resyncAll()
+	}
+}
+
+// Reconcile checks whether the pod with the key was injected with the
+// current bundle of its selector, with the extra CA certificates of its
+// namespace, and emits an Event when it becomes stale. Pods whose selector
+// has no known bundle, such as the pods of deleted policies, are not
+// reported, nor are any pods until the extra CA certificates are loaded.
+func (d *StaleBundleDetector) Reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		return err
+	}
+	// The pods are checked again once the extra CA certificates are loaded.
+	if !d.extra.hasLoaded() {
+		return nil
+	}
+	podKey := types.NamespacedName{Namespace: namespace, Name: name}
+
+	pod, err := d.podLister.Pods(namespace).Get(name)
+	if apierrors.IsNotFound(err) {
+		d.forget(podKey)
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var injected injectionRecord
+	if pod.Status.Phase == corev1.PodSucceeded || pod.Status.Phase == corev1.PodFailed ||
+		json.Unmarshal([]byte(pod.Annotations[InjectedAnnotation]), &injected) != nil {
+		d.forget(podKey)
+		return nil
+	}
+
+	d.lock.Lock()
+	selector := injected.Selector
+	if d.inherited[selector] {
+		selector = defaultSelector
+	}
+	bundle, ok := d.bundles[selector]
+	d.lock.Unlock()
+	current := bundleSHA256(d.extra.bundle(namespace, bundle))
+
+	d.lock.Lock()
+	if !ok || current == injected.BundleSHA256 {
+		delete(d.stale, podKey)
+		d.lock.Unlock()
+		return nil
+	}
+	previous, reported := d.stale[podKey]
+	d.stale[podKey] = stalePod{owner: workloadOf(pod), current: current}
+	d.lock.Unlock()
+
+	if d.recorder != nil && (!reported || previous.current != current) {
+		d.recorder.Event(pod, corev1.EventTypeWarning, reasonCABundleStale, staleMessage(injected, current))
+	}
+	if d.restart != nil {
+		d.restart(podKey)
+	}
+	return nil
+}
+
+// current returns the fingerprint of the current bundle the pod with the
+// key is stale against, or false if it is not stale.
+func (d *StaleBundleDetector) current(key types.NamespacedName) (string, bool) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	p, ok := d.stale[key]
+	return p.current, ok
+}
+
+func (d *StaleBundleDetector) forget(key types.NamespacedName) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	delete(d.stale, key)
+}
+
+func staleMessage(injected injectionRecord, current string) string {
+	if current == "" {
+		return fmt.Sprintf("Pod was injected with CA bundle %s, %s no longer injects a CA bundle, restart the pod to remove it",
+			bundleOrNone(injected.BundleSHA256), injected.Selector)
+	}
+	return fmt.Sprintf("Pod was injected with CA bundle %s, the current CA bundle of %s is %s, restart the pod to trust it",
+		bundleOrNone(injected.BundleSHA256), injected.Selector, current)
+}
+
+func bundleOrNone(sha string) string {
+	if sha == "" {
+		return "none"
+	}
+	return sha
+}
+
+// workloadOf returns the workload the pod belongs to. Pods of the
+// ReplicaSets of Deployments belong to the Deployment.
+func workloadOf(pod *corev1.Pod) workload {
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil {
+		return workload{}
+	}
+
+	if owner.Kind == "ReplicaSet" {
+		if hash := pod.Labels[appsv1.DefaultDeploymentUniqueLabelKey]; hash != "" {
+			if deployment, ok := strings.CutSuffix(owner.Name, "-"+hash); ok {
+				return workload{kind: "Deployment", name: deployment}
+			}
+		}
+	}
+	return workload{kind: owner.Kind, name: owner.Name}
+}
+
+// Read implements metricproducer.Producer with the number of stale pods by
+// namespace and workload.
+func (d *StaleBundleDetector) Read() []*metricdata.Metric {
+	now := time.Now()
+
+	type group struct {
+		namespace string
+		owner     workload
+	}
+
+	d.lock.Lock()
+	counts := map[group]int64{}
+	for key, p := range d.stale {
+		counts[group{key.Namespace, p.owner}]++
+	}
+	d.lock.Unlock()
+
+	series := make([]*metricdata.TimeSeries, 0, len(counts))
+	for g, count := range counts {
+		series = append(series, &metricdata.TimeSeries{
+			LabelValues: []metricdata.LabelValue{
+				metricdata.NewLabelValue(g.namespace),
+				metricdata.NewLabelValue(g.owner.kind),
+				metricdata.NewLabelValue(g.owner.name),
+			},
+			Points:    []metricdata.Point{metricdata.NewInt64Point(now, count)},
+			StartTime: now,
+		})
+	}
+
+	return []*metricdata.Metric{{Descriptor: stalePodsDescriptor, TimeSeries: series}}
+}
@@ -0,0 +1,148 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	"go.opencensus.io/metric/metricdata"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestStaleBundleDetector(t *testing.T) {
+	spec.Run(t, "Stale Bundle Detector", testStaleBundleDetector)
+}
+
+func testStaleBundleDetector(t *testing.T, when spec.G, it spec.S) {
+	const (
+		label = "some/label"
+		key   = "some-namespace/some-deployment-5d8f7c6b9-x2x4z"
+	)
+
+	var (
+		ctx         = context.TODO()
+		caCertsData string
+		indexer     cache.Indexer
+		recorder    *record.FakeRecorder
+		detector    *certinjectionwebhook.StaleBundleDetector
+		ac          caCertsAdmitter
+	)
+
+	it.Before(func() {
+		caCertsData = makeCert(t, "some-ca")
+		indexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		recorder = record.NewFakeRecorder(10)
+		detector = certinjectionwebhook.NewStaleBundleDetector(corelisters.NewPodLister(indexer), recorder)
+
+		var err error
+		ac, err = certinjectionwebhook.NewAdmissionController("some-webhook", "/some-path", nil, certinjectionwebhook.AdmissionOptions{
+			Labels:            []string{label},
+			SetupCACertsImage: "some-ca-certs-image",
+			CACertsData:       caCertsData,
+			Stale:             detector,
+		})
+		require.NoError(t, err)
+	})
+
+	// inject admits the pod of a Deployment and adds the injected pod to the
+	// lister.
+	inject := func() *corev1.Pod {
+		controller := true
+		pod := &corev1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Namespace: "some-namespace",
+				Name:      "some-deployment-5d8f7c6b9-x2x4z",
+				Labels:    map[string]string{label: "", "pod-template-hash": "5d8f7c6b9"},
+				OwnerReferences: []metav1.OwnerReference{{
+					APIVersion: "apps/v1",
+					Kind:       "ReplicaSet",
+					Name:       "some-deployment-5d8f7c6b9",
+					Controller: &controller,
+				}},
+			},
+			Spec: corev1.PodSpec{
+				Containers: []corev1.Container{{Name: "app", Image: "app"}},
+			},
+		}
+		injected := admitPod(t, ctx, ac, pod, false)
+		require.Equal(t, "true", injected.Labels[certinjectionwebhook.InjectedLabel])
+		require.NoError(t, indexer.Add(injected))
+		return injected
+	}
+
+	it("does not report pods injected with the current bundle", func() {
+		inject()
+
+		require.NoError(t, detector.Reconcile(ctx, key))
+		require.Empty(t, recorder.Events)
+		require.Empty(t, detector.Read()[0].TimeSeries)
+	})
+
+	it("reports pods injected with a bundle that changed since", func() {
+		inject()
+		updated := makeCert(t, "updated-ca")
+		ac.UpdateCaCertsData(updated)
+
+		require.NoError(t, detector.Reconcile(ctx, key))
+		require.Len(t, recorder.Events, 1)
+		require.Equal(t, fmt.Sprintf("Warning CABundleStale Pod was injected with CA bundle %s, the current CA bundle of default is %s, restart the pod to trust it",
+			bundleSHA(caCertsData), bundleSHA(updated)), <-recorder.Events)
+
+		metrics := detector.Read()
+		require.Len(t, metrics, 1)
+		require.Equal(t, "stale_pods", metrics[0].Descriptor.Name)
+		require.Len(t, metrics[0].TimeSeries, 1)
+		require.Equal(t, []metricdata.LabelValue{
+			metricdata.NewLabelValue("some-namespace"),
+			metricdata.NewLabelValue("Deployment"),
+			metricdata.NewLabelValue("some-deployment"),
+		}, metrics[0].TimeSeries[0].LabelValues)
+		require.Equal(t, int64(1), metrics[0].TimeSeries[0].Points[0].Value)
+
+		require.NoError(t, detector.Reconcile(ctx, key))
+		require.Empty(t, recorder.Events)
+	})
+
+	it("stops reporting pods once the bundle is restored or they are gone", func() {
+		pod := inject()
+		ac.UpdateCaCertsData(makeCert(t, "updated-ca"))
+		require.NoError(t, detector.Reconcile(ctx, key))
+		<-recorder.Events
+
+		ac.UpdateCaCertsData(caCertsData)
+		require.NoError(t, detector.Reconcile(ctx, key))
+		require.Empty(t, detector.Read()[0].TimeSeries)
+
+		ac.UpdateCaCertsData("")
+		require.NoError(t, detector.Reconcile(ctx, key))
+		require.Len(t, detector.Read()[0].TimeSeries, 1)
+		require.Equal(t, fmt.Sprintf("Warning CABundleStale Pod was injected with CA bundle %s, default no longer injects a CA bundle, restart the pod to remove it",
+			bundleSHA(caCertsData)), <-recorder.Events)
+
+		require.NoError(t, indexer.Delete(pod))
+		require.NoError(t, detector.Reconcile(ctx, key))
+		require.Empty(t, detector.Read()[0].TimeSeries)
+	})
+
+	it("does not report pods that have completed", func() {
+		pod := inject()
+		pod.Status.Phase = corev1.PodSucceeded
+		require.NoError(t, indexer.Update(pod))
+		ac.UpdateCaCertsData(makeCert(t, "updated-ca"))
+
+		require.NoError(t, detector.Reconcile(ctx, key))
+		require.Empty(t, recorder.Events)
+		require.Empty(t, detector.Read()[0].TimeSeries)
+	})
+}
@@ -0,0 +1,111 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+
+	jp "github.com/evanphx/json-patch/v5"
+	"github.com/stretchr/testify/require"
+	admissionv1 "k8s.io/api/admission/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	wtesting "knative.dev/pkg/webhook/testing"
+)
+
+// caCertsAdmitter is the part of the admission controller the tests use.
+type caCertsAdmitter interface {
+	Admit(context.Context, *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse
+	UpdateCaCertsData(string)
+}
+
+// testCACert is a CA certificate for tests that check the bundle as is. It
+// is valid for a hundred years.
+const testCACert = `-----BEGIN CERTIFICATE-----
+MIIBjDCCATGgAwIBAgIUXsNVZlEHjCESxfY330uuu+ytY58wCgYIKoZIzj0EAwIw
+EjEQMA4GA1UEAwwHdGVzdC1jYTAgFw0yNjEwMTYxODMzNDRaGA8yMTI2MDkyMjE4
+MzM0NFowEjEQMA4GA1UEAwwHdGVzdC1jYTBZMBMGByqGSM49AgEGCCqGSM49AwEH
+A0IABOLxLza8ltkYxC+rnA71+nSy2AxArXs3/jhHwvGcPnF3+RuRnxs4+GulnZId
+pkMDscaosN7v3zxg2xAkSP0D00WjYzBhMB0GA1UdDgQWBBS2hVGUXOyKkxMQpf2L
+y8I8YaNtMDAfBgNVHSMEGDAWgBS2hVGUXOyKkxMQpf2Ly8I8YaNtMDAPBgNVHRMB
+Af8EBTADAQH/MA4GA1UdDwEB/wQEAwICBDAKBggqhkjOPQQDAgNJADBGAiEAqij3
+8hha1eaLZjkSv0ld/gM4ADsczB+nvg+9eVJrldQCIQCKot0YvphBDKEy+fQ2R8dL
+C7I8fULzkZvjxVzlhnUKXg==
+-----END CERTIFICATE-----
+`
+
+func makeCert(t *testing.T, cn string) string {
+	t.Helper()
+	return makeExpiringCert(t, cn, time.Now().AddDate(1, 0, 0))
+}
+
+func makeExpiringCert(t *testing.T, cn string, notAfter time.Time) string {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: cn},
+		NotBefore:             notAfter.AddDate(-1, 0, 0),
+		NotAfter:              notAfter,
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+}
+
+// admitPod admits the creation of the pod in its namespace and returns the
+// patched pod, or nil if the admission controller did not patch it.
+func admitPod(t *testing.T, ctx context.Context, ac caCertsAdmitter, pod *corev1.Pod, dryRun bool) *corev1.Pod {
+	t.Helper()
+
+	bytes, err := json.Marshal(pod)
+	require.NoError(t, err)
+
+	response := ac.Admit(ctx, &admissionv1.AdmissionRequest{
+		Namespace: pod.Namespace,
+		Object:    runtime.RawExtension{Raw: bytes},
+		Operation: admissionv1.Create,
+		Resource:  metav1.GroupVersionResource{Version: "v1", Resource: "pods"},
+		DryRun:    &dryRun,
+	})
+	wtesting.ExpectAllowed(t, response)
+	if response.Patch == nil {
+		return nil
+	}
+
+	patch, err := jp.DecodePatch(response.Patch)
+	require.NoError(t, err)
+	patched, err := patch.Apply(bytes)
+	require.NoError(t, err)
+
+	var result corev1.Pod
+	require.NoError(t, json.Unmarshal(patched, &result))
+	return &result
+}
+
+// bundleSHA returns the fingerprint of the bundle recorded on injected pods.
+func bundleSHA(caCertsData string) string {
+	sum := sha256.Sum256([]byte(caCertsData))
+	return hex.EncodeToString(sum[:])
+}
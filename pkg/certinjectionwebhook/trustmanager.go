@@ -0,0 +1,258 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/logging"
+	"knative.dev/pkg/system"
+)
+
+const (
+	CASourceKindBundle = "Bundle"
+
+	// PublishedLabel marks the ConfigMaps and Secrets the webhook publishes
+	// its bundle to.
+	PublishedLabel = "cert-injection.tanzu.vmware.com/published"
+)
+
+// bundleResource is the trust-manager Bundle, which is read as unstructured
+// so that its CRD is not needed.
+var bundleResource = schema.GroupVersionResource{Group: "trust.cert-manager.io", Version: "v1alpha1", Resource: "bundles"}
+
+// loadBundle returns the certificates of the target of the trust-manager
+// Bundle in the system namespace, the ConfigMap or Secret named after the
+// Bundle.
+func (s *CASourceSet) loadBundle(ctx context.Context, source CASource) ([]byte, error) {
+	bundle, err := s.dynamicClient.Resource(bundleResource).Get(ctx, source.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	if key, _, _ := unstructured.NestedString(bundle.Object, "spec", "target", "configMap", "key"); key != "" {
+		s.setTarget(source, resolvedTarget{kind: CASourceKindConfigMap, name: source.Name})
+		cm, err := s.configMapLister.ConfigMaps(system.Namespace()).Get(source.Name)
+		if err != nil {
+			return nil, err
+		}
+		data, ok := cm.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("configmap %q is missing %q key", cm.Name, key)
+		}
+		return decodeCACerts([]byte(data))
+	}
+
+	if key, _, _ := unstructured.NestedString(bundle.Object, "spec", "target", "secret", "key"); key != "" {
+		s.setTarget(source, resolvedTarget{kind: CASourceKindSecret, name: source.Name})
+		secret, err := s.secretLister.Secrets(system.Namespace()).Get(source.Name)
+		if err != nil {
+			return nil, err
+		}
+		data, ok := secret.Data[key]
+		if !ok {
+			return nil, fmt.Errorf("secret %q is missing %q key", secret.Name, key)
+		}
+		return decodeCACerts(data)
+	}
+
+	return nil, fmt.Errorf("bundle %q has neither a ConfigMap nor a Secret target", source.Name)
+}
+
+// ParsePublishTarget parses the target the bundle is published to like
+// trust-manager does, configmap/<name>/<key> or secret/<name>/<key>.
+func ParsePublishTarget(value string) (CASource, error) {
+	source, ok := parseCASource(strings.TrimSpace(value))
+	if !ok || (source.Kind != CASourceKindConfigMap && source.Kind != CASourceKindSecret) || source.Key == "" {
+		return CASource{}, fmt.Errorf("invalid publish target %q, must be like configmap/<name>/<key> or secret/<name>/<key>", value)
+	}
+	return source, nil
+}
+
+// BundlePublisher writes the bundle injected by default to a key of a
+// ConfigMap or Secret in every selected namespace, the format of the
+// targets of trust-manager Bundles. Objects of the same name that the
+// webhook did not create are left alone. Implements controller.Reconciler
+type BundlePublisher struct {
+	target   CASource
+	selector labels.Selector
+
+	client          kubernetes.Interface
+	namespaceLister corelisters.NamespaceLister
+
+	// configMapLister and secretLister list the objects with the
+	// PublishedLabel.
+	configMapLister corelisters.ConfigMapLister
+	secretLister    corelisters.SecretLister
+
+	// enqueue is set by NewPublishController.
+	enqueue func(namespace, name string)
+
+	lock sync.Mutex
+
+	// bundle is the bundle to publish, nil until it is known.
+	bundle *string
+}
+
+func NewBundlePublisher(
+	target CASource,
+	selector labels.Selector,
+	client kubernetes.Interface,
+	namespaceLister corelisters.NamespaceLister,
+	configMapLister corelisters.ConfigMapLister,
+	secretLister corelisters.SecretLister,
+) *BundlePublisher {
+	return &BundlePublisher{
+		target:          target,
+		selector:        selector,
+		client:          client,
+		namespaceLister: namespaceLister,
+		configMapLister: configMapLister,
+		secretLister:    secretLister,
+	}
+}
+
+// setBundle publishes caCertsData to the selected namespaces.
+func (p *BundlePublisher) setBundle(caCertsData string) {
+	if p == nil {
+		return
+	}
+
+	p.lock.Lock()
+	changed := p.bundle == nil || *p.bundle != caCertsData
+	p.bundle = &caCertsData
+	p.lock.Unlock()
+
+	if !changed || p.enqueue == nil {
+		return
+	}
+	namespaces, err := p.namespaceLister.List(p.selector)
+	if err != nil {
+		return
+	}
+	for _, ns := range namespaces {
+		p.enqueue(ns.Name, p.target.Name)
+	}
+}
+
+// Reconcile creates or updates the target with the key in a selected
+// namespace and deletes it from the other namespaces.
+func (p *BundlePublisher) Reconcile(ctx context.Context, key string) error {
+	namespace, name, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil || name != p.target.Name {
+		return err
+	}
+
+	p.lock.Lock()
+	bundle := p.bundle
+	p.lock.Unlock()
+	if bundle == nil {
+		return nil
+	}
+
+	ns, err := p.namespaceLister.Get(namespace)
+	if err != nil && !apierrors.IsNotFound(err) {
+		return err
+	}
+	if ns == nil || ns.DeletionTimestamp != nil || !p.selector.Matches(labels.Set(ns.Labels)) {
+		return p.delete(ctx, namespace)
+	}
+
+	if p.target.Kind == CASourceKindSecret {
+		return p.publishSecret(ctx, namespace, *bundle)
+	}
+	return p.publishConfigMap(ctx, namespace, *bundle)
+}
+
+func (p *BundlePublisher) publishConfigMap(ctx context.Context, namespace, bundle string) error {
+	existing, err := p.configMapLister.ConfigMaps(namespace).Get(p.target.Name)
+	if apierrors.IsNotFound(err) {
+		_, err = p.client.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: p.objectMeta(namespace),
+			Data:       map[string]string{p.target.Key: bundle},
+		}, metav1.CreateOptions{})
+		return p.ignoreForeign(ctx, namespace, err)
+	} else if err != nil {
+		return err
+	}
+
+	if value, ok := existing.Data[p.target.Key]; ok && value == bundle && len(existing.Data) == 1 {
+		return nil
+	}
+	updated := existing.DeepCopy()
+	updated.Data = map[string]string{p.target.Key: bundle}
+	_, err = p.client.CoreV1().ConfigMaps(namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+func (p *BundlePublisher) publishSecret(ctx context.Context, namespace, bundle string) error {
+	existing, err := p.secretLister.Secrets(namespace).Get(p.target.Name)
+	if apierrors.IsNotFound(err) {
+		_, err = p.client.CoreV1().Secrets(namespace).Create(ctx, &corev1.Secret{
+			ObjectMeta: p.objectMeta(namespace),
+			Data:       map[string][]byte{p.target.Key: []byte(bundle)},
+		}, metav1.CreateOptions{})
+		return p.ignoreForeign(ctx, namespace, err)
+	} else if err != nil {
+		return err
+	}
+
+	if value, ok := existing.Data[p.target.Key]; ok && string(value) == bundle && len(existing.Data) == 1 {
+		return nil
+	}
+	updated := existing.DeepCopy()
+	updated.Data = map[string][]byte{p.target.Key: []byte(bundle)}
+	_, err = p.client.CoreV1().Secrets(namespace).Update(ctx, updated, metav1.UpdateOptions{})
+	return err
+}
+
+// delete deletes the target the webhook published to the namespace.
+func (p *BundlePublisher) delete(ctx context.Context, namespace string) error {
+	var err error
+	if p.target.Kind == CASourceKindSecret {
+		if _, err = p.secretLister.Secrets(namespace).Get(p.target.Name); err == nil {
+			err = p.client.CoreV1().Secrets(namespace).Delete(ctx, p.target.Name, metav1.DeleteOptions{})
+		}
+	} else {
+		if _, err = p.configMapLister.ConfigMaps(namespace).Get(p.target.Name); err == nil {
+			err = p.client.CoreV1().ConfigMaps(namespace).Delete(ctx, p.target.Name, metav1.DeleteOptions{})
+		}
+	}
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	return err
+}
+
+// ignoreForeign logs rather than returns the error of creating a target
+// that exists without the PublishedLabel, e.g. because trust-manager
+// publishes a Bundle of the same name.
+func (p *BundlePublisher) ignoreForeign(ctx context.Context, namespace string, err error) error {
+	if apierrors.IsAlreadyExists(err) {
+		logging.FromContext(ctx).Warnf("Not publishing the CA bundle to %s %s/%s, which the webhook did not create",
+			strings.ToLower(p.target.Kind), namespace, p.target.Name)
+		return nil
+	}
+	return err
+}
+
+func (p *BundlePublisher) objectMeta(namespace string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Namespace: namespace,
+		Name:      p.target.Name,
+		Labels:    map[string]string{PublishedLabel: "true"},
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	k8sfake "k8s.io/client-go/kubernetes/fake"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certinjectionwebhook"
+)
+
+func TestBundlePublisher(t *testing.T) {
+	spec.Run(t, "Bundle Publisher", testBundlePublisher)
+}
+
+func testBundlePublisher(t *testing.T, when spec.G, it spec.S) {
+	const (
+		namespace = "some-namespace"
+		name      = "cert-injection-ca-bundle"
+		key       = "ca-certificates.crt"
+	)
+
+	var (
+		ctx              = context.TODO()
+		caCertsData      string
+		namespaceIndexer cache.Indexer
+		configMapIndexer cache.Indexer
+		secretIndexer    cache.Indexer
+		client           *k8sfake.Clientset
+	)
+
+	it.Before(func() {
+		caCertsData = makeCert(t, "some-ca")
+		namespaceIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		configMapIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		secretIndexer = cache.NewIndexer(cache.MetaNamespaceKeyFunc, cache.Indexers{})
+		client = k8sfake.NewSimpleClientset()
+
+		require.NoError(t, namespaceIndexer.Add(&corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{Name: namespace, Labels: map[string]string{"trust": "enabled"}},
+		}))
+	})
+
+	// newPublisher returns the publisher of the bundle of an admission
+	// controller, which is returned as well.
+	newPublisher := func(target, selector string) (*certinjectionwebhook.BundlePublisher, caCertsAdmitter) {
+		source, err := certinjectionwebhook.ParsePublishTarget(target)
+		require.NoError(t, err)
+		s, err := labels.Parse(selector)
+		require.NoError(t, err)
+
+		publisher := certinjectionwebhook.NewBundlePublisher(source, s, client,
+			corelisters.NewNamespaceLister(namespaceIndexer),
+			corelisters.NewConfigMapLister(configMapIndexer),
+			corelisters.NewSecretLister(secretIndexer))
+
+		ac, err := certinjectionwebhook.NewAdmissionController("some-webhook", "/some-path", nil, certinjectionwebhook.AdmissionOptions{
+			Labels:            []string{"some/label"},
+			SetupCACertsImage: "some-ca-certs-image",
+			Publisher:         publisher,
+		})
+		require.NoError(t, err)
+		return publisher, ac
+	}
+
+	reconcile := func(publisher *certinjectionwebhook.BundlePublisher) {
+		require.NoError(t, publisher.Reconcile(ctx, namespace+"/"+name))
+	}
+
+	getConfigMap := func() *corev1.ConfigMap {
+		cm, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		return cm
+	}
+
+	// syncIndexer adds the published ConfigMap to the lister.
+	syncIndexer := func() {
+		require.NoError(t, configMapIndexer.Add(getConfigMap()))
+	}
+
+	it("does not publish until the bundle is known", func() {
+		publisher, _ := newPublisher("configmap/"+name+"/"+key, "")
+		reconcile(publisher)
+
+		list, err := client.CoreV1().ConfigMaps(namespace).List(ctx, metav1.ListOptions{})
+		require.NoError(t, err)
+		require.Empty(t, list.Items)
+	})
+
+	it("publishes the bundle to a ConfigMap and updates it when the bundle changes", func() {
+		publisher, ac := newPublisher("configmap/"+name+"/"+key, "")
+		ac.UpdateCaCertsData(caCertsData)
+		reconcile(publisher)
+
+		cm := getConfigMap()
+		require.Equal(t, "true", cm.Labels[certinjectionwebhook.PublishedLabel])
+		require.Equal(t, map[string]string{key: caCertsData}, cm.Data)
+
+		syncIndexer()
+		other := makeCert(t, "other-ca")
+		ac.UpdateCaCertsData(other)
+		reconcile(publisher)
+
+		require.Equal(t, map[string]string{key: other}, getConfigMap().Data)
+	})
+
+	it("publishes the bundle to a Secret", func() {
+		publisher, ac := newPublisher("secret/"+name+"/"+key, "")
+		ac.UpdateCaCertsData(caCertsData)
+		reconcile(publisher)
+
+		secret, err := client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		require.NoError(t, err)
+		require.Equal(t, "true", secret.Labels[certinjectionwebhook.PublishedLabel])
+		require.Equal(t, map[string][]byte{key: []byte(caCertsData)}, secret.Data)
+	})
+
+	it("deletes the bundle from namespaces that are no longer selected", func() {
+		publisher, ac := newPublisher("configmap/"+name+"/"+key, "trust=enabled")
+		ac.UpdateCaCertsData(caCertsData)
+		reconcile(publisher)
+		syncIndexer()
+
+		require.NoError(t, namespaceIndexer.Update(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: namespace}}))
+		reconcile(publisher)
+
+		_, err := client.CoreV1().ConfigMaps(namespace).Get(ctx, name, metav1.GetOptions{})
+		require.True(t, apierrors.IsNotFound(err))
+	})
+
+	it("leaves objects of the same name it did not create", func() {
+		_, err := client.CoreV1().ConfigMaps(namespace).Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{Namespace: namespace, Name: name},
+			Data:       map[string]string{key: "trust-manager"},
+		}, metav1.CreateOptions{})
+		require.NoError(t, err)
+
+		publisher, ac := newPublisher("configmap/"+name+"/"+key, "")
+		ac.UpdateCaCertsData(caCertsData)
+		reconcile(publisher)
+
+		require.Equal(t, map[string]string{key: "trust-manager"}, getConfigMap().Data)
+	})
+
+	when("ParsePublishTarget", func() {
+		it("parses ConfigMap and Secret keys", func() {
+			target, err := certinjectionwebhook.ParsePublishTarget("secret/" + name + "/" + key)
+			require.NoError(t, err)
+			require.Equal(t, certinjectionwebhook.CASource{Kind: "Secret", Name: name, Key: key}, target)
+		})
+
+		it("rejects targets without a key and other kinds", func() {
+			for _, value := range []string{"secret/" + name, "bundle/" + name, "configmap//" + key, name} {
+				_, err := certinjectionwebhook.ParsePublishTarget(value)
+				require.EqualError(t, err, `invalid publish target "`+value+`", must be like configmap/<name>/<key> or secret/<name>/<key>`)
+			}
+		})
+	})
+}
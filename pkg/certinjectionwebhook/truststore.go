@@ -0,0 +1,73 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionwebhook
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+// TrustStoreAnnotation selects the trust store strategy of a pod: debian,
+// rhel, alpine or suse. It takes precedence over the strategy of the policy.
+const TrustStoreAnnotation = "cert-injection.tanzu.vmware.com/trust-store"
+
+// trustStoreStrategy returns the strategy set by the pod annotation or else
+// the strategy with the name.
+func trustStoreStrategy(pod *corev1.Pod, name string) (certs.Strategy, error) {
+	if annotation, ok := pod.Annotations[TrustStoreAnnotation]; ok {
+		strategy, err := certs.StrategyFor(annotation)
+		if err != nil {
+			return certs.Strategy{}, fmt.Errorf("invalid %s annotation: %v", TrustStoreAnnotation, err)
+		}
+		return strategy, nil
+	}
+	return certs.StrategyFor(name)
+}
+
+// injectedTrustStoreStrategy returns the strategy the setup-ca-certs init
+// container of the pod was configured with or, in configmap mode, the
+// strategy the ca-certs volume lays the trust store out for.
+func injectedTrustStoreStrategy(pod *corev1.Pod) (certs.Strategy, error) {
+	for _, v := range pod.Spec.Volumes {
+		if v.Name != caCertsVolumeName || v.ConfigMap == nil {
+			continue
+		}
+		if strategy, ok := certs.StrategyForItems(certsItems(v.ConfigMap.Items)); ok {
+			return strategy, nil
+		}
+	}
+	return certs.StrategyFor(setupCACertsEnv(pod, certs.StrategyEnv))
+}
+
+// setupCACertsEnv returns the value of the env var of the init containers of
+// the pod that populate the ca-certs volume.
+func setupCACertsEnv(pod *corev1.Pod, name string) string {
+	for _, c := range pod.Spec.InitContainers {
+		if !isCACertsInitContainer(c.Name) {
+			continue
+		}
+		for _, e := range c.Env {
+			if e.Name == name {
+				return e.Value
+			}
+		}
+	}
+	return ""
+}
+
+func caCertsVolumeMounts(strategy certs.Strategy) []corev1.VolumeMount {
+	var mounts []corev1.VolumeMount
+	for _, m := range strategy.Mounts {
+		mounts = append(mounts, corev1.VolumeMount{
+			Name:      caCertsVolumeName,
+			MountPath: m.Path,
+			SubPath:   m.SubPath,
+			ReadOnly:  true,
+		})
+	}
+	return mounts
+}
@@ -5,15 +5,40 @@ package certinjectionwebhook
 
 import (
 	"context"
+	"time"
 
+	"go.opencensus.io/metric/metricproducer"
 	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
 	// Injection stuff
 	kubeclient "knative.dev/pkg/client/injection/kube/client"
 	mwhinformer "knative.dev/pkg/client/injection/kube/informers/admissionregistration/v1/mutatingwebhookconfiguration"
+	daemonsetinformer "knative.dev/pkg/client/injection/kube/informers/apps/v1/daemonset"
+	deploymentinformer "knative.dev/pkg/client/injection/kube/informers/apps/v1/deployment"
+	replicasetinformer "knative.dev/pkg/client/injection/kube/informers/apps/v1/replicaset"
+	statefulsetinformer "knative.dev/pkg/client/injection/kube/informers/apps/v1/statefulset"
+	filteredconfigmapinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/configmap/filtered"
+	namespaceinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/namespace"
+	filteredpodinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/pod/filtered"
+	filteredsecretinformer "knative.dev/pkg/client/injection/kube/informers/core/v1/secret/filtered"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	configmapinformer "knative.dev/pkg/injection/clients/namespacedkube/informers/core/v1/configmap"
 	secretinformer "knative.dev/pkg/injection/clients/namespacedkube/informers/core/v1/secret"
 
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+	policyinformer "github.com/vmware-tanzu/cert-injection-webhook/pkg/client/injection/informers/certinjection/v1alpha1/certinjectionpolicy"
+	namedconfigmapinformer "github.com/vmware-tanzu/cert-injection-webhook/pkg/client/injection/informers/core/v1/configmap/named"
+
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/configmap"
 	"knative.dev/pkg/controller"
+	"knative.dev/pkg/kmeta"
 	"knative.dev/pkg/logging"
 	"knative.dev/pkg/system"
 	"knative.dev/pkg/webhook"
@@ -24,19 +49,22 @@ type Webhook struct {
 	*admissionController
 }
 
+// NewController returns the controller of the webhook named name, which
+// injects the pods at path as configured by opts and by the ca-cert and
+// proxy ConfigMaps. sources, when set, add their certificates to the
+// bundle. opts.NamespaceLister is set from ctx.
 func NewController(
 	ctx context.Context,
+	cmw configmap.Watcher,
 	name, path string,
 	wc func(context.Context) context.Context,
-	labels []string,
-	annotations []string,
-	envVars []corev1.EnvVar,
-	caCertsData, setupCaCertsImage string,
-	imagePullSecrets corev1.LocalObjectReference,
+	sources *CASourceSet,
+	opts AdmissionOptions,
 ) (*controller.Impl, error) {
 	client := kubeclient.Get(ctx)
 	mwhInformer := mwhinformer.Get(ctx)
 	secretInformer := secretinformer.Get(ctx)
+	namespaceInformer := namespaceinformer.Get(ctx)
 	options := webhook.GetOptions(ctx)
 
 	r := NewReconciler(
@@ -46,23 +74,18 @@ func NewController(
 		mwhInformer.Lister(),
 		secretInformer.Lister(),
 		options.SecretName,
+		webhookNamespaceSelector(opts.NamespaceLabel),
 	)
 
-	ac, err := NewAdmissionController(
-		name,
-		path,
-		wc,
-		labels,
-		annotations,
-		envVars,
-		setupCaCertsImage,
-		caCertsData,
-		imagePullSecrets,
-	)
+	opts.NamespaceLister = namespaceInformer.Lister()
+	ac, err := NewAdmissionController(name, path, wc, opts)
 	if err != nil {
 		return nil, err
 	}
 
+	WatchConfigMaps(ctx, cmw, ac, sources)
+	metricproducer.GlobalManager().AddProducer(ac)
+
 	wh := Webhook{r, ac}
 
 	logger := logging.FromContext(ctx)
@@ -80,3 +103,252 @@ func NewController(
 
 	return c, nil
 }
+
+// NewPolicyController reconciles CertInjectionPolicies into the policy set
+// evaluated by the admission controller.
+func NewPolicyController(ctx context.Context, policies *PolicySet, mirror *BundleMirror, expiry *ExpiryMonitor, stale *StaleBundleDetector) *controller.Impl {
+	policyInformer := policyinformer.Get(ctx)
+	configMapInformer := configmapinformer.Get(ctx)
+
+	r := NewPolicyReconciler(
+		dynamicclient.Get(ctx),
+		policyInformer.Lister(),
+		configMapInformer.Lister(),
+		policies,
+		mirror,
+		expiry,
+		stale,
+	)
+
+	logger := logging.FromContext(ctx)
+	c := controller.NewContext(ctx, r, controller.ControllerOptions{Logger: logger, WorkQueueName: "CertInjectionPolicies"})
+
+	policyInformer.Informer().AddEventHandler(controller.HandleAll(c.Enqueue))
+
+	// Policies may reference any ConfigMap in the system namespace.
+	configMapInformer.Informer().AddEventHandler(controller.HandleAll(func(interface{}) {
+		c.GlobalResync(policyInformer.Informer())
+	}))
+
+	return c
+}
+
+// NewMirrorController returns the mirror of the trust stores and the
+// controller that keeps their copies in the namespaces up to date. The
+// informer requires the MirrorLabel selector in the context.
+func NewMirrorController(ctx context.Context, systemCACerts []byte) (*controller.Impl, *BundleMirror) {
+	configMapInformer := filteredconfigmapinformer.Get(ctx, MirrorLabel)
+
+	mirror := NewBundleMirror(systemCACerts, kubeclient.Get(ctx), configMapInformer.Lister())
+
+	logger := logging.FromContext(ctx)
+	_, skipped := certs.NewTrustStore().AddSystem("system_ca", systemCACerts)
+	for _, err := range skipped {
+		logger.Warnf("Skipping system certificate: %v", err)
+	}
+	c := controller.NewContext(ctx, mirror, controller.ControllerOptions{Logger: logger, WorkQueueName: "TrustStoreMirrors"})
+
+	mirror.enqueue = func(namespace, name string) {
+		c.EnqueueKey(types.NamespacedName{Namespace: namespace, Name: name})
+	}
+
+	configMapInformer.Informer().AddEventHandler(controller.HandleAll(c.Enqueue))
+
+	return c, mirror
+}
+
+// NewExpiryController returns the monitor of the expiry of the injected
+// certificates and the controller that emits Events as they get within the
+// thresholds with the recorder. The monitor is registered as a producer of
+// metrics.
+func NewExpiryController(ctx context.Context, thresholds []time.Duration, recorder record.EventRecorder) (*controller.Impl, *ExpiryMonitor) {
+	monitor := NewExpiryMonitor(thresholds, recorder)
+	metricproducer.GlobalManager().AddProducer(monitor)
+
+	logger := logging.FromContext(ctx)
+	c := controller.NewContext(ctx, monitor, controller.ControllerOptions{Logger: logger, WorkQueueName: "CACertExpiry"})
+
+	monitor.enqueue = c.EnqueueKey
+
+	return c, monitor
+}
+
+// NewStaleBundleController returns the detector of the running pods injected
+// with a CA bundle that is no longer current and the controller that checks
+// the injected pods as they or the bundles change. Events are emitted with
+// the recorder. The detector is registered as a producer of metrics. The
+// informer requires the InjectedLabel selector in the context.
+func NewStaleBundleController(ctx context.Context, recorder record.EventRecorder) (*controller.Impl, *StaleBundleDetector) {
+	podInformer := filteredpodinformer.Get(ctx, InjectedLabel)
+
+	detector := NewStaleBundleDetector(podInformer.Lister(), recorder)
+	metricproducer.GlobalManager().AddProducer(detector)
+
+	logger := logging.FromContext(ctx)
+	c := controller.NewContext(ctx, detector, controller.ControllerOptions{Logger: logger, WorkQueueName: "StaleBundles"})
+
+	detector.resync = func() {
+		c.GlobalResync(podInformer.Informer())
+	}
+	detector.enqueue = c.EnqueueKey
+
+	podInformer.Informer().AddEventHandler(controller.HandleAll(c.Enqueue))
+
+	return c, detector
+}
+
+// NewCASourceController returns the set of the CA sources and the
+// controller that loads the Secrets and ConfigMaps of the sources as they
+// change and the indirect sources periodically.
+func NewCASourceController(ctx context.Context, sources []CASource, certManager CertManagerOptions) (*controller.Impl, *CASourceSet) {
+	secretInformer := secretinformer.Get(ctx)
+	configMapInformer := configmapinformer.Get(ctx)
+
+	set := NewCASourceSet(
+		sources,
+		certManager,
+		kubeclient.Get(ctx),
+		dynamicclient.Get(ctx),
+		secretInformer.Lister(),
+		configMapInformer.Lister(),
+	)
+
+	logger := logging.FromContext(ctx)
+	c := controller.NewContext(ctx, set, controller.ControllerOptions{Logger: logger, WorkQueueName: "CASources"})
+
+	secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool { return set.watches(CASourceKindSecret, obj) },
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+	configMapInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: func(obj interface{}) bool { return set.watches(CASourceKindConfigMap, obj) },
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+
+	// Every source is loaded once, even if its Secret or ConfigMap does not
+	// exist, as the bundle is held back until then. The cert-manager and
+	// trust-manager resources are not watched. Every reconciliation loads
+	// all indirect sources and requeues, so enqueuing one of them starts
+	// loading them periodically.
+	indirect := false
+	for _, source := range sources {
+		if source.indirect() {
+			if indirect {
+				continue
+			}
+			indirect = true
+		}
+		c.EnqueueKey(types.NamespacedName{Namespace: system.Namespace(), Name: source.Name})
+	}
+
+	return c, set
+}
+
+// NewPublishController returns the publisher of the bundle injected by
+// default and the controller that keeps the published ConfigMaps or Secrets
+// in the selected namespaces up to date. The informer of the target
+// requires the PublishedLabel selector in the context.
+func NewPublishController(ctx context.Context, target CASource, selector labels.Selector) (*controller.Impl, *BundlePublisher) {
+	namespaceInformer := namespaceinformer.Get(ctx)
+
+	var (
+		configMapLister corelisters.ConfigMapLister
+		secretLister    corelisters.SecretLister
+		targetInformer  cache.SharedIndexInformer
+	)
+	if target.Kind == CASourceKindSecret {
+		informer := filteredsecretinformer.Get(ctx, PublishedLabel)
+		secretLister, targetInformer = informer.Lister(), informer.Informer()
+	} else {
+		informer := filteredconfigmapinformer.Get(ctx, PublishedLabel)
+		configMapLister, targetInformer = informer.Lister(), informer.Informer()
+	}
+
+	publisher := NewBundlePublisher(target, selector, kubeclient.Get(ctx), namespaceInformer.Lister(), configMapLister, secretLister)
+
+	logger := logging.FromContext(ctx)
+	c := controller.NewContext(ctx, publisher, controller.ControllerOptions{Logger: logger, WorkQueueName: "PublishedBundles"})
+
+	publisher.enqueue = func(namespace, name string) {
+		c.EnqueueKey(types.NamespacedName{Namespace: namespace, Name: name})
+	}
+
+	namespaceInformer.Informer().AddEventHandler(controller.HandleAll(func(obj interface{}) {
+		if object, err := kmeta.DeletionHandlingAccessor(obj); err == nil {
+			publisher.enqueue(object.GetName(), target.Name)
+		}
+	}))
+	targetInformer.AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: controller.FilterWithName(target.Name),
+		Handler:    controller.HandleAll(c.Enqueue),
+	})
+
+	return c, publisher
+}
+
+// NewExtraCAController returns the extra CA certificates of the ConfigMaps
+// named name in every namespace and the controller that loads them as they
+// change. The informer requires the name in the context. They are all
+// loaded once the informer has synced, as the controller only starts then.
+func NewExtraCAController(ctx context.Context, name string, mirror *BundleMirror, stale *StaleBundleDetector) (*controller.Impl, *ExtraCABundles) {
+	configMapInformer := namedconfigmapinformer.Get(ctx, name)
+
+	extra := NewExtraCABundles(name, configMapInformer.Lister(), mirror, stale)
+
+	logger := logging.FromContext(ctx)
+	c := controller.NewContext(ctx, extra, controller.ControllerOptions{Logger: logger, WorkQueueName: "ExtraCACerts"})
+
+	configMapInformer.Informer().AddEventHandler(controller.HandleAll(c.Enqueue))
+	c.EnqueueKey(types.NamespacedName{Name: name})
+
+	return c, extra
+}
+
+// NewRestartController returns the controller that restarts the rollout of
+// the workloads that opted in once the detector reports their pods as stale.
+// Events are emitted with the recorder.
+func NewRestartController(ctx context.Context, options RestartOptions, stale *StaleBundleDetector, recorder record.EventRecorder) *controller.Impl {
+	r := NewRestarter(
+		options,
+		kubeclient.Get(ctx),
+		filteredpodinformer.Get(ctx, InjectedLabel).Lister(),
+		namespaceinformer.Get(ctx).Lister(),
+		WorkloadListers{
+			ReplicaSets:  replicasetinformer.Get(ctx).Lister(),
+			Deployments:  deploymentinformer.Get(ctx).Lister(),
+			StatefulSets: statefulsetinformer.Get(ctx).Lister(),
+			DaemonSets:   daemonsetinformer.Get(ctx).Lister(),
+		},
+		stale,
+		recorder,
+	)
+
+	logger := logging.FromContext(ctx)
+	c := controller.NewContext(ctx, r, controller.ControllerOptions{Logger: logger, WorkQueueName: "RolloutRestarts"})
+
+	stale.restart = c.EnqueueKey
+
+	return c
+}
+
+// NewEventRecorder returns the recorder of the context or one that emits the
+// Events to the API server until the context is done. Each recorder that is
+// created starts its own broadcaster, so the controllers share one.
+func NewEventRecorder(ctx context.Context) record.EventRecorder {
+	if recorder := controller.GetEventRecorder(ctx); recorder != nil {
+		return recorder
+	}
+
+	broadcaster := record.NewBroadcaster()
+	watches := []watch.Interface{
+		broadcaster.StartLogging(logging.FromContext(ctx).Named("event-broadcaster").Infof),
+		broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: kubeclient.Get(ctx).CoreV1().Events("")}),
+	}
+	go func() {
+		<-ctx.Done()
+		for _, w := range watches {
+			w.Stop()
+		}
+	}()
+	return broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: "cert-injection-webhook"})
+}
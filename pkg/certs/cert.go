@@ -1,21 +1,65 @@
 package certs
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/pem"
+	"errors"
 	"fmt"
 	"strings"
+	"time"
 )
 
+const certificateBlockType = "CERTIFICATE"
+
+var pemBegin = []byte("-----BEGIN ")
+
 // Split a single string of multiple certs into multiple strings of single
-// certs.
+// certs. PEM blocks other than certificates are dropped.
 func Split(certs string) []string {
 	var res []string
 	for block, data := pem.Decode([]byte(certs)); block != nil; block, data = pem.Decode(data) {
+		if block.Type != certificateBlockType {
+			continue
+		}
 		res = append(res, string(pem.EncodeToMemory(block)))
 	}
 	return res
 }
 
+// Certificate is what is known about a certificate of a bundle.
+type Certificate struct {
+	Subject  string
+	NotAfter time.Time
+
+	// SHA256 is the hex encoded fingerprint of the DER encoding.
+	SHA256 string
+}
+
+// Certificates returns the certificates of the bundle in their order. Blocks
+// that are not certificates or do not parse are skipped.
+func Certificates(bundle string) []Certificate {
+	var res []Certificate
+	for block, data := pem.Decode([]byte(bundle)); block != nil; block, data = pem.Decode(data) {
+		if block.Type != certificateBlockType {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		sum := sha256.Sum256(cert.Raw)
+		res = append(res, Certificate{
+			Subject:  cert.Subject.String(),
+			NotAfter: cert.NotAfter,
+			SHA256:   hex.EncodeToString(sum[:]),
+		})
+	}
+	return res
+}
+
 // Parse the environment variables satsifying the pattern and construct a list
 // of certs.
 func Parse(pattern string, environ []string) ([]string, error) {
@@ -37,7 +81,79 @@ func Parse(pattern string, environ []string) ([]string, error) {
 		if block == nil {
 			return nil, fmt.Errorf("cert not in pem format")
 		}
+		if _, err := ValidateBundle([]byte(fragment), time.Now()); err != nil {
+			return nil, fmt.Errorf("invalid %s: %v", name, err)
+		}
 
 		certs = append(certs, fragment)
 	}
 }
+
+// ValidateBundle checks that every PEM block of data is a certificate that
+// parses and that nothing but whitespace follows the last one. Text before
+// and between the blocks, like the comments of many bundles, is allowed.
+// Certificates that are not CAs or have expired by now are returned as
+// warnings. Problems are reported by the line of their block and its
+// position in the bundle.
+func ValidateBundle(data []byte, now time.Time) (warnings []string, err error) {
+	var errs []string
+	offset, n := 0, 0
+	for {
+		rest := data[offset:]
+		begin := bytes.Index(rest, pemBegin)
+		if begin < 0 {
+			if len(bytes.TrimSpace(rest)) > 0 {
+				errs = append(errs, fmt.Sprintf("line %d: trailing data after the last certificate", lineOf(data, offset+firstNonSpace(rest))))
+			}
+			break
+		}
+
+		start := offset + begin
+		n++
+		block, after := pem.Decode(data[start:])
+		end := len(data) - len(after)
+		// pem.Decode skips malformed blocks and returns the next one.
+		if block == nil || bytes.Contains(data[start+1:end], pemBegin) {
+			errs = append(errs, fmt.Sprintf("line %d: block %d is not a valid PEM block", lineOf(data, start), n))
+			break
+		}
+		offset = end
+
+		position := fmt.Sprintf("line %d: block %d", lineOf(data, start), n)
+		if block.Type != certificateBlockType {
+			if strings.Contains(block.Type, "KEY") {
+				errs = append(errs, fmt.Sprintf("%s is key material (%s), not a certificate", position, block.Type))
+			} else {
+				errs = append(errs, fmt.Sprintf("%s is a %s, not a certificate", position, block.Type))
+			}
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("%s is not a valid certificate: %v", position, err))
+			continue
+		}
+
+		if !cert.IsCA {
+			warnings = append(warnings, fmt.Sprintf("%s (%s) is not a CA certificate", position, cert.Subject))
+		}
+		if now.After(cert.NotAfter) {
+			warnings = append(warnings, fmt.Sprintf("%s (%s) expired on %s", position, cert.Subject, cert.NotAfter.UTC().Format(time.RFC3339)))
+		}
+	}
+
+	if len(errs) > 0 {
+		return warnings, errors.New(strings.Join(errs, "; "))
+	}
+	return warnings, nil
+}
+
+// lineOf returns the 1 based line of the byte at offset in data.
+func lineOf(data []byte, offset int) int {
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+func firstNonSpace(data []byte) int {
+	return len(data) - len(bytes.TrimLeft(data, " \t\r\n"))
+}
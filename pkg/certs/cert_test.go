@@ -10,6 +10,7 @@ import (
 	"io"
 	"math/big"
 	"math/rand"
+	"strings"
 	"testing"
 	"time"
 
@@ -81,6 +82,13 @@ func testCerts(t *testing.T, when spec.G, it spec.S) {
 			require.Equal(t, c3, c[2])
 		})
 
+		it("drops blocks that are not certificates", func() {
+			c1 := makeCaCert(t, prng)
+			key := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("some-key")}))
+
+			require.Equal(t, []string{c1}, certs.Split(c1+key))
+		})
+
 		it("ignores invalid certs", func() {
 			c1 := makeCaCert(t, prng)
 			c3 := makeCaCert(t, prng)
@@ -92,6 +100,86 @@ func testCerts(t *testing.T, when spec.G, it spec.S) {
 		})
 	})
 
+	when("Validating", func() {
+		makeCert := func(isCA bool, notAfter time.Time) string {
+			key, err := ecdsa.GenerateKey(elliptic.P256(), prng)
+			require.NoError(t, err)
+
+			template := &x509.Certificate{
+				SerialNumber:          big.NewInt(1),
+				Subject:               pkix.Name{CommonName: "some-cert"},
+				NotBefore:             notAfter.AddDate(-1, 0, 0),
+				NotAfter:              notAfter,
+				IsCA:                  isCA,
+				BasicConstraintsValid: true,
+			}
+			der, err := x509.CreateCertificate(prng, template, template, &key.PublicKey, key)
+			require.NoError(t, err)
+			return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}))
+		}
+
+		it("accepts CA certificates with comments around them", func() {
+			bundle := "# some bundle\n" + makeCaCert(t, prng) + "\nsome-ca\n=======\n" + makeCaCert(t, prng) + "\n\n"
+
+			warnings, err := certs.ValidateBundle([]byte(bundle), time.Now())
+			require.NoError(t, err)
+			require.Empty(t, warnings)
+		})
+
+		it("refuses key material", func() {
+			c1 := makeCaCert(t, prng)
+			key := string(pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: []byte("some-key")}))
+
+			_, err := certs.ValidateBundle([]byte(c1+key), time.Now())
+			line := strings.Count(c1, "\n") + 1
+			require.EqualError(t, err, fmt.Sprintf("line %d: block 2 is key material (EC PRIVATE KEY), not a certificate", line))
+		})
+
+		it("reports blocks that are not certificates", func() {
+			csr := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE REQUEST", Bytes: []byte("some-csr")}))
+			invalid := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("some-cert")}))
+
+			_, err := certs.ValidateBundle([]byte(csr+invalid), time.Now())
+			require.Error(t, err)
+			require.Contains(t, err.Error(), "line 1: block 1 is a CERTIFICATE REQUEST, not a certificate; line 4: block 2 is not a valid certificate: ")
+		})
+
+		it("reports trailing data and malformed blocks", func() {
+			c1 := makeCaCert(t, prng)
+
+			line := strings.Count(c1, "\n") + 1
+
+			_, err := certs.ValidateBundle([]byte(c1+"\n  garbage\n"), time.Now())
+			require.EqualError(t, err, fmt.Sprintf("line %d: trailing data after the last certificate", line+1))
+
+			_, err = certs.ValidateBundle([]byte(c1+"-----BEGIN CERTIFICATE-----\nMIIB"), time.Now())
+			require.EqualError(t, err, fmt.Sprintf("line %d: block 2 is not a valid PEM block", line))
+		})
+
+		it("lists the certificates that parse", func() {
+			expiry := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+			invalid := string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("some-cert")}))
+
+			c := certs.Certificates(makeCert(true, expiry) + invalid + makeCaCert(t, prng))
+			require.Len(t, c, 2)
+			require.Equal(t, "CN=some-cert", c[0].Subject)
+			require.Equal(t, expiry, c[0].NotAfter)
+			require.Len(t, c[0].SHA256, 64)
+			require.NotEqual(t, c[0].SHA256, c[1].SHA256)
+		})
+
+		it("warns about certificates that are not CAs or have expired", func() {
+			expiry := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+			bundle := makeCert(false, time.Now().AddDate(1, 0, 0)) + makeCert(true, expiry)
+
+			warnings, err := certs.ValidateBundle([]byte(bundle), time.Now())
+			require.NoError(t, err)
+			require.Len(t, warnings, 2)
+			require.Regexp(t, `^line 1: block 1 \(CN=some-cert\) is not a CA certificate$`, warnings[0])
+			require.Regexp(t, `^line \d+: block 2 \(CN=some-cert\) expired on 2020-01-01T00:00:00Z$`, warnings[1])
+		})
+	})
+
 	when("Parsing", func() {
 		it("parsing no cert", func() {
 			envs := []string{
@@ -124,6 +212,16 @@ func testCerts(t *testing.T, when spec.G, it spec.S) {
 			require.Error(t, err)
 		})
 
+		it("parsing key material", func() {
+			key := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("some-key")}))
+			envs := []string{
+				fmt.Sprintf("CA_CERT_DATA_0=%v", key),
+			}
+
+			_, err := certs.Parse("CA_CERT_DATA", envs)
+			require.EqualError(t, err, "invalid CA_CERT_DATA_0: line 1: block 1 is key material (PRIVATE KEY), not a certificate")
+		})
+
 		it("parsing multiple certs", func() {
 			c1 := makeCaCert(t, prng)
 			c2 := makeCaCert(t, prng)
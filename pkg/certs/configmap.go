@@ -0,0 +1,93 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certs
+
+import (
+	"fmt"
+	"path"
+)
+
+// JavaTrustStoreKey is the ConfigMap key of the PKCS#12 Java truststore.
+const JavaTrustStoreKey = "cacerts"
+
+// ConfigMap is a trust store as the keys of a ConfigMap. ConfigMaps cannot
+// hold directories or links, so the hash links are keys with a copy of the
+// certificate and Items lays the keys out the way a strategy expects.
+type ConfigMap struct {
+	Data       map[string]string
+	BinaryData map[string][]byte
+
+	links []string
+}
+
+// Item projects the ConfigMap key to Path in the volume.
+type Item struct {
+	Key  string
+	Path string
+}
+
+// ConfigMap returns the bundle, a copy of each certificate named after its
+// subject hash and the PKCS#12 Java truststore as ConfigMap keys.
+func (ts *TrustStore) ConfigMap() (*ConfigMap, error) {
+	truststore, err := ts.PKCS12(JavaTrustStorePassword)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encode %s truststore: %v", JavaTrustStorePKCS12, err)
+	}
+
+	cm := &ConfigMap{
+		Data:       map[string]string{BundleFileName: string(ts.Bundle())},
+		BinaryData: map[string][]byte{JavaTrustStoreKey: truststore},
+		links:      ts.hashLinks(),
+	}
+	for i, c := range ts.certs {
+		cm.Data[cm.links[i]] = string(c.pem)
+	}
+	return cm, nil
+}
+
+// Size returns the number of bytes of the keys and values.
+func (cm *ConfigMap) Size() int {
+	var size int
+	for k, v := range cm.Data {
+		size += len(k) + len(v)
+	}
+	for k, v := range cm.BinaryData {
+		size += len(k) + len(v)
+	}
+	return size
+}
+
+// Items returns the items that lay the keys out at the paths of the bundles,
+// certificate directories and Java truststore of strategy.
+func (cm *ConfigMap) Items(strategy Strategy) []Item {
+	var items []Item
+	for _, b := range strategy.Bundles {
+		items = append(items, Item{Key: BundleFileName, Path: b})
+	}
+	for _, d := range strategy.Dirs {
+		for _, link := range cm.links {
+			items = append(items, Item{Key: link, Path: path.Join(d, link)})
+		}
+	}
+	if strategy.JavaTrustStore != "" {
+		items = append(items, Item{Key: JavaTrustStoreKey, Path: strategy.JavaTrustStore})
+	}
+	return items
+}
+
+// StrategyForItems returns the strategy whose layout items were built for.
+// ok is false when no strategy puts the bundle where items do.
+func StrategyForItems(items []Item) (strategy Strategy, ok bool) {
+	for _, item := range items {
+		if item.Key != BundleFileName {
+			continue
+		}
+		for _, s := range strategies {
+			if s.Bundles[0] == item.Path {
+				return s, true
+			}
+		}
+	}
+	return Strategy{}, false
+}
@@ -0,0 +1,91 @@
+package certs_test
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+func TestConfigMap(t *testing.T) {
+	spec.Run(t, "ConfigMap", testConfigMap)
+}
+
+func testConfigMap(t *testing.T, when spec.G, it spec.S) {
+	// use insecure prng for certs since this is just a test
+	source := rand.NewSource(time.Now().UnixNano())
+	prng := rand.New(source)
+
+	var (
+		cm     *certs.ConfigMap
+		c1, c2 string
+		hash   string
+	)
+
+	it.Before(func() {
+		c1 = makeCaCert(t, prng)
+		c2 = makeCaCert(t, prng)
+
+		block, _ := pem.Decode([]byte(c1))
+		cert, err := x509.ParseCertificate(block.Bytes)
+		require.NoError(t, err)
+		h, err := certs.SubjectHash(cert)
+		require.NoError(t, err)
+		hash = fmt.Sprintf("%08x", h)
+
+		ts := certs.NewTrustStore()
+		_, err = ts.Add("system_ca", []byte(c1))
+		require.NoError(t, err)
+		_, err = ts.Add("cert_injection_webhook", []byte(c2+c1))
+		require.NoError(t, err)
+
+		cm, err = ts.ConfigMap()
+		require.NoError(t, err)
+	})
+
+	it("holds the bundle, a copy of each certificate per hash link and the java truststore", func() {
+		require.Equal(t, map[string]string{
+			"ca-certificates.crt": c1 + c2,
+			hash + ".0":           c1,
+			hash + ".1":           c2,
+		}, cm.Data)
+		require.Contains(t, cm.BinaryData, "cacerts")
+		require.Greater(t, cm.Size(), len(c1)+len(c2))
+	})
+
+	it("lays the keys out for a strategy", func() {
+		require.Equal(t, []certs.Item{
+			{Key: "ca-certificates.crt", Path: "ca-certificates.crt"},
+			{Key: hash + ".0", Path: hash + ".0"},
+			{Key: hash + ".1", Path: hash + ".1"},
+			{Key: "cacerts", Path: "java/cacerts"},
+		}, cm.Items(certs.Debian))
+
+		require.Equal(t, []certs.Item{
+			{Key: "ca-certificates.crt", Path: "tls/certs/ca-bundle.crt"},
+			{Key: "ca-certificates.crt", Path: "tls/certs/ca-bundle.trust.crt"},
+			{Key: "ca-certificates.crt", Path: "ca-trust/extracted/pem/tls-ca-bundle.pem"},
+			{Key: "ca-certificates.crt", Path: "ca-trust/extracted/openssl/ca-bundle.trust.crt"},
+			{Key: hash + ".0", Path: "tls/certs/" + hash + ".0"},
+			{Key: hash + ".1", Path: "tls/certs/" + hash + ".1"},
+			{Key: "cacerts", Path: "ca-trust/extracted/java/cacerts"},
+		}, cm.Items(certs.RHEL))
+	})
+
+	it("finds the strategy of the items", func() {
+		for _, strategy := range []certs.Strategy{certs.Debian, certs.RHEL, certs.Alpine, certs.SUSE} {
+			found, ok := certs.StrategyForItems(cm.Items(strategy))
+			require.True(t, ok)
+			require.Equal(t, strategy.Name, found.Name)
+		}
+
+		_, ok := certs.StrategyForItems([]certs.Item{{Key: "ca-certificates.crt", Path: "other.crt"}})
+		require.False(t, ok)
+	})
+}
@@ -0,0 +1,160 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"sort"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+// ASN.1 string tags that OpenSSL canonicalizes when hashing a name.
+const (
+	tagUTF8String      = 12
+	tagPrintableString = 19
+	tagT61String       = 20
+	tagIA5String       = 22
+	tagVisibleString   = 26
+	tagUniversalString = 28
+	tagBMPString       = 30
+)
+
+type attributeTypeAndValue struct {
+	Type  asn1.ObjectIdentifier
+	Value asn1.RawValue
+}
+
+// SubjectHash returns the hash OpenSSL uses to look up a certificate in a
+// certificate directory, as printed by `openssl x509 -subject_hash`.
+func SubjectHash(cert *x509.Certificate) (uint32, error) {
+	canon, err := canonicalName(cert.RawSubject)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sha1.Sum(canon)
+	return binary.LittleEndian.Uint32(sum[:4]), nil
+}
+
+// canonicalName is the encoding of a name OpenSSL hashes: every RDN set is
+// DER encoded with string values converted to lowercase UTF8Strings with
+// collapsed whitespace, and the sets are concatenated without the outer
+// sequence.
+func canonicalName(rawName []byte) ([]byte, error) {
+	var rdns []asn1.RawValue
+	if rest, err := asn1.Unmarshal(rawName, &rdns); err != nil {
+		return nil, fmt.Errorf("invalid name: %v", err)
+	} else if len(rest) != 0 {
+		return nil, fmt.Errorf("invalid name: trailing data")
+	}
+
+	var canon []byte
+	for _, rdn := range rdns {
+		var avas [][]byte
+		for data := rdn.Bytes; len(data) > 0; {
+			var ava attributeTypeAndValue
+			var err error
+			if data, err = asn1.Unmarshal(data, &ava); err != nil {
+				return nil, fmt.Errorf("invalid name attribute: %v", err)
+			}
+
+			if value, ok := canonicalValue(ava.Value); ok {
+				ava.Value = asn1.RawValue{Tag: tagUTF8String, Bytes: value}
+			}
+
+			encoded, err := asn1.Marshal(ava)
+			if err != nil {
+				return nil, err
+			}
+			avas = append(avas, encoded)
+		}
+
+		// DER orders the elements of a SET OF by their encoding.
+		sort.Slice(avas, func(i, j int) bool {
+			return bytes.Compare(avas[i], avas[j]) < 0
+		})
+
+		set, err := asn1.Marshal(asn1.RawValue{
+			Tag:        asn1.TagSet,
+			IsCompound: true,
+			Bytes:      bytes.Join(avas, nil),
+		})
+		if err != nil {
+			return nil, err
+		}
+		canon = append(canon, set...)
+	}
+	return canon, nil
+}
+
+// canonicalValue converts a string value to UTF-8, trims it, collapses runs
+// of whitespace and lowercases ASCII letters. ok is false for values that are
+// not strings.
+func canonicalValue(v asn1.RawValue) (value []byte, ok bool) {
+	if v.Class != asn1.ClassUniversal {
+		return nil, false
+	}
+
+	var s []byte
+	switch v.Tag {
+	case tagUTF8String, tagPrintableString, tagIA5String, tagVisibleString:
+		s = v.Bytes
+	case tagT61String:
+		// OpenSSL treats T61String as Latin-1.
+		for _, b := range v.Bytes {
+			s = utf8.AppendRune(s, rune(b))
+		}
+	case tagBMPString:
+		units := make([]uint16, len(v.Bytes)/2)
+		for i := range units {
+			units[i] = binary.BigEndian.Uint16(v.Bytes[2*i:])
+		}
+		for _, r := range utf16.Decode(units) {
+			s = utf8.AppendRune(s, r)
+		}
+	case tagUniversalString:
+		for i := 0; i+4 <= len(v.Bytes); i += 4 {
+			s = utf8.AppendRune(s, rune(binary.BigEndian.Uint32(v.Bytes[i:])))
+		}
+	default:
+		return nil, false
+	}
+
+	s = bytes.TrimFunc(s, func(r rune) bool { return r < utf8.RuneSelf && isSpace(byte(r)) })
+
+	value = make([]byte, 0, len(s))
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c >= utf8.RuneSelf:
+			value = append(value, c)
+			i++
+		case isSpace(c):
+			value = append(value, ' ')
+			for i < len(s) && isSpace(s[i]) {
+				i++
+			}
+		default:
+			if 'A' <= c && c <= 'Z' {
+				c += 'a' - 'A'
+			}
+			value = append(value, c)
+			i++
+		}
+	}
+	return value, true
+}
+
+func isSpace(c byte) bool {
+	switch c {
+	case ' ', '\t', '\n', '\v', '\f', '\r':
+		return true
+	}
+	return false
+}
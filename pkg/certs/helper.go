@@ -0,0 +1,51 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certs
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// HelperPathEnv is the env var setup-ca-certs reads the path to install
+// itself at from. The installed helper is statically linked, so it runs in
+// the init container based on the application image that merges the
+// injected certificates into the trust store of that image.
+const HelperPathEnv = "CA_CERTS_HELPER_PATH"
+
+// InstallHelper copies the running executable to path.
+func InstallHelper(path string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	src, err := os.Open(executable)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	dst, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0755)
+	if err != nil {
+		return err
+	}
+
+	// The mode of an existing file is not changed by OpenFile.
+	if err := dst.Chmod(0755); err != nil {
+		dst.Close()
+		return err
+	}
+
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
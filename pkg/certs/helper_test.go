@@ -0,0 +1,35 @@
+package certs_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+func TestHelper(t *testing.T) {
+	spec.Run(t, "Helper", testHelper)
+}
+
+func testHelper(t *testing.T, when spec.G, it spec.S) {
+	it("copies the running executable", func() {
+		path := filepath.Join(t.TempDir(), "bin", "setup-ca-certs")
+
+		require.NoError(t, certs.InstallHelper(path))
+
+		executable, err := os.Executable()
+		require.NoError(t, err)
+		expected, err := os.ReadFile(executable)
+		require.NoError(t, err)
+		actual, err := os.ReadFile(path)
+		require.NoError(t, err)
+		require.Equal(t, expected, actual)
+
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		require.Equal(t, os.FileMode(0755), info.Mode().Perm())
+	})
+}
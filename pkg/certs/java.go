@@ -0,0 +1,268 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certs
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+	"unicode/utf16"
+)
+
+// JavaTrustStorePassword is the password of the Java truststores, the
+// well-known default of the JDK's cacerts.
+const JavaTrustStorePassword = "changeit"
+
+// JavaTrustStoreTypeEnv is the env var setup-ca-certs reads the type of the
+// Java truststore from.
+const JavaTrustStoreTypeEnv = "JAVA_TRUSTSTORE_TYPE"
+
+// JavaTrustStoreType is the format of a Java truststore.
+type JavaTrustStoreType string
+
+const (
+	JavaTrustStorePKCS12 JavaTrustStoreType = "PKCS12"
+	JavaTrustStoreJKS    JavaTrustStoreType = "JKS"
+)
+
+// ParseJavaTrustStoreType defaults to JavaTrustStorePKCS12 when t is empty.
+func ParseJavaTrustStoreType(t string) (JavaTrustStoreType, error) {
+	switch {
+	case t == "":
+		return JavaTrustStorePKCS12, nil
+	case strings.EqualFold(t, string(JavaTrustStorePKCS12)):
+		return JavaTrustStorePKCS12, nil
+	case strings.EqualFold(t, string(JavaTrustStoreJKS)):
+		return JavaTrustStoreJKS, nil
+	default:
+		return "", fmt.Errorf("invalid java truststore type %q, must be one of %q or %q", t, JavaTrustStorePKCS12, JavaTrustStoreJKS)
+	}
+}
+
+var (
+	oidData                = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidCertBag             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 12, 10, 1, 3}
+	oidX509Certificate     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 22, 1}
+	oidFriendlyName        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 20}
+	oidSHA1                = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidAnyExtendedKeyUsage = asn1.ObjectIdentifier{2, 5, 29, 37, 0}
+
+	// oidJavaTrustedKeyUsage marks a certificate bag as a trusted
+	// certificate entry for the JDK.
+	oidJavaTrustedKeyUsage = asn1.ObjectIdentifier{2, 16, 840, 1, 113894, 746875, 1, 1}
+)
+
+const pkcs12MacIterations = 10000
+
+type pfx struct {
+	Version  int
+	AuthSafe contentInfo
+	MacData  macData
+}
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue
+}
+
+type macData struct {
+	Mac        digestInfo
+	MacSalt    []byte
+	Iterations int
+}
+
+type digestInfo struct {
+	Algorithm algorithmIdentifier
+	Digest    []byte
+}
+
+type algorithmIdentifier struct {
+	Algorithm  asn1.ObjectIdentifier
+	Parameters asn1.RawValue
+}
+
+type safeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue
+	Attributes []pkcs12Attribute `asn1:"set"`
+}
+
+type certBag struct {
+	ID   asn1.ObjectIdentifier
+	Data []byte `asn1:"explicit,tag:0"`
+}
+
+type pkcs12Attribute struct {
+	ID     asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// PKCS12 encodes the certificates as a PKCS#12 truststore the JDK reads as
+// trusted certificate entries. The certificates are not encrypted, the store
+// is integrity protected with password.
+func (ts *TrustStore) PKCS12(password string) ([]byte, error) {
+	var bags []safeBag
+	for _, c := range ts.certs {
+		bag, err := asn1.Marshal(certBag{ID: oidX509Certificate, Data: c.der})
+		if err != nil {
+			return nil, err
+		}
+
+		trusted, err := asn1.Marshal(oidAnyExtendedKeyUsage)
+		if err != nil {
+			return nil, err
+		}
+
+		bags = append(bags, safeBag{
+			ID:    oidCertBag,
+			Value: explicit(bag),
+			Attributes: []pkcs12Attribute{
+				{ID: oidFriendlyName, Values: []asn1.RawValue{{Tag: asn1.TagBMPString, Bytes: bmpString(c.alias())}}},
+				{ID: oidJavaTrustedKeyUsage, Values: []asn1.RawValue{{FullBytes: trusted}}},
+			},
+		})
+	}
+
+	safeContents, err := asn1.Marshal(bags)
+	if err != nil {
+		return nil, err
+	}
+
+	authSafe, err := asn1.Marshal([]contentInfo{dataContentInfo(safeContents)})
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 20)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	key := pkcs12KDF(append(bmpString(password), 0, 0), salt, 3, pkcs12MacIterations, sha1.Size)
+	mac := hmac.New(sha1.New, key)
+	mac.Write(authSafe)
+
+	return asn1.Marshal(pfx{
+		Version:  3,
+		AuthSafe: dataContentInfo(authSafe),
+		MacData: macData{
+			Mac: digestInfo{
+				Algorithm: algorithmIdentifier{Algorithm: oidSHA1, Parameters: asn1.NullRawValue},
+				Digest:    mac.Sum(nil),
+			},
+			MacSalt:    salt,
+			Iterations: pkcs12MacIterations,
+		},
+	})
+}
+
+func dataContentInfo(data []byte) contentInfo {
+	octets, _ := asn1.Marshal(data)
+	return contentInfo{ContentType: oidData, Content: explicit(octets)}
+}
+
+// explicit tags an encoded value with [0] EXPLICIT. encoding/asn1 ignores
+// the tag of a struct field for raw values.
+func explicit(encoded []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: encoded}
+}
+
+// pkcs12KDF derives a key from password as described in RFC 7292, Appendix
+// B.2, using SHA-1.
+func pkcs12KDF(password, salt []byte, id byte, iterations, size int) []byte {
+	const v = 64
+
+	fill := func(b []byte) []byte {
+		if len(b) == 0 {
+			return nil
+		}
+		out := make([]byte, v*((len(b)+v-1)/v))
+		for i := range out {
+			out[i] = b[i%len(b)]
+		}
+		return out
+	}
+
+	d := bytes.Repeat([]byte{id}, v)
+	i := append(fill(salt), fill(password)...)
+
+	var key []byte
+	one := big.NewInt(1)
+	for len(key) < size {
+		h := sha1.Sum(append(d, i...))
+		a := h[:]
+		for n := 1; n < iterations; n++ {
+			h = sha1.Sum(a)
+			a = h[:]
+		}
+		key = append(key, a...)
+
+		b := new(big.Int).SetBytes(fill(a))
+		b.Add(b, one)
+		for j := 0; j < len(i); j += v {
+			block := new(big.Int).SetBytes(i[j : j+v])
+			block.Add(block, b)
+			// Keep the low v bytes, the addition is modulo 2^(v*8).
+			block.SetBytes(block.Bytes()[max(0, len(block.Bytes())-v):])
+			block.FillBytes(i[j : j+v])
+		}
+	}
+	return key[:size]
+}
+
+func bmpString(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
+
+// JKS encodes the certificates as a JKS truststore for JDKs that cannot read
+// PKCS#12.
+func (ts *TrustStore) JKS(password string) ([]byte, error) {
+	const (
+		magic        = 0xfeedfeed
+		version      = 2
+		trustedEntry = 2
+	)
+
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		_ = binary.Write(&buf, binary.BigEndian, v)
+	}
+	writeUTF := func(s string) {
+		write(uint16(len(s)))
+		buf.WriteString(s)
+	}
+
+	write(uint32(magic))
+	write(uint32(version))
+	write(uint32(len(ts.certs)))
+
+	now := time.Now().UnixMilli()
+	for _, c := range ts.certs {
+		write(uint32(trustedEntry))
+		writeUTF(c.alias())
+		write(now)
+		writeUTF("X.509")
+		write(uint32(len(c.der)))
+		buf.Write(c.der)
+	}
+
+	h := sha1.New()
+	h.Write(bmpString(password))
+	h.Write([]byte("Mighty Aphrodite"))
+	h.Write(buf.Bytes())
+	buf.Write(h.Sum(nil))
+
+	return buf.Bytes(), nil
+}
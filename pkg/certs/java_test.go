@@ -0,0 +1,212 @@
+package certs_test
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/asn1"
+	"encoding/binary"
+	"encoding/pem"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+	"unicode/utf16"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+func TestJavaTrustStore(t *testing.T) {
+	spec.Run(t, "JavaTrustStore", testJavaTrustStore)
+}
+
+type testContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type testSafeBag struct {
+	ID         asn1.ObjectIdentifier
+	Value      asn1.RawValue `asn1:"explicit,tag:0"`
+	Attributes []struct {
+		ID     asn1.ObjectIdentifier
+		Values []asn1.RawValue `asn1:"set"`
+	} `asn1:"set"`
+}
+
+func testJavaTrustStore(t *testing.T, when spec.G, it spec.S) {
+	// use insecure prng for certs since this is just a test
+	source := rand.NewSource(time.Now().UnixNano())
+	prng := rand.New(source)
+
+	var (
+		ts       *certs.TrustStore
+		c1, c2   string
+		der1     []byte
+		der2     []byte
+		password = certs.JavaTrustStorePassword
+	)
+
+	it.Before(func() {
+		c1 = makeCaCert(t, prng)
+		c2 = makeCaCert(t, prng)
+
+		block, _ := pem.Decode([]byte(c1))
+		der1 = block.Bytes
+		block, _ = pem.Decode([]byte(c2))
+		der2 = block.Bytes
+
+		ts = certs.NewTrustStore()
+		_, err := ts.Add("system", []byte(c1))
+		require.NoError(t, err)
+		_, err = ts.Add("injected", []byte(c2))
+		require.NoError(t, err)
+	})
+
+	when("PKCS12", func() {
+		it("stores the certificates as trusted certificate bags named by alias", func() {
+			data, err := ts.PKCS12(password)
+			require.NoError(t, err)
+
+			var pfx struct {
+				Version  int
+				AuthSafe testContentInfo
+				MacData  asn1.RawValue
+			}
+			_, err = asn1.Unmarshal(data, &pfx)
+			require.NoError(t, err)
+			require.Equal(t, 3, pfx.Version)
+
+			var authSafeData []byte
+			_, err = asn1.Unmarshal(pfx.AuthSafe.Content.Bytes, &authSafeData)
+			require.NoError(t, err)
+
+			var authSafe []testContentInfo
+			_, err = asn1.Unmarshal(authSafeData, &authSafe)
+			require.NoError(t, err)
+			require.Len(t, authSafe, 1)
+
+			var safeContentsData []byte
+			_, err = asn1.Unmarshal(authSafe[0].Content.Bytes, &safeContentsData)
+			require.NoError(t, err)
+
+			var bags []testSafeBag
+			_, err = asn1.Unmarshal(safeContentsData, &bags)
+			require.NoError(t, err)
+			require.Len(t, bags, 2)
+
+			for i, expected := range []struct {
+				alias string
+				der   []byte
+			}{{"system_0", der1}, {"injected_0", der2}} {
+				var certBag struct {
+					ID   asn1.ObjectIdentifier
+					Data []byte `asn1:"explicit,tag:0"`
+				}
+				_, err = asn1.Unmarshal(bags[i].Value.Bytes, &certBag)
+				require.NoError(t, err)
+				require.Equal(t, expected.der, certBag.Data)
+
+				attributes := map[string]asn1.RawValue{}
+				for _, a := range bags[i].Attributes {
+					attributes[a.ID.String()] = a.Values[0]
+				}
+				require.Equal(t, bmp(expected.alias), attributes["1.2.840.113549.1.9.20"].Bytes)
+				require.Contains(t, attributes, "2.16.840.1.113894.746875.1.1")
+			}
+		})
+	})
+
+	when("JKS", func() {
+		it("stores the certificates as trusted certificate entries", func() {
+			data, err := ts.JKS(password)
+			require.NoError(t, err)
+
+			body, digest := data[:len(data)-sha1.Size], data[len(data)-sha1.Size:]
+			h := sha1.New()
+			h.Write(bmp(password))
+			h.Write([]byte("Mighty Aphrodite"))
+			h.Write(body)
+			require.Equal(t, h.Sum(nil), digest)
+
+			r := bytes.NewReader(body)
+			readUint32 := func() uint32 {
+				var v uint32
+				require.NoError(t, binary.Read(r, binary.BigEndian, &v))
+				return v
+			}
+			readUTF := func() string {
+				var n uint16
+				require.NoError(t, binary.Read(r, binary.BigEndian, &n))
+				b := make([]byte, n)
+				_, err := r.Read(b)
+				require.NoError(t, err)
+				return string(b)
+			}
+
+			require.Equal(t, uint32(0xfeedfeed), readUint32())
+			require.Equal(t, uint32(2), readUint32())
+			require.Equal(t, uint32(2), readUint32())
+
+			for _, expected := range []struct {
+				alias string
+				der   []byte
+			}{{"system_0", der1}, {"injected_0", der2}} {
+				require.Equal(t, uint32(2), readUint32())
+				require.Equal(t, expected.alias, readUTF())
+				var timestamp int64
+				require.NoError(t, binary.Read(r, binary.BigEndian, &timestamp))
+				require.Equal(t, "X.509", readUTF())
+				der := make([]byte, readUint32())
+				_, err := r.Read(der)
+				require.NoError(t, err)
+				require.Equal(t, expected.der, der)
+			}
+			require.Zero(t, r.Len())
+		})
+	})
+
+	when("WriteJava", func() {
+		it("writes the truststore where the strategy expects it", func() {
+			dir, err := os.MkdirTemp("", "java")
+			require.NoError(t, err)
+			defer os.RemoveAll(dir)
+
+			require.NoError(t, ts.Write(dir, certs.RHEL))
+			require.FileExists(t, filepath.Join(dir, "ca-trust/extracted/java/cacerts"))
+			require.NoFileExists(t, filepath.Join(dir, "ca-trust/extracted/java/cacerts.jks"))
+
+			require.NoError(t, ts.WriteJava(dir, certs.RHEL, certs.JavaTrustStoreJKS))
+			require.FileExists(t, filepath.Join(dir, "ca-trust/extracted/java/cacerts.jks"))
+		})
+	})
+
+	when("ParseJavaTrustStoreType", func() {
+		it("defaults to PKCS12", func() {
+			tsType, err := certs.ParseJavaTrustStoreType("")
+			require.NoError(t, err)
+			require.Equal(t, certs.JavaTrustStorePKCS12, tsType)
+		})
+
+		it("ignores the case", func() {
+			tsType, err := certs.ParseJavaTrustStoreType("jks")
+			require.NoError(t, err)
+			require.Equal(t, certs.JavaTrustStoreJKS, tsType)
+		})
+
+		it("fails on unknown types", func() {
+			_, err := certs.ParseJavaTrustStoreType("BKS")
+			require.EqualError(t, err, `invalid java truststore type "BKS", must be one of "PKCS12" or "JKS"`)
+		})
+	})
+}
+
+func bmp(s string) []byte {
+	var b []byte
+	for _, r := range utf16.Encode([]rune(s)) {
+		b = append(b, byte(r>>8), byte(r))
+	}
+	return b
+}
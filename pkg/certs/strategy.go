@@ -0,0 +1,164 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certs
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// StrategyEnv is the env var setup-ca-certs reads the name of the strategy
+// from.
+const StrategyEnv = "TRUST_STORE_STRATEGY"
+
+// Strategy is the trust store layout of a family of distributions: the files
+// setup-ca-certs writes to the volume and where the volume is mounted.
+type Strategy struct {
+	Name string
+
+	// Bundles are the paths of the bundle files in the volume.
+	Bundles []string
+
+	// Dirs are the directories in the volume that get a file and a subject
+	// hash link per certificate.
+	Dirs []string
+
+	// JavaTrustStore is the path of the Java truststore in the volume.
+	JavaTrustStore string
+
+	// Mounts are where the volume is mounted in the containers.
+	Mounts []Mount
+}
+
+// Mount mounts SubPath of the volume, or all of it when SubPath is empty, at
+// Path.
+type Mount struct {
+	Path    string
+	SubPath string
+}
+
+var (
+	// Debian is also used by Ubuntu and distroless images.
+	Debian = Strategy{
+		Name:           "debian",
+		Bundles:        []string{BundleFileName},
+		Dirs:           []string{""},
+		JavaTrustStore: "java/cacerts",
+		Mounts:         []Mount{{Path: "/etc/ssl/certs"}},
+	}
+
+	// RHEL is also used by UBI, Fedora and CentOS images. OpenSSL reads the
+	// certificate directory, while most other clients read one of the
+	// extracted bundles.
+	RHEL = Strategy{
+		Name: "rhel",
+		Bundles: []string{
+			"tls/certs/ca-bundle.crt",
+			"tls/certs/ca-bundle.trust.crt",
+			"ca-trust/extracted/pem/tls-ca-bundle.pem",
+			"ca-trust/extracted/openssl/ca-bundle.trust.crt",
+		},
+		Dirs:           []string{"tls/certs"},
+		JavaTrustStore: "ca-trust/extracted/java/cacerts",
+		Mounts: []Mount{
+			{Path: "/etc/pki/tls/certs", SubPath: "tls/certs"},
+			{Path: "/etc/pki/ca-trust/extracted", SubPath: "ca-trust/extracted"},
+		},
+	}
+
+	// Alpine reads /etc/ssl/cert.pem besides the Debian style directory.
+	Alpine = Strategy{
+		Name:           "alpine",
+		Bundles:        []string{"certs/" + BundleFileName, "cert.pem"},
+		Dirs:           []string{"certs"},
+		JavaTrustStore: "certs/java/cacerts",
+		Mounts: []Mount{
+			{Path: "/etc/ssl/certs", SubPath: "certs"},
+			{Path: "/etc/ssl/cert.pem", SubPath: "cert.pem"},
+		},
+	}
+
+	// SUSE links /etc/ssl/certs and /etc/ssl/ca-bundle.pem into
+	// /var/lib/ca-certificates.
+	SUSE = Strategy{
+		Name:           "suse",
+		Bundles:        []string{"ca-bundle.pem"},
+		Dirs:           []string{"pem"},
+		JavaTrustStore: "java-cacerts",
+		Mounts:         []Mount{{Path: "/var/lib/ca-certificates"}},
+	}
+
+	strategies = []Strategy{Debian, RHEL, Alpine, SUSE}
+)
+
+// JavaTrustStorePath returns the path of the Java truststore of type t in
+// the volume.
+func (s Strategy) JavaTrustStorePath(t JavaTrustStoreType) string {
+	if t == JavaTrustStoreJKS {
+		return s.JavaTrustStore + ".jks"
+	}
+	return s.JavaTrustStore
+}
+
+// MountedPath returns the path in the containers of the file at volumePath
+// in the volume. ok is false when the file is not mounted.
+func (s Strategy) MountedPath(volumePath string) (mounted string, ok bool) {
+	for _, m := range s.Mounts {
+		switch {
+		case m.SubPath == "":
+			return path.Join(m.Path, volumePath), true
+		case volumePath == m.SubPath:
+			return m.Path, true
+		case strings.HasPrefix(volumePath, m.SubPath+"/"):
+			return path.Join(m.Path, strings.TrimPrefix(volumePath, m.SubPath+"/")), true
+		}
+	}
+	return "", false
+}
+
+// WithMountPath returns the strategy with its certificate directory, the
+// first of its mounts, mounted at p.
+func (s Strategy) WithMountPath(p string) Strategy {
+	mounts := append([]Mount(nil), s.Mounts...)
+	mounts[0].Path = p
+	s.Mounts = mounts
+	return s
+}
+
+// WithFileMounts returns the strategy that mounts its bundles and the files,
+// paths in the volume, one by one with a subPath where it would mount them
+// otherwise. This leaves the other files of the directories in the image in
+// place. Files the strategy does not mount are skipped.
+func (s Strategy) WithFileMounts(files []string) Strategy {
+	var mounts []Mount
+	seen := map[string]bool{}
+	for _, f := range append(append([]string(nil), s.Bundles...), files...) {
+		mounted, ok := s.MountedPath(f)
+		if !ok || seen[mounted] {
+			continue
+		}
+		seen[mounted] = true
+		mounts = append(mounts, Mount{Path: mounted, SubPath: f})
+	}
+	s.Mounts = mounts
+	return s
+}
+
+// StrategyFor returns the strategy with the name. It defaults to Debian when
+// name is empty.
+func StrategyFor(name string) (Strategy, error) {
+	if name == "" {
+		return Debian, nil
+	}
+
+	names := make([]string, 0, len(strategies))
+	for _, s := range strategies {
+		if s.Name == name {
+			return s, nil
+		}
+		names = append(names, s.Name)
+	}
+	return Strategy{}, fmt.Errorf("invalid trust store strategy %q, must be one of %s", name, strings.Join(names, ", "))
+}
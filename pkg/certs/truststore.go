@@ -0,0 +1,203 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certs
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// BundleFileName is the name of the bundle in a Debian style certificate
+// directory such as /etc/ssl/certs.
+const BundleFileName = "ca-certificates.crt"
+
+// TrustStore builds certificate directories like update-ca-certificates and
+// c_rehash do: a bundle of all certificates, a file per certificate and an
+// OpenSSL subject hash link to each of those files.
+type TrustStore struct {
+	certs []storeCert
+	seen  map[[sha256.Size]byte]bool
+}
+
+type storeCert struct {
+	name string
+	hash uint32
+	der  []byte
+	pem  []byte
+}
+
+// alias is the name of the certificate in Java truststores.
+func (c storeCert) alias() string {
+	return strings.TrimSuffix(c.name, ".pem")
+}
+
+func NewTrustStore() *TrustStore {
+	return &TrustStore{seen: map[[sha256.Size]byte]bool{}}
+}
+
+// Add adds the certificates in the PEM data. The files of the certificates
+// are named <prefix>_<n>.pem. Certificates that were already added are
+// skipped.
+func (ts *TrustStore) Add(prefix string, data []byte) (int, error) {
+	return ts.add(prefix, data, nil)
+}
+
+// AddSystem adds the certificates in the PEM data like Add, but skips the
+// certificates that cannot be parsed and returns their errors instead. It
+// is meant for the bundles of images, which should not keep the injected
+// certificates from being trusted over a root that Go rejects.
+func (ts *TrustStore) AddSystem(prefix string, data []byte) (int, []error) {
+	var skipped []error
+	added, _ := ts.add(prefix, data, func(err error) {
+		skipped = append(skipped, err)
+	})
+	return added, skipped
+}
+
+// add adds the certificates in the PEM data. Certificates that cannot be
+// added are passed to skip, or fail when skip is nil.
+func (ts *TrustStore) add(prefix string, data []byte, skip func(error)) (int, error) {
+	var added int
+	for block, rest := pem.Decode(data); block != nil; block, rest = pem.Decode(rest) {
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			err = fmt.Errorf("failed to parse certificate: %v", err)
+			if skip == nil {
+				return added, err
+			}
+			skip(err)
+			continue
+		}
+
+		fingerprint := sha256.Sum256(cert.Raw)
+		if ts.seen[fingerprint] {
+			continue
+		}
+
+		hash, err := SubjectHash(cert)
+		if err != nil {
+			err = fmt.Errorf("failed to hash certificate subject %q: %v", cert.Subject, err)
+			if skip == nil {
+				return added, err
+			}
+			skip(err)
+			continue
+		}
+
+		ts.seen[fingerprint] = true
+		ts.certs = append(ts.certs, storeCert{
+			name: fmt.Sprintf("%s_%d.pem", prefix, added),
+			hash: hash,
+			der:  cert.Raw,
+			pem:  pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Raw}),
+		})
+		added++
+	}
+	return added, nil
+}
+
+// Len returns the number of certificates in the store.
+func (ts *TrustStore) Len() int {
+	return len(ts.certs)
+}
+
+// Bundle returns the PEM encoded certificates.
+func (ts *TrustStore) Bundle() []byte {
+	var bundle []byte
+	for _, c := range ts.certs {
+		bundle = append(bundle, c.pem...)
+	}
+	return bundle
+}
+
+// Write writes the bundles, the certificate files, the hash links and the
+// PKCS#12 Java truststore of the strategy to dir. The links are relative so
+// the directory can be mounted anywhere.
+func (ts *TrustStore) Write(dir string, strategy Strategy) error {
+	for _, d := range strategy.Dirs {
+		if err := ts.writeDir(filepath.Join(dir, d)); err != nil {
+			return err
+		}
+	}
+
+	bundle := ts.Bundle()
+	for _, b := range strategy.Bundles {
+		if err := writeFile(filepath.Join(dir, b), bundle); err != nil {
+			return err
+		}
+	}
+
+	if strategy.JavaTrustStore == "" {
+		return nil
+	}
+	return ts.WriteJava(dir, strategy, JavaTrustStorePKCS12)
+}
+
+// WriteJava writes the Java truststore of type t to where strategy expects
+// it in dir.
+func (ts *TrustStore) WriteJava(dir string, strategy Strategy, t JavaTrustStoreType) error {
+	var data []byte
+	var err error
+	switch t {
+	case JavaTrustStoreJKS:
+		data, err = ts.JKS(JavaTrustStorePassword)
+	default:
+		data, err = ts.PKCS12(JavaTrustStorePassword)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to encode %s truststore: %v", t, err)
+	}
+
+	return writeFile(filepath.Join(dir, strategy.JavaTrustStorePath(t)), data)
+}
+
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0644)
+}
+
+func (ts *TrustStore) writeDir(dir string) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+
+	links := ts.hashLinks()
+	for i, c := range ts.certs {
+		if err := os.WriteFile(filepath.Join(dir, c.name), c.pem, 0644); err != nil {
+			return err
+		}
+
+		link := filepath.Join(dir, links[i])
+		if err := os.Remove(link); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		if err := os.Symlink(c.name, link); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hashLinks returns the name of the subject hash link of each certificate.
+// Certificates with the same subject hash are numbered.
+func (ts *TrustStore) hashLinks() []string {
+	links := make([]string, len(ts.certs))
+	hashes := map[uint32]int{}
+	for i, c := range ts.certs {
+		links[i] = fmt.Sprintf("%08x.%d", c.hash, hashes[c.hash])
+		hashes[c.hash]++
+	}
+	return links
+}
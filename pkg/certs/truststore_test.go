@@ -0,0 +1,258 @@
+package certs_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/sclevine/spec"
+	"github.com/stretchr/testify/require"
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/certs"
+)
+
+func TestTrustStore(t *testing.T) {
+	spec.Run(t, "TrustStore", testTrustStore)
+}
+
+func makeNamedCaCert(t *testing.T, rng io.Reader, subject pkix.Name) *x509.Certificate {
+	t.Helper()
+	pKey, err := ecdsa.GenerateKey(elliptic.P256(), rng)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               subject,
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rng, tmpl, tmpl, &pKey.PublicKey, pKey)
+	require.NoError(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return cert
+}
+
+func testTrustStore(t *testing.T, when spec.G, it spec.S) {
+	// use insecure prng for certs since this is just a test
+	source := rand.NewSource(time.Now().UnixNano())
+	prng := rand.New(source)
+
+	when("SubjectHash", func() {
+		it("matches openssl x509 -subject_hash", func() {
+			for expected, subject := range map[string]pkix.Name{
+				"2709036b": {CommonName: "Some CA"},
+				"cb040a45": {CommonName: "  SOME   \t CA  ", Organization: []string{"Example, Inc."}},
+				"8e208b8c": {CommonName: "Ünïcödé CA", Country: []string{"DE"}},
+				"eea339da": {},
+			} {
+				hash, err := certs.SubjectHash(makeNamedCaCert(t, prng, subject))
+				require.NoError(t, err)
+				require.Equal(t, expected, fmt.Sprintf("%08x", hash))
+			}
+		})
+	})
+
+	when("Write", func() {
+		var dir string
+
+		it.Before(func() {
+			var err error
+			dir, err = os.MkdirTemp("", "truststore")
+			require.NoError(t, err)
+		})
+
+		it.After(func() {
+			require.NoError(t, os.RemoveAll(dir))
+		})
+
+		it("writes the bundle, a file per cert and hash links", func() {
+			c1 := makeCaCert(t, prng)
+			c2 := makeCaCert(t, prng)
+			c3 := makeCaCert(t, prng)
+
+			ts := certs.NewTrustStore()
+			n, err := ts.Add("system", []byte(c1+c2))
+			require.NoError(t, err)
+			require.Equal(t, 2, n)
+
+			n, err = ts.Add("injected", []byte(c3))
+			require.NoError(t, err)
+			require.Equal(t, 1, n)
+			require.Equal(t, 3, ts.Len())
+
+			require.NoError(t, ts.Write(dir, certs.Debian))
+
+			bundle, err := os.ReadFile(filepath.Join(dir, certs.BundleFileName))
+			require.NoError(t, err)
+			require.Equal(t, c1+c2+c3, string(bundle))
+
+			for name, cert := range map[string]string{
+				"system_0.pem":   c1,
+				"system_1.pem":   c2,
+				"injected_0.pem": c3,
+			} {
+				b, err := os.ReadFile(filepath.Join(dir, name))
+				require.NoError(t, err)
+				require.Equal(t, cert, string(b))
+			}
+
+			block, _ := pem.Decode([]byte(c1))
+			parsed, err := x509.ParseCertificate(block.Bytes)
+			require.NoError(t, err)
+			hash, err := certs.SubjectHash(parsed)
+			require.NoError(t, err)
+
+			// the test certs share a subject, so their links are numbered
+			for i, name := range []string{"system_0.pem", "system_1.pem", "injected_0.pem"} {
+				target, err := os.Readlink(filepath.Join(dir, fmt.Sprintf("%08x.%d", hash, i)))
+				require.NoError(t, err)
+				require.Equal(t, name, target)
+			}
+		})
+
+		it("writes the bundles and directories of the strategy", func() {
+			c1 := makeCaCert(t, prng)
+
+			ts := certs.NewTrustStore()
+			_, err := ts.Add("injected", []byte(c1))
+			require.NoError(t, err)
+
+			require.NoError(t, ts.Write(dir, certs.RHEL))
+
+			for _, name := range []string{
+				"tls/certs/ca-bundle.crt",
+				"tls/certs/ca-bundle.trust.crt",
+				"ca-trust/extracted/pem/tls-ca-bundle.pem",
+				"ca-trust/extracted/openssl/ca-bundle.trust.crt",
+				"tls/certs/injected_0.pem",
+			} {
+				b, err := os.ReadFile(filepath.Join(dir, name))
+				require.NoError(t, err)
+				require.Equal(t, c1, string(b))
+			}
+
+			links, err := filepath.Glob(filepath.Join(dir, "tls/certs/*.0"))
+			require.NoError(t, err)
+			require.Len(t, links, 1)
+			require.NoFileExists(t, filepath.Join(dir, certs.BundleFileName))
+		})
+
+		it("skips duplicate certs", func() {
+			c1 := makeCaCert(t, prng)
+
+			ts := certs.NewTrustStore()
+			_, err := ts.Add("system", []byte(c1))
+			require.NoError(t, err)
+
+			n, err := ts.Add("injected", []byte(c1))
+			require.NoError(t, err)
+			require.Equal(t, 0, n)
+			require.Equal(t, 1, ts.Len())
+
+			require.NoError(t, ts.Write(dir, certs.Debian))
+
+			bundle, err := os.ReadFile(filepath.Join(dir, certs.BundleFileName))
+			require.NoError(t, err)
+			require.Equal(t, c1, string(bundle))
+			require.NoFileExists(t, filepath.Join(dir, "injected_0.pem"))
+		})
+
+		it("replaces existing links", func() {
+			c1 := makeCaCert(t, prng)
+
+			ts := certs.NewTrustStore()
+			_, err := ts.Add("injected", []byte(c1))
+			require.NoError(t, err)
+
+			require.NoError(t, ts.Write(dir, certs.Debian))
+			require.NoError(t, ts.Write(dir, certs.Debian))
+		})
+
+		it("fails on invalid certs", func() {
+			data := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")})
+
+			_, err := certs.NewTrustStore().Add("injected", data)
+			require.Error(t, err)
+		})
+
+		it("skips invalid system certs", func() {
+			c1 := makeCaCert(t, prng)
+			c2 := makeCaCert(t, prng)
+			invalid := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: []byte("invalid")})
+
+			ts := certs.NewTrustStore()
+			n, skipped := ts.AddSystem("system", []byte(c1+string(invalid)+c2))
+			require.Equal(t, 2, n)
+			require.Len(t, skipped, 1)
+			require.ErrorContains(t, skipped[0], "failed to parse certificate")
+
+			require.NoError(t, ts.Write(dir, certs.Debian))
+
+			bundle, err := os.ReadFile(filepath.Join(dir, certs.BundleFileName))
+			require.NoError(t, err)
+			require.Equal(t, c1+c2, string(bundle))
+			require.FileExists(t, filepath.Join(dir, "system_1.pem"))
+		})
+	})
+	when("StrategyFor", func() {
+		it("defaults to debian", func() {
+			s, err := certs.StrategyFor("")
+			require.NoError(t, err)
+			require.Equal(t, certs.Debian, s)
+		})
+
+		it("looks up strategies by name", func() {
+			for name, expected := range map[string]certs.Strategy{
+				"debian": certs.Debian,
+				"rhel":   certs.RHEL,
+				"alpine": certs.Alpine,
+				"suse":   certs.SUSE,
+			} {
+				s, err := certs.StrategyFor(name)
+				require.NoError(t, err)
+				require.Equal(t, expected, s)
+			}
+		})
+
+		it("maps volume paths to mounted paths", func() {
+			for _, tc := range []struct {
+				strategy   certs.Strategy
+				volumePath string
+				expected   string
+			}{
+				{certs.Debian, certs.Debian.JavaTrustStore, "/etc/ssl/certs/java/cacerts"},
+				{certs.RHEL, certs.RHEL.JavaTrustStore, "/etc/pki/ca-trust/extracted/java/cacerts"},
+				{certs.Alpine, "cert.pem", "/etc/ssl/cert.pem"},
+				{certs.Alpine, certs.Alpine.JavaTrustStore, "/etc/ssl/certs/java/cacerts"},
+				{certs.SUSE, certs.SUSE.JavaTrustStore, "/var/lib/ca-certificates/java-cacerts"},
+			} {
+				mounted, ok := tc.strategy.MountedPath(tc.volumePath)
+				require.True(t, ok)
+				require.Equal(t, tc.expected, mounted)
+			}
+
+			_, ok := certs.RHEL.MountedPath("tls/certsx/file")
+			require.False(t, ok)
+		})
+
+		it("fails on unknown strategies", func() {
+			_, err := certs.StrategyFor("windows")
+			require.EqualError(t, err, `invalid trust store strategy "windows", must be one of debian, rhel, alpine, suse`)
+		})
+	})
+}
@@ -0,0 +1,49 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package certinjectionpolicy
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/injection/clients/dynamicclient"
+	"knative.dev/pkg/logging"
+
+	"github.com/vmware-tanzu/cert-injection-webhook/pkg/apis/certinjection/v1alpha1"
+)
+
+func init() {
+	injection.Default.RegisterInformer(withInformer)
+}
+
+// Key is used for associating the Informer inside the context.Context.
+type Key struct{}
+
+func withInformer(ctx context.Context) (context.Context, controller.Informer) {
+	inf := dynamicinformer.NewFilteredDynamicInformer(
+		dynamicclient.Get(ctx),
+		v1alpha1.CertInjectionPolicyResource,
+		metav1.NamespaceAll,
+		controller.GetResyncPeriod(ctx),
+		cache.Indexers{},
+		nil,
+	)
+	return context.WithValue(ctx, Key{}, inf), inf.Informer()
+}
+
+// Get extracts the CertInjectionPolicy informer from the context. Policies
+// are served as unstructured objects so no generated clientset is needed.
+func Get(ctx context.Context) informers.GenericInformer {
+	untyped := ctx.Value(Key{})
+	if untyped == nil {
+		logging.FromContext(ctx).Panic(
+			"Unable to fetch k8s.io/client-go/informers.GenericInformer from context.")
+	}
+	return untyped.(informers.GenericInformer)
+}
@@ -0,0 +1,72 @@
+// Copyright 2020-Present VMware, Inc.
+// SPDX-License-Identifier: Apache-2.0
+
+package named
+
+import (
+	"context"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/client-go/informers"
+	v1 "k8s.io/client-go/informers/core/v1"
+	kubeclient "knative.dev/pkg/client/injection/kube/client"
+	"knative.dev/pkg/controller"
+	"knative.dev/pkg/injection"
+	"knative.dev/pkg/logging"
+)
+
+func init() {
+	injection.Default.RegisterFilteredInformers(withInformers)
+}
+
+// Key is used for associating the Informer of the ConfigMaps with a name
+// inside the context.Context.
+type Key struct {
+	Name string
+}
+
+// NamesKey is used for associating the names of the ConfigMaps to inform
+// about inside the context.Context.
+type NamesKey struct{}
+
+// WithNames sets the names of the ConfigMaps an informer is set up for.
+// Each informer caches the ConfigMaps of its name in every namespace rather
+// than every ConfigMap of the cluster.
+func WithNames(ctx context.Context, names ...string) context.Context {
+	return context.WithValue(ctx, NamesKey{}, names)
+}
+
+func withInformers(ctx context.Context) (context.Context, []controller.Informer) {
+	untyped := ctx.Value(NamesKey{})
+	if untyped == nil {
+		return ctx, nil
+	}
+
+	infs := []controller.Informer{}
+	for _, name := range untyped.([]string) {
+		selector := fields.OneTermEqualSelector("metadata.name", name).String()
+		f := informers.NewSharedInformerFactoryWithOptions(
+			kubeclient.Get(ctx),
+			controller.GetResyncPeriod(ctx),
+			informers.WithTweakListOptions(func(l *metav1.ListOptions) {
+				l.FieldSelector = selector
+			}),
+		)
+		inf := f.Core().V1().ConfigMaps()
+		ctx = context.WithValue(ctx, Key{Name: name}, inf)
+		infs = append(infs, inf.Informer())
+	}
+	return ctx, infs
+}
+
+// Get extracts the informer of the ConfigMaps with the name from the
+// context.
+func Get(ctx context.Context, name string) v1.ConfigMapInformer {
+	untyped := ctx.Value(Key{Name: name})
+	if untyped == nil {
+		logging.FromContext(ctx).Panicf(
+			"Unable to fetch k8s.io/client-go/informers/core/v1.ConfigMapInformer with name %s from context.", name)
+	}
+	return untyped.(v1.ConfigMapInformer)
+}